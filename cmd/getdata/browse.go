@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// Kinds of shell entries
+const (
+	nodeClient = "client"
+	nodeSite   = "site"
+	nodeDevice = "device"
+	nodeView   = "view"
+	nodeCheck  = "check"
+	nodePatch  = "patch"
+)
+
+// Views of a device offered by the shell
+const (
+	viewAsset   = "Asset details"
+	viewChecks  = "Checks"
+	viewPatches = "Patches"
+)
+
+// node is one entry of a shell list
+type node struct {
+	kind   string
+	id     int
+	name   string
+	info   string      // Secondary text shown after the name
+	alert  bool        // Failing check, highlighted in the list
+	record interface{} // Shown in the details pane
+	parent *node       // Device of a view, check or patch
+}
+
+// label is the list text of a node
+func (n *node) label() string {
+	if n.kind == nodeView {
+		return n.name
+	}
+	label := fmt.Sprintf("%-8d %s", n.id, tview.Escape(n.name))
+	if n.alert {
+		label += "  [red]failing[-]"
+	}
+	if n.info != "" {
+		label += "  [gray]" + tview.Escape(n.info) + "[-]"
+	}
+	return label
+}
+
+// matches reports whether the node contains a search text, ignoring case
+func (n *node) matches(search string) bool {
+	search = strings.ToLower(search)
+	return strings.Contains(strings.ToLower(n.name), search) ||
+		strings.Contains(strings.ToLower(n.info), search) ||
+		strings.Contains(strconv.Itoa(n.id), search)
+}
+
+// browser loads the levels of the shell from the API and, when N-Sight is
+// not reachable or there are no credentials, from the fetchall cache
+type browser struct {
+	api     *nsight.ApiClient // nil without credentials
+	dir     string            // fetchall cache directory
+	offline error             // Why the cache is used, nil while online
+	tree    []inventory.ClientDetail
+}
+
+// newBrowser creates a browser, offline from the start if api is nil
+func newBrowser(api *nsight.ApiClient, dir string, apiErr error) *browser {
+	b := &browser{api: api, dir: dir}
+	if api == nil {
+		b.offline = apiErr
+	}
+	return b
+}
+
+// online reports whether the API is used
+func (b *browser) online() bool {
+	return b.api != nil && b.offline == nil
+}
+
+// retry goes back online after N-Sight was not reachable
+func (b *browser) retry() {
+	if b.api != nil {
+		b.offline = nil
+		b.tree = nil
+	}
+}
+
+// fallBack switches to the cache when err means N-Sight cannot be reached
+// and reports whether it did
+func (b *browser) fallBack(err error) bool {
+	if errors.Is(err, nsight.ErrUnavailable) || errors.Is(err, nsight.ErrTimeout) {
+		b.offline = err
+		return true
+	}
+	return false
+}
+
+// source describes where the data comes from, for the header
+func (b *browser) source() string {
+	if b.online() {
+		return "N-Sight API"
+	}
+	updated, err := inventory.Updated(b.dir)
+	if err != nil {
+		return "offline, no fetchall cache"
+	}
+	return "offline, cache from " + updated.Local().Format(time.DateTime)
+}
+
+// cached returns the tree of the fetchall cache
+func (b *browser) cached() ([]inventory.ClientDetail, error) {
+	if b.tree == nil {
+		tree, err := inventory.BuildFromCache(b.dir)
+		if err != nil {
+			return nil, fmt.Errorf("%v; the fetchall cache is not available either: %w", b.offline, err)
+		}
+		b.tree = tree
+	}
+	return b.tree, nil
+}
+
+// clients lists the clients
+func (b *browser) clients() ([]node, error) {
+	if b.online() {
+		clients, err := b.api.FetchClients()
+		if err == nil {
+			nodes := make([]node, len(clients))
+			for i, c := range clients {
+				nodes[i] = node{kind: nodeClient, id: c.ClientID, name: c.Name, record: c}
+			}
+			return sortNodes(nodes), nil
+		}
+		if !b.fallBack(err) {
+			return nil, err
+		}
+	}
+	tree, err := b.cached()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []node
+	for _, c := range tree {
+		nodes = append(nodes, node{kind: nodeClient, id: c.ID, name: c.Name, info: fmt.Sprintf("%d sites", len(c.Sites)), record: c})
+	}
+	return sortNodes(nodes), nil
+}
+
+// sites lists the sites of a client
+func (b *browser) sites(client *node) ([]node, error) {
+	if b.online() {
+		sites, err := b.api.FetchSites(client.id)
+		if err == nil {
+			nodes := make([]node, len(sites))
+			for i, s := range sites {
+				nodes[i] = node{kind: nodeSite, id: s.SiteID, name: s.Name, record: s}
+			}
+			return sortNodes(nodes), nil
+		}
+		if !b.fallBack(err) {
+			return nil, err
+		}
+	}
+	tree, err := b.cached()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []node
+	for _, c := range tree {
+		if c.ID != client.id {
+			continue
+		}
+		for _, s := range c.Sites {
+			devices := len(s.Servers) + len(s.Workstations)
+			nodes = append(nodes, node{kind: nodeSite, id: s.ID, name: s.Name, info: fmt.Sprintf("%d devices", devices), record: s})
+		}
+	}
+	return sortNodes(nodes), nil
+}
+
+// devices lists the servers and workstations of a site
+func (b *browser) devices(site *node) ([]node, error) {
+	if b.online() {
+		nodes, err := b.fetchDevices(site.id)
+		if err == nil {
+			return sortNodes(nodes), nil
+		}
+		if !b.fallBack(err) {
+			return nil, err
+		}
+	}
+	tree, err := b.cached()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []node
+	for _, c := range tree {
+		for _, s := range c.Sites {
+			if s.ID != site.id {
+				continue
+			}
+			for _, server := range s.Servers {
+				nodes = append(nodes, node{kind: nodeDevice, id: server.ID, name: server.Name, info: deviceInfo("server", server.Online, server.IP), record: server})
+			}
+			for _, ws := range s.Workstations {
+				nodes = append(nodes, node{kind: nodeDevice, id: ws.ID, name: ws.Name, info: deviceInfo("workstation", ws.Online, ws.IP), record: ws})
+			}
+		}
+	}
+	return sortNodes(nodes), nil
+}
+
+// fetchDevices lists the servers and workstations of a site from the API
+func (b *browser) fetchDevices(siteID int) ([]node, error) {
+	servers, err := b.api.FetchServers(siteID)
+	if err != nil {
+		return nil, err
+	}
+	workstations, err := b.api.FetchWorkstations(siteID)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []node
+	for _, server := range servers {
+		nodes = append(nodes, node{kind: nodeDevice, id: server.ServerID, name: server.Name, info: deviceInfo("server", server.Online == 1, server.IP), record: server})
+	}
+	for _, ws := range workstations {
+		nodes = append(nodes, node{kind: nodeDevice, id: ws.WorkstationID, name: ws.Name, info: deviceInfo("workstation", ws.Online == 1, ws.IP), record: ws})
+	}
+	return nodes, nil
+}
+
+// views lists what can be shown about a device
+func (b *browser) views(device *node) []node {
+	views := make([]node, 0, 3)
+	for _, name := range []string{viewAsset, viewChecks, viewPatches} {
+		views = append(views, node{kind: nodeView, name: name, parent: device, record: device.record})
+	}
+	return views
+}
+
+// assetDetails returns the asset details of a device, from the cache when offline
+func (b *browser) assetDetails(device *node) (interface{}, error) {
+	if b.online() {
+		details, err := b.api.FetchDeviceAssetDetails(device.id)
+		if err == nil {
+			return details, nil
+		}
+		if !b.fallBack(err) {
+			return nil, err
+		}
+	}
+	switch d := device.record.(type) {
+	case inventory.ServerDetail:
+		if d.AssetInfo != nil {
+			return d.AssetInfo, nil
+		}
+	case inventory.WorkstationDetail:
+		if d.AssetInfo != nil {
+			return d.AssetInfo, nil
+		}
+	}
+	return nil, fmt.Errorf("asset details of %s are not in the fetchall cache", device.name)
+}
+
+// checks lists the checks of a device, failing ones first
+func (b *browser) checks(device *node) ([]node, error) {
+	if !b.online() {
+		return nil, fmt.Errorf("checks are not in the fetchall cache, press r to retry online")
+	}
+	checks, err := b.api.FetchChecks(device.id)
+	if err != nil {
+		b.fallBack(err)
+		return nil, err
+	}
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].Severity > checks[j].Severity })
+	nodes := make([]node, len(checks))
+	for i, c := range checks {
+		nodes[i] = node{kind: nodeCheck, id: c.CheckID, name: c.Name, info: c.Message, alert: c.Severity > 0, record: c, parent: device}
+	}
+	return nodes, nil
+}
+
+// patches lists the patches of a device
+func (b *browser) patches(device *node) ([]node, error) {
+	if !b.online() {
+		return nil, fmt.Errorf("patches are not in the fetchall cache, press r to retry online")
+	}
+	patches, err := b.api.FetchPatches(device.id)
+	if err != nil {
+		b.fallBack(err)
+		return nil, err
+	}
+	nodes := make([]node, len(patches))
+	for i, p := range patches {
+		nodes[i] = node{kind: nodePatch, id: p.PatchID, name: p.Name, info: strings.TrimSpace(p.Severity + " " + p.Status), record: p, parent: device}
+	}
+	return nodes, nil
+}
+
+// deviceInfo is the secondary text of a device
+func deviceInfo(deviceType string, online bool, ip string) string {
+	state := "offline"
+	if online {
+		state = "online"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s, %s %s", deviceType, state, ip))
+}
+
+// sortNodes orders nodes by name
+func sortNodes(nodes []node) []node {
+	sort.SliceStable(nodes, func(i, j int) bool { return strings.ToLower(nodes[i].name) < strings.ToLower(nodes[j].name) })
+	return nodes
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/output"
+	"nsight-proxy/internal/query"
+)
+
+// paramKind says what a parameter holds, for usage texts and completion
+type paramKind int
+
+const (
+	kindText paramKind = iota
+	kindID
+	kindNumber
+	kindList // Comma-separated numbers
+	kindDate
+	kindDuration
+	kindClient
+	kindSite
+	kindDevice
+	kindFile
+)
+
+// metavars name the values of each kind in usage texts, text is named after
+// the parameter
+var metavars = map[paramKind]string{
+	kindID:       "id",
+	kindNumber:   "n",
+	kindList:     "id,id,...",
+	kindDate:     "date",
+	kindDuration: "duration|date",
+	kindClient:   "client",
+	kindSite:     "site",
+	kindDevice:   "device",
+	kindFile:     "file",
+}
+
+// param is a named parameter of a command, given as --name value. The first
+// parameter of a command can also be given as its first argument, unless the
+// command takes flags only.
+type param struct {
+	name     string
+	kind     paramKind
+	usage    string
+	required bool
+	choices  []string // Accepted values, offered by completion
+	def      string   // Value used when the parameter is not given
+}
+
+// metavar names the value of p in usage texts
+func (p param) metavar() string {
+	if len(p.choices) > 0 {
+		return strings.Join(p.choices, "|")
+	}
+	if p.kind == kindText {
+		return p.name
+	}
+	return metavars[p.kind]
+}
+
+// Setup a command needs before it runs
+const (
+	needsNothing = iota // Runs without configuration
+	needsConfig         // Needs the configuration but no API client
+	needsAPI            // Calls the N-Sight API
+)
+
+// command is a getdata subcommand
+type command struct {
+	name    string
+	group   string
+	summary string
+	params  []param
+	needs   int
+	noArgs  bool // Parameters can only be given as flags
+	confirm bool // Changes data; asks first and takes --dry-run and --yes
+	run     func(inv *invocation) error
+}
+
+// scopeParams are the parameters shared with the -client and -site flags,
+// which also limit the resolution of site and device names
+var scopeParams = map[string]*string{
+	"client": &deviceScope.client,
+	"site":   &deviceScope.site,
+}
+
+// invocation is a parsed command line
+type invocation struct {
+	cmd    *command
+	values map[string]*string
+	given  map[string]bool
+	cfg    *config.Config
+	api    *nsight.ApiClient
+	dryRun bool // --dry-run of a command that confirms changes
+	yes    bool // --yes of a command that confirms changes
+}
+
+// String returns the value of a parameter, its default if it was not given
+func (inv *invocation) String(name string) string {
+	if value, ok := inv.values[name]; ok && *value != "" {
+		return *value
+	}
+	for _, p := range inv.cmd.params {
+		if p.name == name {
+			return p.def
+		}
+	}
+	return ""
+}
+
+// Given reports whether a parameter was set on the command line
+func (inv *invocation) Given(name string) bool {
+	return inv.given[name] || (scopeParams[name] != nil && *scopeParams[name] != "")
+}
+
+// Int returns a numeric parameter
+func (inv *invocation) Int(name string) (int, error) {
+	value := inv.String(name)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, usageErrorf("invalid --%s %q, expected a number", name, value)
+	}
+	return n, nil
+}
+
+// Ints returns a parameter of comma-separated numbers
+func (inv *invocation) Ints(name string) ([]int, error) {
+	parts := strings.Split(inv.String(name), ",")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, usageErrorf("invalid --%s value %q, expected comma-separated numbers", name, part)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// commands are the getdata subcommands in the order of the usage text. They
+// are set in init since help and completion refer to them.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		// -- Basic Entity Listing --
+		{name: "list_clients", group: "Basic Entity Listing", summary: "List all clients", needs: needsAPI, run: handleListClients},
+		{name: "list_sites", group: "Basic Entity Listing", summary: "List the sites of a client", needs: needsAPI, run: handleListSites,
+			params: []param{{name: "client", kind: kindClient, usage: "Client ID or name", required: true}}},
+		{name: "list_servers", group: "Basic Entity Listing", summary: "List the servers of a site", needs: needsAPI, run: handleListServers,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}}},
+		{name: "list_workstations", group: "Basic Entity Listing", summary: "List the workstations of a site", needs: needsAPI, run: handleListWorkstations,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}}},
+		{name: "list_devices", group: "Basic Entity Listing", summary: "List all devices of a site", needs: needsAPI, run: handleListDevices,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}}},
+		{name: "list_devices_at_client", group: "Basic Entity Listing", summary: "List all devices of a client", needs: needsAPI, run: handleListDevicesAtClient,
+			params: []param{{name: "client", kind: kindClient, usage: "Client ID or name", required: true}}},
+		{name: "list_agentless_assets", group: "Basic Entity Listing", summary: "List the agentless assets of a site", needs: needsAPI, run: handleListAgentlessAssets,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}}},
+
+		// -- Check and Monitoring --
+		{name: "list_failing_checks", group: "Check and Monitoring", summary: "List all failing checks", needs: needsAPI, run: handleListFailingChecks},
+		{name: "list_checks", group: "Check and Monitoring", summary: "List the checks of a device, or of a site with --site only", needs: needsAPI, run: handleListChecks,
+			params: []param{{name: "device", kind: kindDevice, usage: "Device ID, hostname, serial number, IP or MAC address"}, {name: "site", kind: kindSite, usage: "Site ID or name"}}},
+		{name: "list_device_monitoring_details", group: "Check and Monitoring", summary: "Show the monitoring details of a device", needs: needsAPI, run: handleListDeviceMonitoringDetails,
+			params: []param{deviceParam}},
+		{name: "list_check_configuration", group: "Check and Monitoring", summary: "Show the check configuration of a device", needs: needsAPI, run: handleListCheckConfiguration,
+			params: []param{deviceParam, {name: "os", usage: "Operating system of the configuration", choices: []string{"windows", "mac", "linux"}}}},
+		{name: "list_check_configuration_windows", group: "Check and Monitoring", summary: "Show the Windows check configuration of a device", needs: needsAPI, run: handleListCheckConfiguration,
+			params: []param{deviceParam}},
+		{name: "list_check_configuration_mac", group: "Check and Monitoring", summary: "Show the Mac check configuration of a device", needs: needsAPI, run: handleListCheckConfiguration,
+			params: []param{deviceParam}},
+		{name: "list_check_configuration_linux", group: "Check and Monitoring", summary: "Show the Linux check configuration of a device", needs: needsAPI, run: handleListCheckConfiguration,
+			params: []param{deviceParam}},
+		{name: "list_outages", group: "Check and Monitoring", summary: "List the outages of a site in a period", needs: needsAPI, run: handleListOutages,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}, fromParam, toParam}},
+		{name: "clear_check", group: "Check and Monitoring", summary: "Clear a failing check", needs: needsAPI, confirm: true, run: handleClearCheck,
+			params: []param{checkParam}},
+		{name: "add_check_note", group: "Check and Monitoring", summary: "Add a note to a check", needs: needsAPI, run: handleAddCheckNote,
+			params: []param{checkParam, {name: "note", usage: "Text of the note", required: true}}},
+
+		// -- Asset Tracking --
+		{name: "list_hardware", group: "Asset Tracking", summary: "List the hardware of a device", needs: needsAPI, run: handleListHardware,
+			params: []param{deviceParam}},
+		{name: "list_software", group: "Asset Tracking", summary: "List the software of a device", needs: needsAPI, run: handleListSoftware,
+			params: []param{deviceParam}},
+		{name: "list_device_asset_details", group: "Asset Tracking", summary: "Show the asset details of a device", needs: needsAPI, run: handleListDeviceAssetDetails,
+			params: []param{deviceParam}},
+		{name: "device_overview", group: "Asset Tracking", summary: "Show everything about a device in one document", needs: needsAPI, run: handleDeviceOverview,
+			params: []param{deviceParam, {name: "days", kind: kindNumber, usage: "Days of outage and performance history"}}},
+		{name: "list_license_groups", group: "Asset Tracking", summary: "List the software license groups", needs: needsAPI, run: handleListLicenseGroups},
+
+		// -- Patch Management --
+		{name: "list_patches", group: "Patch Management", summary: "List the patches of a device", needs: needsAPI, run: handleListPatches,
+			params: []param{deviceParam}},
+		{name: "approve_patch", group: "Patch Management", summary: "Approve patches of a device", needs: needsAPI, confirm: true, run: handleApprovePatches,
+			params: []param{deviceParam, patchesParam}},
+		{name: "ignore_patch", group: "Patch Management", summary: "Ignore patches of a device", needs: needsAPI, confirm: true, run: handleIgnorePatches,
+			params: []param{deviceParam, patchesParam}},
+
+		// -- Antivirus --
+		{name: "list_antivirus_products", group: "Antivirus", summary: "List the supported antivirus products", needs: needsAPI, run: handleListAntivirusProducts},
+		{name: "list_antivirus_definitions", group: "Antivirus", summary: "Show the antivirus definitions of a device", needs: needsAPI, run: handleListAntivirusDefinitions,
+			params: []param{deviceParam}},
+		{name: "list_quarantine", group: "Antivirus", summary: "List the quarantined items of a device", needs: needsAPI, run: handleListQuarantine,
+			params: []param{deviceParam}},
+		{name: "start_scan", group: "Antivirus", summary: "Start an antivirus scan on a device", needs: needsAPI, confirm: true, run: handleStartAntivirusScan,
+			params: []param{deviceParam, {name: "type", usage: "Scan type, e.g. quick or full", required: true}}},
+
+		// -- Performance and History --
+		{name: "list_performance_history", group: "Performance and History", summary: "List the performance history of a check", needs: needsAPI, run: handleListPerformanceHistory,
+			params: []param{deviceParam, {name: "check", kind: kindID, usage: "Check ID", required: true}, fromParam, toParam}},
+		{name: "list_drive_space_history", group: "Performance and History", summary: "List the drive space history of a device", needs: needsAPI, run: handleListDriveSpaceHistory,
+			params: []param{deviceParam, fromParam, toParam}},
+
+		// -- Templates --
+		{name: "list_templates", group: "Templates", summary: "List the monitoring templates", needs: needsAPI, run: handleListTemplates},
+
+		// -- Backup & Recovery --
+		{name: "list_backup_sessions", group: "Backup & Recovery", summary: "List the backup sessions of a device", needs: needsAPI, run: handleListBackupSessions,
+			params: []param{deviceParam}},
+
+		// -- Settings --
+		{name: "list_wall_chart_settings", group: "Settings", summary: "Show the wall chart settings", needs: needsAPI, run: handleListWallChartSettings},
+		{name: "list_general_settings", group: "Settings", summary: "Show the general settings", needs: needsAPI, run: handleListGeneralSettings},
+
+		// -- Tasks and Users --
+		{name: "list_active_directory_users", group: "Tasks and Users", summary: "List the Active Directory users of a device", needs: needsAPI, run: handleListActiveDirectoryUsers,
+			params: []param{deviceParam}},
+		{name: "run_task_now", group: "Tasks and Users", summary: "Run a task now", needs: needsAPI, confirm: true, run: handleRunTaskNow,
+			params: []param{{name: "task", kind: kindID, usage: "Task ID", required: true}}},
+
+		// -- Site Management --
+		{name: "add_client", group: "Site Management", summary: "Add a client", needs: needsAPI, confirm: true, run: handleAddClient,
+			params: []param{{name: "name", usage: "Name of the client", required: true}, contactNameParam, contactEmailParam}},
+		{name: "add_site", group: "Site Management", summary: "Add a site to a client", needs: needsAPI, confirm: true, run: handleAddSite,
+			params: []param{{name: "name", usage: "Name of the site", required: true}, {name: "client", kind: kindClient, usage: "Client ID or name", required: true}, contactNameParam, contactEmailParam}},
+		{name: "get_site_installation_package", group: "Site Management", summary: "Download the agent installation package of a site", needs: needsAPI, run: handleGetSiteInstallationPackage,
+			params: []param{{name: "site", kind: kindSite, usage: "Site ID or name", required: true}, {name: "type", usage: "Package type", required: true}}},
+
+		// -- Local commands --
+		{name: "audit_log", group: "Audit Log", summary: "Show the audit records of calls that changed data", needs: needsConfig, noArgs: true, run: handleAuditLog,
+			params: []param{
+				{name: "since", kind: kindDuration, usage: "Only records newer than a duration (e.g. 24h) or date (2006-01-02 or RFC 3339)"},
+				{name: "until", kind: kindDate, usage: "Only records older than a date (2006-01-02 or RFC 3339)"},
+				{name: "service", usage: "Only calls of this service, e.g. clear_check"},
+				{name: "user", usage: "Only calls by this user or tenant"},
+				{name: "tool", usage: "Only calls made by this tool, e.g. getdata or nsight-proxy"},
+				{name: "target", kind: kindID, usage: "Only calls affecting this entity ID"},
+				{name: "outcome", usage: "Only calls with this outcome, e.g. ok or not_found"},
+				{name: "limit", kind: kindNumber, usage: "Show only the most recent records"},
+				{name: "file", kind: kindFile, usage: "Audit log file, default audit.log of the configuration"},
+			}},
+		{name: "encrypt_key", group: "Credentials", summary: "Encrypt the API key read from stdin with NSIGHT_KEY_PASSPHRASE", needs: needsNothing, run: handleEncryptKey,
+			params: []param{{name: "file", kind: kindFile, usage: "Encrypted key file to write", required: true}}},
+		{name: "config", group: "Configuration", summary: "Show the effective settings, secrets redacted", needs: needsConfig, run: handleConfig,
+			params: []param{
+				{name: "action", usage: "What to do with the configuration", required: true, choices: []string{"show"}},
+				{name: "format", usage: "Output format of show", choices: []string{"yaml", "toml", "json"}, def: "yaml"},
+			}},
+		{name: "shell", group: "Shell", summary: "Browse clients, sites, devices, checks and patches interactively", needs: needsConfig, noArgs: true, run: handleShell},
+		{name: "completion", group: "Shell", summary: "Print a completion script for a shell", needs: needsNothing, run: handleCompletion,
+			params: []param{{name: "shell", usage: "Shell to complete in", required: true, choices: completionShells}}},
+		{name: "help", group: "Shell", summary: "Show the usage of getdata or of one command", needs: needsNothing, run: handleHelp,
+			params: []param{{name: "command", usage: "Command to describe"}}},
+	}
+}
+
+// Parameters shared by several commands
+var (
+	deviceParam       = param{name: "device", kind: kindDevice, usage: "Device ID, hostname, serial number, IP or MAC address", required: true}
+	checkParam        = param{name: "check", kind: kindID, usage: "Check ID", required: true}
+	patchesParam      = param{name: "patches", kind: kindList, usage: "Comma-separated patch IDs", required: true}
+	fromParam         = param{name: "from", kind: kindDate, usage: "Start of the period, e.g. 2024-05-01", required: true}
+	toParam           = param{name: "to", kind: kindDate, usage: "End of the period, e.g. 2024-05-31", required: true}
+	contactNameParam  = param{name: "contact-name", usage: "Name of the contact person", required: true}
+	contactEmailParam = param{name: "contact-email", usage: "E-mail of the contact person", required: true}
+)
+
+// findCommand returns the command of a name, nil if there is none
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// globalFlags are the flags every command accepts, before or after its name
+type globalFlags struct {
+	config   *config.Flags
+	format   string
+	columns  string
+	noHeader bool
+	query    string
+	dryRun   bool // Only of commands that confirm changes
+	yes      bool
+}
+
+// register adds the global flags to fs
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	g.config = config.RegisterFlags(fs, config.ScopeCLI)
+	fs.StringVar(&deviceScope.client, "client", "", "Client ID or name; limits the resolution of site and device names")
+	fs.StringVar(&deviceScope.site, "site", "", "Site ID or name; limits the resolution of device names")
+	fs.StringVar(&g.format, "o", "json", "Output format: "+output.Formats)
+	fs.StringVar(&g.columns, "columns", "", "Comma-separated columns of table, wide, csv and tsv output")
+	fs.BoolVar(&g.noHeader, "no-header", false, "Omit the header row of table, wide, csv and tsv output")
+	fs.StringVar(&g.query, "q", "", "jq expression applied to the result before output")
+}
+
+// splitCommand finds the command name among args, skipping the global flags
+// and their values before it, and returns the remaining arguments
+func splitCommand(args []string) (string, []string, error) {
+	fs := flag.NewFlagSet("getdata", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	new(globalFlags).register(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "help", nil, nil
+		}
+		return "", nil, usageErrorf("%v", err)
+	}
+	if fs.NArg() == 0 {
+		return "", nil, usageErrorf("no command given, see getdata help")
+	}
+	// The arguments before the command are given again, the flag set of the
+	// command parses them a second time
+	consumed := len(args) - fs.NArg()
+	rest := append(append([]string{}, args[:consumed]...), fs.Args()[1:]...)
+	return fs.Arg(0), rest, nil
+}
+
+// parse reads the global flags and the parameters of cmd from args, which
+// may mix flags and arguments
+func (cmd *command) parse(args []string, globals *globalFlags) (*invocation, error) {
+	inv := &invocation{cmd: cmd, values: make(map[string]*string), given: make(map[string]bool)}
+	fs := cmd.flagSet(globals, inv.values)
+	fs.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, errHelp
+			}
+			return nil, usageErrorf("%v", err)
+		}
+		consumed := len(args) - fs.NArg()
+		if consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, fs.Args()...)
+			break
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	fs.Visit(func(f *flag.Flag) { inv.given[f.Name] = true })
+	inv.dryRun, inv.yes = globals.dryRun, globals.yes
+
+	if len(positional) > 0 {
+		if len(cmd.params) == 0 || cmd.noArgs {
+			return nil, usageErrorf("%s takes no arguments, usage: %s", cmd.name, cmd.synopsis())
+		}
+		first := cmd.params[0]
+		if inv.Given(first.name) {
+			return nil, usageErrorf("%s is given both as an argument and as --%s", first.metavar(), first.name)
+		}
+		if len(positional) > 1 {
+			return nil, usageErrorf("only the %s can be given as an argument, usage: %s", first.name, cmd.synopsis())
+		}
+		*inv.values[first.name] = positional[0]
+		inv.given[first.name] = true
+	}
+
+	for _, p := range cmd.params {
+		if p.required && !inv.Given(p.name) {
+			return nil, usageErrorf("missing --%s, usage: %s", p.name, cmd.synopsis())
+		}
+		if value := inv.String(p.name); len(p.choices) > 0 && value != "" && !containsFold(p.choices, value) {
+			return nil, usageErrorf("invalid --%s %q, expected %s", p.name, value, strings.Join(p.choices, ", "))
+		}
+	}
+	return inv, nil
+}
+
+// flagSet returns the flags of cmd besides the global ones, storing the
+// values of its parameters in values
+func (cmd *command) flagSet(globals *globalFlags, values map[string]*string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	if globals != nil {
+		globals.register(fs)
+		if cmd.confirm {
+			fs.BoolVar(&globals.dryRun, "dry-run", false, "Show the call and the affected entities without changing anything")
+			fs.BoolVar(&globals.yes, "yes", false, "Change without asking for confirmation")
+		}
+	}
+	for _, p := range cmd.params {
+		if value, ok := scopeParams[p.name]; ok {
+			values[p.name] = value
+			continue
+		}
+		values[p.name] = fs.String(p.name, "", p.usage)
+	}
+	return fs
+}
+
+// synopsis is the command line of cmd, with the first parameter as an argument
+func (cmd *command) synopsis() string {
+	parts := []string{"getdata", cmd.name}
+	for i, p := range cmd.params {
+		part := "--" + p.name + " <" + p.metavar() + ">"
+		if i == 0 && !cmd.noArgs {
+			part = "<" + p.metavar() + ">"
+		}
+		if !p.required {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	if cmd.confirm {
+		parts = append(parts, "[--dry-run]", "[--yes]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// printHelp writes the usage of cmd
+func (cmd *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s\n\n%s.\n", cmd.synopsis(), cmd.summary)
+	if len(cmd.params) > 0 {
+		fmt.Fprintln(w, "\nParameters:")
+		for i, p := range cmd.params {
+			usage := p.usage
+			if i == 0 && !cmd.noArgs {
+				usage += "; can be given as the first argument"
+			}
+			if p.required {
+				usage += " (required)"
+			}
+			if p.def != "" {
+				usage += fmt.Sprintf(" (default %s)", p.def)
+			}
+			fmt.Fprintf(w, "  --%-14s %s\n", p.name, usage)
+		}
+	}
+	if cmd.confirm {
+		fmt.Fprintln(w, "\nThe command changes data in N-Sight and asks for confirmation first:")
+		fmt.Fprintf(w, "  --%-14s %s\n", "dry-run", "Show the call and the affected entities without changing anything")
+		fmt.Fprintf(w, "  --%-14s %s\n", "yes", "Change without asking, required when stdin is not a terminal")
+	}
+	if cmd.needs != needsNothing {
+		fmt.Fprintln(w, "\nGlobal flags such as -o, -q, -client and -instance are described in getdata help.")
+	}
+}
+
+// printUsage writes the usage of getdata with the commands by group
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: getdata [global flags] <command> [<argument>] [--parameter value...]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags and parameters can be given before or after the command, as -name or --name.")
+	fmt.Fprintln(w, "getdata help <command> or getdata <command> --help describes one command.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "<device> is a device ID, hostname, serial number, IP or MAC address. Names are")
+	fmt.Fprintln(w, "matched ignoring case, by prefix and with small typos, in the name index")
+	fmt.Fprintln(w, "(resolver.json next to the fetchall cache); -client and -site limit the search.")
+
+	group := ""
+	for _, cmd := range commands {
+		if cmd.group != group {
+			group = cmd.group
+			fmt.Fprintf(w, "\n%s:\n", group)
+		}
+		fmt.Fprintf(w, "  %s\n", strings.TrimPrefix(cmd.synopsis(), "getdata "))
+	}
+
+	fmt.Fprintln(w, "\nGlobal flags:")
+	fs := flag.NewFlagSet("getdata", flag.ContinueOnError)
+	fs.SetOutput(w)
+	new(globalFlags).register(fs)
+	fs.PrintDefaults()
+
+	fmt.Fprintln(w, "\nExit codes:")
+	for _, code := range exitCodes {
+		fmt.Fprintf(w, "  %d  %s\n", code.code, code.meaning)
+	}
+}
+
+// commandNames lists the commands, sorted
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// containsFold reports whether list contains value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the output format and query selected by the global flags
+func (g *globalFlags) apply() error {
+	var err error
+	if outputOptions, err = output.Parse(g.format); err != nil {
+		return usageErrorf("%v", err)
+	}
+	outputOptions.NoHeader = g.noHeader
+	if g.columns != "" {
+		outputOptions.Columns = strings.Split(g.columns, ",")
+	}
+	resultQuery = nil
+	if g.query != "" {
+		if resultQuery, err = query.Parse(g.query); err != nil {
+			return usageErrorf("%v", err)
+		}
+	}
+	return nil
+}
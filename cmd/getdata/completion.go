@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/instance"
+	"nsight-proxy/internal/resolver"
+)
+
+// completeCommand is the hidden command the completion scripts call with the
+// words of the command line, the word being completed last. It prints one
+// candidate per line; no candidates let the shell complete file names.
+const completeCommand = "__complete"
+
+// completionShells are the shells completion scripts are available for
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// completionScripts are the scripts printed by getdata completion
+var completionScripts = map[string]string{
+	"bash": `# bash completion for getdata, load with: source <(getdata completion bash)
+_getdata_complete() {
+	local candidate
+	COMPREPLY=()
+	while IFS= read -r candidate; do
+		COMPREPLY+=("$(printf '%q' "$candidate")")
+	done < <("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+}
+complete -o default -F _getdata_complete getdata
+`,
+	"zsh": `#compdef getdata
+# zsh completion for getdata, load with: source <(getdata completion zsh)
+_getdata() {
+	local -a candidates
+	candidates=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -n ${candidates[1]} ]]; then
+		compadd -- "${candidates[@]}"
+	else
+		_files
+	fi
+}
+compdef _getdata getdata
+`,
+	"fish": `# fish completion for getdata, load with: getdata completion fish | source
+function __getdata_complete
+	set -l tokens (commandline -opc)
+	set -e tokens[1]
+	set -l current (commandline -ct)
+	set -l candidates (getdata __complete $tokens $current 2>/dev/null)
+	if test (count $candidates) -gt 0
+		printf '%s\n' $candidates
+	else
+		__fish_complete_path $current
+	end
+end
+complete -c getdata -f -a '(__getdata_complete)'
+`,
+	"powershell": `# PowerShell completion for getdata, load with: getdata completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName getdata, getdata.exe -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 |
+		Where-Object { $_.Extent.EndOffset -le $cursorPosition } | ForEach-Object { $_.ToString() })
+	if ($wordToComplete -eq '') { $words += '""' }
+	& $commandAst.CommandElements[0].ToString() __complete @words 2>$null | ForEach-Object {
+		$text = if ($_ -match '[\s''"]') { "'" + ($_ -replace "'", "''") + "'" } else { $_ }
+		[System.Management.Automation.CompletionResult]::new($text, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
+
+// handleCompletion prints the completion script of a shell
+func handleCompletion(inv *invocation) error {
+	fmt.Print(completionScripts[inv.String("shell")])
+	return nil
+}
+
+// runComplete prints the candidates for the last of words
+func runComplete(words []string) {
+	// Completion must not write anything but candidates
+	log.SetOutput(io.Discard)
+	for _, candidate := range completions(words) {
+		fmt.Println(candidate)
+	}
+}
+
+// completions returns the candidates for the last of words, which are the
+// command line after getdata as the shell split it
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	for i := range words {
+		words[i] = unquote(words[i])
+	}
+	current, before := words[len(words)-1], words[:len(words)-1]
+
+	// The command is the first argument that is not the value of a global flag
+	var globals globalFlags
+	fs := flag.NewFlagSet("getdata", flag.ContinueOnError)
+	globals.register(fs)
+	var cmd *command
+	commandAt := -1
+	for i := 0; i < len(before) && cmd == nil; i++ {
+		if flagName(before[i]) != "" {
+			if takesValue(fs, before[i]) {
+				i++
+			}
+			continue
+		}
+		if cmd = findCommand(before[i]); cmd == nil {
+			return nil
+		}
+		commandAt = i
+	}
+	values := make(map[string]*string)
+	if cmd != nil {
+		fs = cmd.flagSet(&globals, values)
+	}
+
+	// Flags given so far select the instance and scope the names
+	arguments := 0
+	var pending *flag.Flag
+	for i := 0; i < len(before); i++ {
+		word := before[i]
+		name := flagName(word)
+		switch {
+		case name != "" && takesValue(fs, word):
+			if i+1 == len(before) {
+				pending = fs.Lookup(name)
+			} else {
+				fs.Set(name, before[i+1])
+			}
+			i++
+		case name != "":
+			if _, value, ok := strings.Cut(word, "="); ok {
+				fs.Set(name, value)
+			}
+		case cmd != nil && i > commandAt:
+			arguments++
+		}
+	}
+
+	var candidates []string
+	switch {
+	case pending != nil:
+		candidates = flagValues(cmd, pending.Name, &globals)
+	case strings.HasPrefix(current, "-"):
+		fs.VisitAll(func(f *flag.Flag) { candidates = append(candidates, "--"+f.Name) })
+	case cmd == nil:
+		candidates = commandNames()
+	case arguments == 0 && len(cmd.params) > 0:
+		candidates = flagValues(cmd, cmd.params[0].name, &globals)
+	}
+	return withPrefix(candidates, current)
+}
+
+// flagValues returns the values a flag of cmd can take, nil if they are not known
+func flagValues(cmd *command, name string, globals *globalFlags) []string {
+	switch name {
+	case "o":
+		return []string{"table", "wide", "csv", "tsv", "yaml", "json", "ndjson", "template=", "template-file="}
+	case "instance":
+		return instanceNames(globals)
+	case "client":
+		return indexNames(globals, kindClient)
+	case "site":
+		return indexNames(globals, kindSite)
+	case "command":
+		return commandNames()
+	}
+	if cmd == nil {
+		return nil
+	}
+	for _, p := range cmd.params {
+		if p.name != name {
+			continue
+		}
+		if len(p.choices) > 0 {
+			return p.choices
+		}
+		if p.kind == kindClient || p.kind == kindSite || p.kind == kindDevice {
+			return indexNames(globals, p.kind)
+		}
+	}
+	return nil
+}
+
+// instanceNames lists the configured instances and all
+func instanceNames(globals *globalFlags) []string {
+	cfg, err := config.Load(globals.config)
+	if err != nil {
+		return nil
+	}
+	instances, err := instance.Load(cfg)
+	if err != nil || !instances.Configured() {
+		return nil
+	}
+	names := []string{instance.All}
+	for _, inst := range instances.List() {
+		names = append(names, inst.Name)
+	}
+	return names
+}
+
+// indexNames lists the client, site or device names of the name index of
+// the selected instance, without calling the API. Sites and devices are
+// limited by -client and -site like name resolution.
+func indexNames(globals *globalFlags, kind paramKind) []string {
+	cfg, err := config.Load(globals.config)
+	if err != nil {
+		return nil
+	}
+	instances, err := instance.Load(cfg)
+	if err != nil {
+		return nil
+	}
+	inst, err := instances.Get(cfg.Instance)
+	if err != nil {
+		return nil
+	}
+	clients, err := resolver.New(inst.CacheDir, cfg.Resolver.TTL.D(), nil).Clients()
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, c := range clients {
+		if kind == kindClient {
+			add(c.Name)
+			continue
+		}
+		if !inScope(deviceScope.client, c.ID, c.Name) {
+			continue
+		}
+		for _, site := range c.Sites {
+			if kind == kindDevice && !inScope(deviceScope.site, site.ID, site.Name) {
+				continue
+			}
+			if kind == kindSite {
+				add(site.Name)
+				continue
+			}
+			for _, server := range site.Servers {
+				add(server.Name)
+			}
+			for _, ws := range site.Workstations {
+				add(ws.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inScope reports whether an entity matches a -client or -site scope given
+// by ID or name, or the scope is not set
+func inScope(scope string, id int, name string) bool {
+	return scope == "" || scope == strconv.Itoa(id) || strings.EqualFold(scope, name)
+}
+
+// flagName returns the name of a flag word such as -o, --site or --o=json,
+// empty if word is not a flag
+func flagName(word string) string {
+	if len(word) < 2 || word[0] != '-' || word == "--" {
+		return ""
+	}
+	name, _, _ := strings.Cut(strings.TrimLeft(word, "-"), "=")
+	return name
+}
+
+// takesValue reports whether a flag word is followed by its value
+func takesValue(fs *flag.FlagSet, word string) bool {
+	if strings.Contains(word, "=") {
+		return false
+	}
+	f := fs.Lookup(flagName(word))
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+// withPrefix keeps the candidates that start with prefix, ignoring case
+func withPrefix(candidates []string, prefix string) []string {
+	var result []string
+	for _, candidate := range candidates {
+		if len(candidate) >= len(prefix) && strings.EqualFold(candidate[:len(prefix)], prefix) {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+// unquote removes the quotes and backslash escapes a shell leaves in the
+// words of a command line that is still being typed
+func unquote(word string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range word {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' || r == '\'':
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/resolver"
+)
+
+// Exit codes of getdata
+const (
+	exitOK       = 0
+	exitError    = 1 // Any other failure, e.g. of the configuration or of local files
+	exitUsage    = 2
+	exitAuth     = 3
+	exitNotFound = 4
+	exitUpstream = 5
+)
+
+// exitCodes describe the exit codes in the usage text
+var exitCodes = []struct {
+	code    int
+	meaning string
+}{
+	{exitOK, "success"},
+	{exitError, "other error, e.g. invalid configuration"},
+	{exitUsage, "invalid command line, or a name that matches several clients, sites or devices"},
+	{exitAuth, "missing, rejected or insufficient API key"},
+	{exitNotFound, "client, site, device or entity not found"},
+	{exitUpstream, "N-Sight failed, timed out, throttled the call or is unreachable"},
+}
+
+// errHelp is returned by command line parsing when help was requested
+var errHelp = errors.New("help requested")
+
+// usageError is an invalid command line
+type usageError struct{ msg string }
+
+func (e *usageError) Error() string { return e.msg }
+
+// usageErrorf returns a usageError with a formatted message
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// authError is a failure to set up API credentials
+type authError struct{ err error }
+
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+// exitCode classifies an error returned by a command
+func exitCode(err error) int {
+	var usage *usageError
+	var auth *authError
+	var ambiguous *inventory.AmbiguousError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage), errors.As(err, &ambiguous), errors.Is(err, resolver.ErrAmbiguous):
+		return exitUsage
+	case errors.As(err, &auth), errors.Is(err, nsight.ErrUnauthorized), errors.Is(err, nsight.ErrForbidden):
+		return exitAuth
+	case errors.Is(err, nsight.ErrNotFound), errors.Is(err, resolver.ErrNotFound), errors.Is(err, inventory.ErrNoDevice):
+		return exitNotFound
+	case errors.Is(err, nsight.ErrThrottled), errors.Is(err, nsight.ErrTimeout), errors.Is(err, nsight.ErrUnavailable),
+		errors.Is(err, nsight.ErrUpstream), errors.Is(err, nsight.ErrDecode):
+		return exitUpstream
+	}
+	return exitError
+}
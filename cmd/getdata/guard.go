@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// errAborted is returned when a change is not confirmed
+var errAborted = errors.New("aborted, nothing was changed")
+
+// entity is a client, site, device, check, patch or task affected by a change
+type entity struct {
+	Kind   string `json:"kind"`
+	ID     int    `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Detail string `json:"detail,omitempty"` // Where the entity is, or why it matters
+}
+
+func (e entity) String() string {
+	s := e.Kind
+	if e.ID != 0 {
+		s += " " + strconv.Itoa(e.ID)
+	}
+	if e.Name != "" {
+		s += " " + e.Name
+	}
+	if e.Detail != "" {
+		s += " (" + e.Detail + ")"
+	}
+	return s
+}
+
+// change is a call of a command that confirms changes
+type change struct {
+	action   string // What the call does, e.g. "clear check 5001"
+	affected []entity
+	call     func(api *nsight.ApiClient) error
+	done     string // Success message
+}
+
+// dryRunResult is the output of --dry-run
+type dryRunResult struct {
+	DryRun   bool          `json:"dry_run"`
+	Action   string        `json:"action"`
+	Calls    []nsight.Call `json:"calls"`
+	Affected []entity      `json:"affected"`
+}
+
+// apply makes a change once it is confirmed, or with --dry-run only shows
+// the calls it would make and the entities they affect
+func (inv *invocation) apply(c change) error {
+	if inv.dryRun {
+		var calls []nsight.Call
+		if err := c.call(inv.api.WithDryRun(&calls)); err != nil {
+			return fmt.Errorf("could not %s: %w", c.action, err)
+		}
+		return printResult(dryRunResult{DryRun: true, Action: c.action, Calls: calls, Affected: c.affected})
+	}
+	if !inv.yes {
+		if err := confirm(c); err != nil {
+			return err
+		}
+	}
+	if err := c.call(inv.api); err != nil {
+		return fmt.Errorf("could not %s: %w", c.action, err)
+	}
+	return printSuccess(c.done)
+}
+
+// confirm asks on the terminal whether to make a change
+func confirm(c change) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return usageErrorf("refusing to %s without confirmation: stdin is not a terminal, add --yes to confirm or --dry-run to preview", c.action)
+	}
+	fmt.Fprintf(os.Stderr, "About to %s, affecting:\n", c.action)
+	for _, e := range c.affected {
+		fmt.Fprintf(os.Stderr, "  %s\n", e)
+	}
+	fmt.Fprint(os.Stderr, "Proceed? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errAborted
+}
+
+// -- Affected entities, resolved with read calls --
+
+// deviceEntity describes a device, rebuilding the name index from the API if
+// it does not know the ID
+func deviceEntity(deviceID int) entity {
+	e := entity{Kind: "device", ID: deviceID}
+	location, err := names.Device(inventory.DeviceQuery{Identifier: strconv.Itoa(deviceID), Exact: true}, nil)
+	if err != nil || location.Match != inventory.MatchID {
+		e.Detail = "not found in the name index"
+		return e
+	}
+	e.Name = location.DeviceName
+	e.Detail = fmt.Sprintf("%s at %s / %s", location.DeviceType, location.ClientName, location.SiteName)
+	return e
+}
+
+// checkEntity describes a check, which N-Sight only lists by ID among the failing checks
+func checkEntity(api *nsight.ApiClient, checkID int) (entity, error) {
+	e := entity{Kind: "check", ID: checkID, Detail: "not among the failing checks"}
+	checks, err := api.FetchFailingChecks()
+	if err != nil {
+		return e, fmt.Errorf("could not fetch failing checks: %w", err)
+	}
+	for _, c := range checks {
+		if c.CheckID == checkID {
+			e.Name = c.Name
+			e.Detail = fmt.Sprintf("failing on %s %d: %s", c.DeviceName, c.DeviceID, c.Message)
+		}
+	}
+	return e, nil
+}
+
+// patchEntities describes patches of a device
+func patchEntities(api *nsight.ApiClient, deviceID int, patchIDs []int) ([]entity, error) {
+	patches, err := api.FetchPatches(deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch patches: %w", err)
+	}
+	byID := make(map[int]nsight.Patch, len(patches))
+	for _, p := range patches {
+		byID[p.PatchID] = p
+	}
+	entities := make([]entity, len(patchIDs))
+	for i, id := range patchIDs {
+		entities[i] = entity{Kind: "patch", ID: id, Detail: "not listed for the device"}
+		if p, ok := byID[id]; ok {
+			entities[i].Name = p.Name
+			entities[i].Detail = strings.TrimSpace(p.Severity + " " + p.Status)
+		}
+	}
+	return entities, nil
+}
+
+// clientEntity describes a client
+func clientEntity(api *nsight.ApiClient, clientID int) (entity, error) {
+	e := entity{Kind: "client", ID: clientID, Detail: "not found"}
+	clients, err := api.FetchClients()
+	if err != nil {
+		return e, fmt.Errorf("could not fetch clients: %w", err)
+	}
+	for _, c := range clients {
+		if c.ClientID == clientID {
+			e.Name, e.Detail = c.Name, ""
+		}
+	}
+	return e, nil
+}
+
+// newClientEntity describes a client about to be added, noting an existing
+// client of the same name
+func newClientEntity(api *nsight.ApiClient, name string) (entity, error) {
+	e := entity{Kind: "client", Name: name, Detail: "new"}
+	clients, err := api.FetchClients()
+	if err != nil {
+		return e, fmt.Errorf("could not fetch clients: %w", err)
+	}
+	for _, c := range clients {
+		if strings.EqualFold(c.Name, name) {
+			e.Detail = fmt.Sprintf("new, client %d has the same name", c.ClientID)
+		}
+	}
+	return e, nil
+}
+
+// newSiteEntity describes a site about to be added to a client, noting an
+// existing site of the same name
+func newSiteEntity(api *nsight.ApiClient, clientID int, name string) (entity, error) {
+	e := entity{Kind: "site", Name: name, Detail: "new"}
+	sites, err := api.FetchSites(clientID)
+	if err != nil {
+		return e, fmt.Errorf("could not fetch sites: %w", err)
+	}
+	for _, s := range sites {
+		if strings.EqualFold(s.Name, name) {
+			e.Detail = fmt.Sprintf("new, site %d of the client has the same name", s.SiteID)
+		}
+	}
+	return e, nil
+}
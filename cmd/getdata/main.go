@@ -1,813 +1,908 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/joho/godotenv"
+
+	"nsight-proxy/internal/audit"
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/instance"
+	"nsight-proxy/internal/inventory"
 	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/output"
+	"nsight-proxy/internal/overview"
+	"nsight-proxy/internal/query"
+	"nsight-proxy/internal/resolver"
 )
 
+// names resolves client, site and device names of the selected instance
+var names *resolver.Resolver
+
+// outputOptions is the output format selected by -o, -columns and -no-header
+var outputOptions output.Options
+
+// resultQuery is the -q expression, nil if none was given
+var resultQuery *query.Query
+
 
 
 // -- Main service function --
 func main() {
-	apiClient, err := nsight.NewApiClient()
-	if err != nil {
-		log.Fatalf("Failed to initialize API client: %v", err)
-	}
-
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
-	}
-
-	serviceName := os.Args[1]
-	args := os.Args[2:]
-
-	switch serviceName {
-	// -- Basic Entity Listing --
-	case "list_clients":
-		handleListClients(apiClient, args)
-	case "list_sites":
-		handleListSites(apiClient, args)
-	case "list_servers":
-		handleListServers(apiClient, args)
-	case "list_workstations":
-		handleListWorkstations(apiClient, args)
-	case "list_devices":
-		handleListDevices(apiClient, args)
-	case "list_devices_at_client":
-		handleListDevicesAtClient(apiClient, args)
-	case "list_agentless_assets":
-		handleListAgentlessAssets(apiClient, args)
-
-	// -- Check and Monitoring --
-	case "list_failing_checks":
-		handleListFailingChecks(apiClient, args)
-	case "list_checks":
-		handleListChecks(apiClient, args)
-	case "list_device_monitoring_details":
-		handleListDeviceMonitoringDetails(apiClient, args)
-	case "list_check_configuration", "list_check_configuration_windows", "list_check_configuration_mac", "list_check_configuration_linux":
-		handleListCheckConfiguration(apiClient, serviceName, args)
-	case "list_outages":
-		handleListOutages(apiClient, args)
-	case "clear_check":
-		handleClearCheck(apiClient, args)
-	case "add_check_note":
-		handleAddCheckNote(apiClient, args)
-
-	// -- Asset Tracking --
-	case "list_hardware":
-		handleListHardware(apiClient, args)
-	case "list_software":
-		handleListSoftware(apiClient, args)
-	case "list_device_asset_details":
-		handleListDeviceAssetDetails(apiClient, args)
-	case "list_license_groups":
-		handleListLicenseGroups(apiClient, args)
-
-	// -- Patch Management --
-	case "list_patches":
-		handleListPatches(apiClient, args)
-	case "approve_patch":
-		handleApprovePatches(apiClient, args)
-	case "ignore_patch":
-		handleIgnorePatches(apiClient, args)
-
-	// -- Antivirus --
-	case "list_antivirus_products":
-		handleListAntivirusProducts(apiClient, args)
-	case "list_antivirus_definitions":
-		handleListAntivirusDefinitions(apiClient, args)
-	case "list_quarantine":
-		handleListQuarantine(apiClient, args)
-	case "start_scan":
-		handleStartAntivirusScan(apiClient, args)
-
-	// -- Performance and History --
-	case "list_performance_history":
-		handleListPerformanceHistory(apiClient, args)
-	case "list_drive_space_history":
-		handleListDriveSpaceHistory(apiClient, args)
-
-	// -- Templates --
-	case "list_templates":
-		handleListTemplates(apiClient, args)
-
-	// -- Backup & Recovery --
-	case "list_backup_sessions":
-		handleListBackupSessions(apiClient, args)
-
-	// -- Settings --
-	case "list_wall_chart_settings":
-		handleListWallChartSettings(apiClient, args)
-	case "list_general_settings":
-		handleListGeneralSettings(apiClient, args)
-
-	// -- Tasks and Users --
-	case "list_active_directory_users":
-		handleListActiveDirectoryUsers(apiClient, args)
-	case "run_task_now":
-		handleRunTaskNow(apiClient, args)
-
-	// -- Site Management --
-	case "add_client":
-		handleAddClient(apiClient, args)
-	case "add_site":
-		handleAddSite(apiClient, args)
-	case "get_site_installation_package":
-		handleGetSiteInstallationPackage(apiClient, args)
-
-	default:
-		log.Fatalf("Error: Unknown service '%s'", serviceName)
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes one command line and returns the exit code
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
 	}
+	if args[0] == completeCommand {
+		runComplete(args[1:])
+		return exitOK
+	}
+	err := execute(args)
+	if err != nil {
+		log.Printf("Error: %v", err)
+	}
+	return exitCode(err)
 }
 
-// -- Utility Functions --
+// execute parses a command line, sets up what the command needs and runs it
+func execute(args []string) error {
+	name, rest, err := splitCommand(args)
+	if err != nil {
+		return err
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		return usageErrorf("unknown command %q, see getdata help", name)
+	}
+	var globals globalFlags
+	inv, err := cmd.parse(rest, &globals)
+	if errors.Is(err, errHelp) {
+		cmd.printHelp(os.Stdout)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := globals.apply(); err != nil {
+		return err
+	}
 
-func printUsage() {
-	fmt.Println("Usage: go run cmd/getdata/main.go <service_name> [parameters...]")
-	fmt.Println()
-	fmt.Println("Basic Entity Listing:")
-	fmt.Println("  list_clients")
-	fmt.Println("  list_sites <client_id | \"client_name\">")
-	fmt.Println("  list_servers <site_id | \"site_name\">")
-	fmt.Println("  list_workstations <site_id | \"site_name\">")
-	fmt.Println("  list_devices <site_id>")
-	fmt.Println("  list_devices_at_client <client_id>")
-	fmt.Println("  list_agentless_assets <site_id>")
-	fmt.Println()
-	fmt.Println("Check and Monitoring:")
-	fmt.Println("  list_failing_checks")
-	fmt.Println("  list_checks <device_id | site_id>")
-	fmt.Println("  list_device_monitoring_details <device_id>")
-	fmt.Println("  list_check_configuration <device_id> [os]")
-	fmt.Println("  list_check_configuration_windows <device_id>")
-	fmt.Println("  list_check_configuration_mac <device_id>")
-	fmt.Println("  list_check_configuration_linux <device_id>")
-	fmt.Println("  list_outages <site_id> <start_date> <end_date>")
-	fmt.Println("  clear_check <check_id>")
-	fmt.Println("  add_check_note <check_id> \"<note>\"")
-	fmt.Println()
-	fmt.Println("Asset Tracking:")
-	fmt.Println("  list_hardware <device_id>")
-	fmt.Println("  list_software <device_id>")
-	fmt.Println("  list_device_asset_details <device_id>")
-	fmt.Println("  list_license_groups")
-	fmt.Println()
-	fmt.Println("Patch Management:")
-	fmt.Println("  list_patches <device_id>")
-	fmt.Println("  approve_patch <device_id> <patch_id1,patch_id2,...>")
-	fmt.Println("  ignore_patch <device_id> <patch_id1,patch_id2,...>")
-	fmt.Println()
-	fmt.Println("Antivirus:")
-	fmt.Println("  list_antivirus_products")
-	fmt.Println("  list_antivirus_definitions <device_id>")
-	fmt.Println("  list_quarantine <device_id>")
-	fmt.Println("  start_scan <device_id> <scan_type>")
-	fmt.Println()
-	fmt.Println("Performance and History:")
-	fmt.Println("  list_performance_history <device_id> <check_id> <start_date> <end_date>")
-	fmt.Println("  list_drive_space_history <device_id> <start_date> <end_date>")
-	fmt.Println()
-	fmt.Println("Templates:")
-	fmt.Println("  list_templates")
-	fmt.Println()
-	fmt.Println("Backup & Recovery:")
-	fmt.Println("  list_backup_sessions <device_id>")
-	fmt.Println()
-	fmt.Println("Settings:")
-	fmt.Println("  list_wall_chart_settings")
-	fmt.Println("  list_general_settings")
-	fmt.Println()
-	fmt.Println("Tasks and Users:")
-	fmt.Println("  list_active_directory_users <device_id>")
-	fmt.Println("  run_task_now <task_id>")
-	fmt.Println()
-	fmt.Println("Site Management:")
-	fmt.Println("  add_client \"<name>\" \"<contact_name>\" \"<contact_email>\"")
-	fmt.Println("  add_site <client_id> \"<name>\" \"<contact_name>\" \"<contact_email>\"")
-	fmt.Println("  get_site_installation_package <site_id> <package_type>")
-}
-
-func outputJSON(data interface{}) {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		log.Fatalf("Error marshalling data to JSON: %v", err)
-	}
-	fmt.Println(string(jsonData))
-}
-
-func getClientIDByName(apiClient *nsight.ApiClient, clientName string) (int, error) {
-	clients, err := apiClient.FetchClients()
-	if err != nil {
-		return 0, fmt.Errorf("could not fetch client list to find ID: %w", err)
-	}
-
-	for _, client := range clients {
-		if client.Name == clientName {
-			return client.ClientID, nil
-		}
+	// Encrypting a key, help and completion need no configuration
+	if cmd.needs == needsNothing {
+		godotenv.Load()
+		return cmd.run(inv)
 	}
 
-	return 0, fmt.Errorf("client with name '%s' not found", clientName)
+	cfg, err := config.Load(globals.config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	nsight.Configure(cfg.Client)
+	audit.Configure(cfg.Audit)
+	inv.cfg = cfg
+	if cmd.confirm && !inv.dryRun && nsight.ReadOnly() {
+		return fmt.Errorf("%s refused: %w", cmd.name, nsight.ErrReadOnly)
+	}
+
+	// The audit log and the configuration are read locally and need no API credentials
+	if cmd.needs == needsConfig {
+		return cmd.run(inv)
+	}
+
+	if cfg.Instance == instance.All && cmd.name == "list_clients" {
+		instances, err := instance.Load(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid instance configuration: %w", err)
+		}
+		return listAllInstances(instances)
+	}
+	inst, apiClient, err := openInstance(cfg)
+	if err != nil {
+		return err
+	}
+	names = resolver.New(inst.CacheDir, cfg.Resolver.TTL.D(), func() (*nsight.ApiClient, error) { return apiClient, nil })
+	inv.api = apiClient
+	return cmd.run(inv)
 }
 
-func getSiteIDByName(apiClient *nsight.ApiClient, siteName string) (int, error) {
-	clients, err := apiClient.FetchClients()
+// openInstance returns the instance selected by -instance and its API
+// client. Without usable credentials the instance is returned with an
+// authError, so local data can still be read.
+func openInstance(cfg *config.Config) (*instance.Instance, *nsight.ApiClient, error) {
+	instances, err := instance.Load(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid instance configuration: %w", err)
+	}
+	if cfg.Instance == instance.All {
+		return nil, nil, usageErrorf("-instance all is only supported for list_clients")
+	}
+	inst, err := instances.Get(cfg.Instance)
+	if err != nil {
+		return nil, nil, usageErrorf("%v", err)
+	}
+	apiClient, err := inst.Client()
 	if err != nil {
-		return 0, fmt.Errorf("could not fetch client list to find site ID: %w", err)
+		return inst, nil, &authError{fmt.Errorf("failed to initialize API client: %w", err)}
 	}
+	return inst, apiClient.WithActor(audit.DefaultActor("getdata")), nil
+}
+
+// -- Utility Functions --
 
-	for _, client := range clients {
-		sites, err := apiClient.FetchSites(client.ClientID)
+// printResult writes a result to stdout in the format selected by -o, after
+// the -q expression if one was given. Like jq, JSON output writes each value
+// the expression emits as its own document; other formats write them as a list.
+func printResult(data interface{}) error {
+	if resultQuery != nil {
+		results, err := resultQuery.Run(context.Background(), data)
 		if err != nil {
-			continue
+			return err
 		}
-		for _, site := range sites {
-			if site.Name == siteName {
-				return site.SiteID, nil
+		if outputOptions.Format == output.FormatJSON {
+			for _, result := range results {
+				if err := writeOutput(result); err != nil {
+					return err
+				}
 			}
+			return nil
 		}
+		data = query.Collapse(results)
 	}
+	return writeOutput(data)
+}
+
+// writeOutput writes one value in the format selected by -o
+func writeOutput(data interface{}) error {
+	if err := output.Write(os.Stdout, data, outputOptions); err != nil {
+		return fmt.Errorf("could not write output: %w", err)
+	}
+	return nil
+}
 
-	return 0, fmt.Errorf("site with name '%s' not found across any client", siteName)
+// printSuccess reports a call that changed data
+func printSuccess(message string) error {
+	fmt.Printf("{\"status\": \"success\", \"message\": %q}\n", message)
+	return nil
 }
 
-func resolveClientID(apiClient *nsight.ApiClient, identifier string) (int, error) {
-	if clientID, err := strconv.Atoi(identifier); err == nil {
-		return clientID, nil
+// resolveClientID turns a client ID or name into a client ID
+func resolveClientID(identifier string) (int, error) {
+	id, err := names.ClientID(identifier)
+	if err != nil {
+		return 0, fmt.Errorf("could not resolve client: %w", err)
 	}
-	return getClientIDByName(apiClient, identifier)
+	return id, nil
 }
 
-func resolveSiteID(apiClient *nsight.ApiClient, identifier string) (int, error) {
-	if siteID, err := strconv.Atoi(identifier); err == nil {
-		return siteID, nil
+// resolveSiteID turns a site ID or name into a site ID. Names are looked up
+// among the sites of the -client client, if given.
+func resolveSiteID(identifier string) (int, error) {
+	id, err := names.SiteID(identifier, deviceScope.client)
+	if err != nil {
+		return 0, fmt.Errorf("could not resolve site: %w", err)
 	}
-	return getSiteIDByName(apiClient, identifier)
+	return id, nil
 }
 
+// deviceScope limits site and device names resolved by name, set by -client and -site
+var deviceScope struct {
+	client string
+	site   string
+}
+
+// resolveDeviceID turns a device ID, hostname, serial number, IP or MAC
+// address into a device ID. Numeric identifiers are used as they are. Other
+// identifiers are looked up in the name index, which is rebuilt from the
+// fetchall cache or the API when it is stale or lacks the device.
 func resolveDeviceID(identifier string) (int, error) {
-	return strconv.Atoi(identifier)
+	return lookupDeviceID(identifier, false)
 }
 
-// -- Handler Functions --
+// resolveTargetDeviceID resolves the device of a call that changes data, which
+// must be named exactly rather than by a prefix or with typos
+func resolveTargetDeviceID(identifier string) (int, error) {
+	return lookupDeviceID(identifier, true)
+}
 
-func handleListClients(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_clients")
+// lookupDeviceID implements resolveDeviceID with optional exact matching
+func lookupDeviceID(identifier string, exact bool) (int, error) {
+	if deviceID, err := strconv.Atoi(identifier); err == nil {
+		return deviceID, nil
 	}
-	clients, err := apiClient.FetchClients()
+	location, err := findDevice(identifier, exact)
 	if err != nil {
-		log.Fatalf("Error fetching clients: %v", err)
+		return 0, err
 	}
-	outputJSON(clients)
+	return location.DeviceID, nil
+}
+
+// findDevice looks a device up in the name index
+func findDevice(identifier string, exact bool) (*inventory.DeviceLocation, error) {
+	query := inventory.DeviceQuery{Identifier: identifier, Client: deviceScope.client, Site: deviceScope.site, Exact: exact}
+	location, err := names.Device(query, nil)
+	return resolvedDevice(identifier, location, err)
 }
 
-func handleListSites(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_sites <client_id | \"client_name\">")
+// resolvedDevice reports a resolved device, or lists the candidates of an
+// ambiguous identifier one per line
+func resolvedDevice(identifier string, location *inventory.DeviceLocation, err error) (*inventory.DeviceLocation, error) {
+	var ambiguous *inventory.AmbiguousError
+	if errors.As(err, &ambiguous) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%q matches %d devices, use an ID or narrow the search with -client or -site:", identifier, len(ambiguous.Candidates))
+		for _, c := range ambiguous.Candidates {
+			fmt.Fprintf(&b, "\n  %-8d %-24s %-11s %s / %s (by %s)", c.DeviceID, c.DeviceName, c.DeviceType, c.ClientName, c.SiteName, c.Match)
+		}
+		return nil, &usageError{msg: b.String()}
 	}
-	clientID, err := resolveClientID(apiClient, args[0])
 	if err != nil {
-		log.Fatalf("Error resolving client: %v", err)
+		return nil, fmt.Errorf("could not resolve device: %w", err)
 	}
-	sites, err := apiClient.FetchSites(clientID)
-	if err != nil {
-		log.Fatalf("Error fetching sites: %v", err)
+	log.Printf("Resolved %q to %s %d %s (%s / %s, by %s)", identifier, location.DeviceType, location.DeviceID, location.DeviceName, location.ClientName, location.SiteName, location.Match)
+	return location, nil
+}
+
+// instanceClient is a client tagged with the instance it was fetched from
+type instanceClient struct {
+	Instance string `json:"instance"`
+	nsight.Client
+}
+
+// listAllInstances lists the clients of every configured instance, tagging
+// each entry with its instance
+func listAllInstances(instances *instance.Set) error {
+	merged := []instanceClient{}
+	for _, inst := range instances.List() {
+		apiClient, err := inst.Client()
+		if err != nil {
+			return &authError{fmt.Errorf("failed to initialize API client of instance %s: %w", inst.Name, err)}
+		}
+		clients, err := apiClient.FetchClients()
+		if err != nil {
+			return fmt.Errorf("could not fetch clients of instance %s: %w", inst.Name, err)
+		}
+		for _, client := range clients {
+			merged = append(merged, instanceClient{Instance: inst.Name, Client: client})
+		}
 	}
-	outputJSON(sites)
+	return printResult(merged)
 }
 
-func handleListServers(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_servers <site_id | \"site_name\">")
+// -- Handler Functions --
+
+func handleListClients(inv *invocation) error {
+	clients, err := inv.api.FetchClients()
+	if err != nil {
+		return fmt.Errorf("could not fetch clients: %w", err)
 	}
-	siteID, err := resolveSiteID(apiClient, args[0])
+	return printResult(clients)
+}
+
+func handleListSites(inv *invocation) error {
+	clientID, err := resolveClientID(inv.String("client"))
 	if err != nil {
-		log.Fatalf("Error resolving site: %v", err)
+		return err
 	}
-	servers, err := apiClient.FetchServers(siteID)
+	sites, err := inv.api.FetchSites(clientID)
 	if err != nil {
-		log.Fatalf("Error fetching servers: %v", err)
+		return fmt.Errorf("could not fetch sites: %w", err)
 	}
-	outputJSON(servers)
+	return printResult(sites)
 }
 
-func handleListWorkstations(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_workstations <site_id | \"site_name\">")
-	}
-	siteID, err := resolveSiteID(apiClient, args[0])
+func handleListServers(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
 	if err != nil {
-		log.Fatalf("Error resolving site: %v", err)
+		return err
 	}
-	workstations, err := apiClient.FetchWorkstations(siteID)
+	servers, err := inv.api.FetchServers(siteID)
 	if err != nil {
-		log.Fatalf("Error fetching workstations: %v", err)
+		return fmt.Errorf("could not fetch servers: %w", err)
 	}
-	outputJSON(workstations)
+	return printResult(servers)
 }
 
-func handleListDevices(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_devices <site_id>")
-	}
-	siteID, err := strconv.Atoi(args[0])
+func handleListWorkstations(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
 	if err != nil {
-		log.Fatalf("Invalid site ID: %v", err)
+		return err
 	}
-	devices, err := apiClient.FetchDevicesBySite(siteID)
+	workstations, err := inv.api.FetchWorkstations(siteID)
 	if err != nil {
-		log.Fatalf("Error fetching devices: %v", err)
+		return fmt.Errorf("could not fetch workstations: %w", err)
 	}
-	outputJSON(devices)
+	return printResult(workstations)
 }
 
-func handleListDevicesAtClient(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_devices_at_client <client_id>")
-	}
-	clientID, err := strconv.Atoi(args[0])
+func handleListDevices(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
 	if err != nil {
-		log.Fatalf("Invalid client ID: %v", err)
+		return err
 	}
-	devices, err := apiClient.FetchDevices(clientID)
+	devices, err := inv.api.FetchDevicesBySite(siteID)
 	if err != nil {
-		log.Fatalf("Error fetching devices: %v", err)
+		return fmt.Errorf("could not fetch devices: %w", err)
 	}
-	outputJSON(devices)
+	return printResult(devices)
 }
 
-func handleListAgentlessAssets(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_agentless_assets <site_id>")
-	}
-	siteID, err := strconv.Atoi(args[0])
+func handleListDevicesAtClient(inv *invocation) error {
+	clientID, err := resolveClientID(inv.String("client"))
 	if err != nil {
-		log.Fatalf("Invalid site ID: %v", err)
+		return err
 	}
-	assets, err := apiClient.FetchAgentlessAssets(siteID)
+	devices, err := inv.api.FetchDevices(clientID)
 	if err != nil {
-		log.Fatalf("Error fetching agentless assets: %v", err)
+		return fmt.Errorf("could not fetch devices: %w", err)
 	}
-	outputJSON(assets)
+	return printResult(devices)
 }
 
-func handleListFailingChecks(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_failing_checks")
+func handleListAgentlessAssets(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
+	if err != nil {
+		return err
+	}
+	assets, err := inv.api.FetchAgentlessAssets(siteID)
+	if err != nil {
+		return fmt.Errorf("could not fetch agentless assets: %w", err)
 	}
-	checks, err := apiClient.FetchFailingChecks()
+	return printResult(assets)
+}
+
+func handleListFailingChecks(inv *invocation) error {
+	checks, err := inv.api.FetchFailingChecks()
 	if err != nil {
-		log.Fatalf("Error fetching failing checks: %v", err)
+		return fmt.Errorf("could not fetch failing checks: %w", err)
 	}
-	outputJSON(checks)
+	return printResult(checks)
 }
 
-func handleListChecks(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_checks <device_id | site_id>")
+// handleListChecks lists the checks of a device or, given only --site, of a site
+func handleListChecks(inv *invocation) error {
+	if !inv.Given("device") {
+		if !inv.Given("site") {
+			return usageErrorf("missing --device or --site, usage: %s", inv.cmd.synopsis())
+		}
+		siteID, err := resolveSiteID(inv.String("site"))
+		if err != nil {
+			return err
+		}
+		checks, err := inv.api.FetchChecksBySite(siteID)
+		if err != nil {
+			return fmt.Errorf("could not fetch checks: %w", err)
+		}
+		return printResult(checks)
 	}
-	
-	// Try as device ID first, then as site ID
-	id, err := strconv.Atoi(args[0])
+
+	// Names are resolved as devices
+	id, err := strconv.Atoi(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid ID: %v", err)
+		deviceID, err := resolveDeviceID(inv.String("device"))
+		if err != nil {
+			return err
+		}
+		checks, err := inv.api.FetchChecks(deviceID)
+		if err != nil {
+			return fmt.Errorf("could not fetch checks: %w", err)
+		}
+		return printResult(checks)
 	}
-	
-	// Try device checks first
-	checks, err := apiClient.FetchChecks(id)
+
+	// Try as device ID first, then as site ID
+	checks, err := inv.api.FetchChecks(id)
 	if err != nil {
-		// If device checks fail, try site checks
-		checks, err = apiClient.FetchChecksBySite(id)
+		checks, err = inv.api.FetchChecksBySite(id)
 		if err != nil {
-			log.Fatalf("Error fetching checks: %v", err)
+			return fmt.Errorf("could not fetch checks: %w", err)
 		}
 	}
-	outputJSON(checks)
+	return printResult(checks)
 }
 
-func handleListDeviceMonitoringDetails(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_device_monitoring_details <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListDeviceMonitoringDetails(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	details, err := apiClient.FetchDeviceMonitoringDetails(deviceID)
+	details, err := inv.api.FetchDeviceMonitoringDetails(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching device monitoring details: %v", err)
+		return fmt.Errorf("could not fetch device monitoring details: %w", err)
 	}
-	outputJSON(details)
+	return printResult(details)
 }
 
-func handleListCheckConfiguration(apiClient *nsight.ApiClient, serviceName string, args []string) {
-	if len(args) < 1 {
-		log.Fatalf("Usage: %s <device_id> [os]", serviceName)
-	}
-	deviceID, err := resolveDeviceID(args[0])
+// handleListCheckConfiguration serves list_check_configuration and its
+// variants for one operating system
+func handleListCheckConfiguration(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	
-	var os string
-	if strings.Contains(serviceName, "_windows") {
-		os = "windows"
-	} else if strings.Contains(serviceName, "_mac") {
-		os = "mac"
-	} else if strings.Contains(serviceName, "_linux") {
-		os = "linux"
-	} else if len(args) > 1 {
-		os = args[1]
+
+	os := inv.String("os")
+	if _, suffix, ok := strings.Cut(inv.cmd.name, "configuration_"); ok {
+		os = suffix
 	}
-	
-	config, err := apiClient.FetchCheckConfiguration(deviceID, os)
+
+	config, err := inv.api.FetchCheckConfiguration(deviceID, os)
 	if err != nil {
-		log.Fatalf("Error fetching check configuration: %v", err)
+		return fmt.Errorf("could not fetch check configuration: %w", err)
 	}
-	outputJSON(config)
+	return printResult(config)
 }
 
-func handleListOutages(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 3 {
-		log.Fatalf("Usage: list_outages <site_id> <start_date> <end_date>")
-	}
-	siteID, err := strconv.Atoi(args[0])
+func handleListOutages(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
 	if err != nil {
-		log.Fatalf("Invalid site ID: %v", err)
+		return err
 	}
-	outages, err := apiClient.FetchOutages(siteID, args[1], args[2])
+	outages, err := inv.api.FetchOutages(siteID, inv.String("from"), inv.String("to"))
 	if err != nil {
-		log.Fatalf("Error fetching outages: %v", err)
+		return fmt.Errorf("could not fetch outages: %w", err)
 	}
-	outputJSON(outages)
+	return printResult(outages)
 }
 
-func handleClearCheck(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: clear_check <check_id>")
-	}
-	checkID, err := strconv.Atoi(args[0])
+func handleClearCheck(inv *invocation) error {
+	checkID, err := inv.Int("check")
 	if err != nil {
-		log.Fatalf("Invalid check ID: %v", err)
+		return err
 	}
-	err = apiClient.ClearCheck(checkID)
+	check, err := checkEntity(inv.api, checkID)
 	if err != nil {
-		log.Fatalf("Error clearing check: %v", err)
+		return err
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Check cleared\"}")
+	return inv.apply(change{
+		action:   fmt.Sprintf("clear check %d", checkID),
+		affected: []entity{check},
+		call:     func(api *nsight.ApiClient) error { return api.ClearCheck(checkID) },
+		done:     "Check cleared",
+	})
 }
 
-func handleAddCheckNote(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: add_check_note <check_id> \"<note>\"")
-	}
-	checkID, err := strconv.Atoi(args[0])
+func handleAddCheckNote(inv *invocation) error {
+	checkID, err := inv.Int("check")
 	if err != nil {
-		log.Fatalf("Invalid check ID: %v", err)
+		return err
 	}
-	err = apiClient.AddCheckNote(checkID, args[1])
-	if err != nil {
-		log.Fatalf("Error adding check note: %v", err)
+	if err := inv.api.AddCheckNote(checkID, inv.String("note")); err != nil {
+		return fmt.Errorf("could not add check note: %w", err)
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Note added to check\"}")
+	return printSuccess("Note added to check")
 }
 
-func handleListHardware(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_hardware <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListHardware(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	hardware, err := apiClient.FetchHardware(deviceID)
+	hardware, err := inv.api.FetchHardware(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching hardware: %v", err)
+		return fmt.Errorf("could not fetch hardware: %w", err)
 	}
-	outputJSON(hardware)
+	return printResult(hardware)
 }
 
-func handleListSoftware(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_software <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListSoftware(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	software, err := apiClient.FetchSoftware(deviceID)
+	software, err := inv.api.FetchSoftware(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching software: %v", err)
+		return fmt.Errorf("could not fetch software: %w", err)
 	}
-	outputJSON(software)
+	return printResult(software)
 }
 
-func handleListDeviceAssetDetails(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_device_asset_details <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListDeviceAssetDetails(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	details, err := apiClient.FetchDeviceAssetDetails(deviceID)
+	details, err := inv.api.FetchDeviceAssetDetails(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching device asset details: %v", err)
+		return fmt.Errorf("could not fetch device asset details: %w", err)
 	}
-	outputJSON(details)
+	return printResult(details)
 }
 
-func handleListLicenseGroups(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_license_groups")
-	}
-	groups, err := apiClient.FetchLicenseGroups()
+func handleListLicenseGroups(inv *invocation) error {
+	groups, err := inv.api.FetchLicenseGroups()
 	if err != nil {
-		log.Fatalf("Error fetching license groups: %v", err)
+		return fmt.Errorf("could not fetch license groups: %w", err)
 	}
-	outputJSON(groups)
+	return printResult(groups)
 }
 
-func handleListPatches(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_patches <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListPatches(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	patches, err := apiClient.FetchPatches(deviceID)
+	patches, err := inv.api.FetchPatches(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching patches: %v", err)
+		return fmt.Errorf("could not fetch patches: %w", err)
 	}
-	outputJSON(patches)
+	return printResult(patches)
 }
 
-func handleApprovePatches(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: approve_patch <device_id> <patch_id1,patch_id2,...>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleApprovePatches(inv *invocation) error {
+	patchIDs, err := inv.Ints("patches")
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	
-	patchIDStrings := strings.Split(args[1], ",")
-	patchIDs := make([]int, len(patchIDStrings))
-	for i, idStr := range patchIDStrings {
-		patchIDs[i], err = strconv.Atoi(strings.TrimSpace(idStr))
-		if err != nil {
-			log.Fatalf("Invalid patch ID '%s': %v", idStr, err)
-		}
+	deviceID, err := resolveTargetDeviceID(inv.String("device"))
+	if err != nil {
+		return err
 	}
-	
-	err = apiClient.ApprovePatches(deviceID, patchIDs)
+	patches, err := patchEntities(inv.api, deviceID, patchIDs)
 	if err != nil {
-		log.Fatalf("Error approving patches: %v", err)
+		return err
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Patches approved\"}")
+	return inv.apply(change{
+		action:   fmt.Sprintf("approve %d patches of device %d", len(patchIDs), deviceID),
+		affected: append([]entity{deviceEntity(deviceID)}, patches...),
+		call:     func(api *nsight.ApiClient) error { return api.ApprovePatches(deviceID, patchIDs) },
+		done:     "Patches approved",
+	})
 }
 
-func handleIgnorePatches(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: ignore_patch <device_id> <patch_id1,patch_id2,...>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleIgnorePatches(inv *invocation) error {
+	patchIDs, err := inv.Ints("patches")
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	
-	patchIDStrings := strings.Split(args[1], ",")
-	patchIDs := make([]int, len(patchIDStrings))
-	for i, idStr := range patchIDStrings {
-		patchIDs[i], err = strconv.Atoi(strings.TrimSpace(idStr))
-		if err != nil {
-			log.Fatalf("Invalid patch ID '%s': %v", idStr, err)
-		}
+	deviceID, err := resolveTargetDeviceID(inv.String("device"))
+	if err != nil {
+		return err
 	}
-	
-	err = apiClient.IgnorePatches(deviceID, patchIDs)
+	patches, err := patchEntities(inv.api, deviceID, patchIDs)
 	if err != nil {
-		log.Fatalf("Error ignoring patches: %v", err)
+		return err
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Patches ignored\"}")
+	return inv.apply(change{
+		action:   fmt.Sprintf("ignore %d patches of device %d", len(patchIDs), deviceID),
+		affected: append([]entity{deviceEntity(deviceID)}, patches...),
+		call:     func(api *nsight.ApiClient) error { return api.IgnorePatches(deviceID, patchIDs) },
+		done:     "Patches ignored",
+	})
 }
 
-func handleListAntivirusProducts(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_antivirus_products")
-	}
-	products, err := apiClient.FetchAntivirusProducts()
+func handleListAntivirusProducts(inv *invocation) error {
+	products, err := inv.api.FetchAntivirusProducts()
 	if err != nil {
-		log.Fatalf("Error fetching antivirus products: %v", err)
+		return fmt.Errorf("could not fetch antivirus products: %w", err)
 	}
-	outputJSON(products)
+	return printResult(products)
 }
 
-func handleListAntivirusDefinitions(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_antivirus_definitions <device_id>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListAntivirusDefinitions(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	definitions, err := apiClient.FetchAntivirusDefinitions(deviceID)
+	definitions, err := inv.api.FetchAntivirusDefinitions(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching antivirus definitions: %v", err)
+		return fmt.Errorf("could not fetch antivirus definitions: %w", err)
 	}
-	outputJSON(definitions)
+	return printResult(definitions)
 }
 
-func handleListQuarantine(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_quarantine <device_id>")
+func handleListQuarantine(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
+	if err != nil {
+		return err
 	}
-	deviceID, err := resolveDeviceID(args[0])
+	quarantine, err := inv.api.FetchQuarantineList(deviceID)
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return fmt.Errorf("could not fetch quarantine list: %w", err)
 	}
-	quarantine, err := apiClient.FetchQuarantineList(deviceID)
+	return printResult(quarantine)
+}
+
+func handleStartAntivirusScan(inv *invocation) error {
+	deviceID, err := resolveTargetDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Error fetching quarantine list: %v", err)
+		return err
 	}
-	outputJSON(quarantine)
+	scanType := inv.String("type")
+	return inv.apply(change{
+		action:   fmt.Sprintf("start a %s antivirus scan on device %d", scanType, deviceID),
+		affected: []entity{deviceEntity(deviceID)},
+		call:     func(api *nsight.ApiClient) error { return api.StartAntivirusScan(deviceID, scanType) },
+		done:     "Antivirus scan started",
+	})
 }
 
-func handleStartAntivirusScan(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: start_scan <device_id> <scan_type>")
+func handleListPerformanceHistory(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
+	if err != nil {
+		return err
 	}
-	deviceID, err := resolveDeviceID(args[0])
+	checkID, err := inv.Int("check")
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	err = apiClient.StartAntivirusScan(deviceID, args[1])
+	history, err := inv.api.FetchPerformanceHistory(deviceID, checkID, inv.String("from"), inv.String("to"))
 	if err != nil {
-		log.Fatalf("Error starting antivirus scan: %v", err)
+		return fmt.Errorf("could not fetch performance history: %w", err)
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Antivirus scan started\"}")
+	return printResult(history)
 }
 
-func handleListPerformanceHistory(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 4 {
-		log.Fatalf("Usage: list_performance_history <device_id> <check_id> <start_date> <end_date>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListDriveSpaceHistory(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	checkID, err := strconv.Atoi(args[1])
+	history, err := inv.api.FetchDriveSpaceHistory(deviceID, inv.String("from"), inv.String("to"))
 	if err != nil {
-		log.Fatalf("Invalid check ID: %v", err)
+		return fmt.Errorf("could not fetch drive space history: %w", err)
 	}
-	history, err := apiClient.FetchPerformanceHistory(deviceID, checkID, args[2], args[3])
+	return printResult(history)
+}
+
+func handleListTemplates(inv *invocation) error {
+	templates, err := inv.api.FetchTemplates()
 	if err != nil {
-		log.Fatalf("Error fetching performance history: %v", err)
+		return fmt.Errorf("could not fetch templates: %w", err)
 	}
-	outputJSON(history)
+	return printResult(templates)
 }
 
-func handleListDriveSpaceHistory(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 3 {
-		log.Fatalf("Usage: list_drive_space_history <device_id> <start_date> <end_date>")
-	}
-	deviceID, err := resolveDeviceID(args[0])
+func handleListBackupSessions(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	history, err := apiClient.FetchDriveSpaceHistory(deviceID, args[1], args[2])
+	sessions, err := inv.api.FetchBackupSessions(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching drive space history: %v", err)
+		return fmt.Errorf("could not fetch backup sessions: %w", err)
 	}
-	outputJSON(history)
+	return printResult(sessions)
 }
 
-func handleListTemplates(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_templates")
-	}
-	templates, err := apiClient.FetchTemplates()
+func handleListWallChartSettings(inv *invocation) error {
+	settings, err := inv.api.FetchWallChartSettings()
 	if err != nil {
-		log.Fatalf("Error fetching templates: %v", err)
+		return fmt.Errorf("could not fetch wall chart settings: %w", err)
 	}
-	outputJSON(templates)
+	return printResult(settings)
 }
 
-func handleListBackupSessions(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_backup_sessions <device_id>")
+func handleListGeneralSettings(inv *invocation) error {
+	settings, err := inv.api.FetchGeneralSettings()
+	if err != nil {
+		return fmt.Errorf("could not fetch general settings: %w", err)
 	}
-	deviceID, err := resolveDeviceID(args[0])
+	return printResult(settings)
+}
+
+func handleListActiveDirectoryUsers(inv *invocation) error {
+	deviceID, err := resolveDeviceID(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	sessions, err := apiClient.FetchBackupSessions(deviceID)
+	users, err := inv.api.FetchActiveDirectoryUsers(deviceID)
 	if err != nil {
-		log.Fatalf("Error fetching backup sessions: %v", err)
+		return fmt.Errorf("could not fetch Active Directory users: %w", err)
 	}
-	outputJSON(sessions)
+	return printResult(users)
 }
 
-func handleListWallChartSettings(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_wall_chart_settings")
-	}
-	settings, err := apiClient.FetchWallChartSettings()
+func handleRunTaskNow(inv *invocation) error {
+	taskID, err := inv.Int("task")
 	if err != nil {
-		log.Fatalf("Error fetching wall chart settings: %v", err)
+		return err
 	}
-	outputJSON(settings)
+	// N-Sight has no call that describes a task
+	return inv.apply(change{
+		action:   fmt.Sprintf("run task %d now", taskID),
+		affected: []entity{{Kind: "task", ID: taskID}},
+		call:     func(api *nsight.ApiClient) error { return api.RunTaskNow(taskID) },
+		done:     "Task started",
+	})
 }
 
-func handleListGeneralSettings(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 0 {
-		log.Fatalf("Usage: list_general_settings")
-	}
-	settings, err := apiClient.FetchGeneralSettings()
+func handleAddClient(inv *invocation) error {
+	name, contactName, contactEmail := inv.String("name"), inv.String("contact-name"), inv.String("contact-email")
+	client, err := newClientEntity(inv.api, name)
 	if err != nil {
-		log.Fatalf("Error fetching general settings: %v", err)
+		return err
 	}
-	outputJSON(settings)
+	return inv.apply(change{
+		action:   fmt.Sprintf("add client %q", name),
+		affected: []entity{client},
+		call:     func(api *nsight.ApiClient) error { return api.AddClient(name, contactName, contactEmail) },
+		done:     "Client added",
+	})
 }
 
-func handleListActiveDirectoryUsers(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: list_active_directory_users <device_id>")
+func handleAddSite(inv *invocation) error {
+	clientID, err := resolveClientID(inv.String("client"))
+	if err != nil {
+		return err
 	}
-	deviceID, err := resolveDeviceID(args[0])
+	name, contactName, contactEmail := inv.String("name"), inv.String("contact-name"), inv.String("contact-email")
+	client, err := clientEntity(inv.api, clientID)
 	if err != nil {
-		log.Fatalf("Invalid device ID: %v", err)
+		return err
 	}
-	users, err := apiClient.FetchActiveDirectoryUsers(deviceID)
+	site, err := newSiteEntity(inv.api, clientID, name)
 	if err != nil {
-		log.Fatalf("Error fetching Active Directory users: %v", err)
+		return err
 	}
-	outputJSON(users)
+	return inv.apply(change{
+		action:   fmt.Sprintf("add site %q to client %d", name, clientID),
+		affected: []entity{client, site},
+		call:     func(api *nsight.ApiClient) error { return api.AddSite(clientID, name, contactName, contactEmail) },
+		done:     "Site added",
+	})
 }
 
-func handleRunTaskNow(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Usage: run_task_now <task_id>")
-	}
-	taskID, err := strconv.Atoi(args[0])
+func handleGetSiteInstallationPackage(inv *invocation) error {
+	siteID, err := resolveSiteID(inv.String("site"))
 	if err != nil {
-		log.Fatalf("Invalid task ID: %v", err)
+		return err
 	}
-	err = apiClient.RunTaskNow(taskID)
+	packageData, err := inv.api.GetSiteInstallationPackage(siteID, inv.String("type"))
 	if err != nil {
-		log.Fatalf("Error running task: %v", err)
+		return fmt.Errorf("could not get installation package: %w", err)
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Task started\"}")
+	// For binary data, we could base64 encode or save to file
+	fmt.Printf("{\"status\": \"success\", \"package_size\": %d}\n", len(packageData))
+	return nil
 }
 
-func handleAddClient(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 3 {
-		log.Fatalf("Usage: add_client \"<name>\" \"<contact_name>\" \"<contact_email>\"")
+// -- Device Overview --
+
+// handleDeviceOverview prints everything about one device, resolving names like resolveDeviceID
+func handleDeviceOverview(inv *invocation) error {
+	var opts overview.Options
+	if inv.Given("days") {
+		days, err := inv.Int("days")
+		if err != nil || days < 1 {
+			return usageErrorf("invalid --days %q, expected a positive number", inv.String("days"))
+		}
+		opts.Days = days
 	}
-	err := apiClient.AddClient(args[0], args[1], args[2])
+
+	// Numeric IDs are placed in the tree from the name index if possible
+	var location *inventory.DeviceLocation
+	deviceID, err := strconv.Atoi(inv.String("device"))
 	if err != nil {
-		log.Fatalf("Error adding client: %v", err)
+		if location, err = findDevice(inv.String("device"), false); err != nil {
+			return err
+		}
+		deviceID = location.DeviceID
+	} else {
+		location = names.Locate(deviceID, nil)
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Client added\"}")
+
+	device := overview.Build(inv.api, deviceID, location, opts)
+	if err := device.Err(); err != nil {
+		return fmt.Errorf("could not fetch device overview: %w", err)
+	}
+	for _, partErr := range device.Errors {
+		log.Printf("Warning: %s unavailable: %s", partErr.Part, partErr.Error)
+	}
+	return printResult(device)
 }
 
-func handleAddSite(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 4 {
-		log.Fatalf("Usage: add_site <client_id> \"<name>\" \"<contact_name>\" \"<contact_email>\"")
+// -- Audit Log, Configuration and Help --
+
+// handleConfig prints the effective configuration with secrets redacted
+func handleConfig(inv *invocation) error {
+	format := inv.String("format")
+	if inv.cfg.File != "" && format != "json" {
+		fmt.Printf("# Loaded from %s\n", inv.cfg.File)
 	}
-	clientID, err := strconv.Atoi(args[0])
-	if err != nil {
-		log.Fatalf("Invalid client ID: %v", err)
+	return inv.cfg.Redacted().Write(os.Stdout, format)
+}
+
+// handleEncryptKey writes the API key read from stdin to an encrypted key
+// file for the encrypted: key source
+func handleEncryptKey(inv *invocation) error {
+	passphrase := os.Getenv("NSIGHT_KEY_PASSPHRASE")
+	if passphrase == "" {
+		return usageErrorf("NSIGHT_KEY_PASSPHRASE must be set")
 	}
-	err = apiClient.AddSite(clientID, args[1], args[2], args[3])
-	if err != nil {
-		log.Fatalf("Error adding site: %v", err)
+	key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read key from stdin: %w", err)
 	}
-	fmt.Println("{\"status\": \"success\", \"message\": \"Site added\"}")
+	file := inv.String("file")
+	if err := credentials.WriteEncrypted(file, strings.TrimSpace(key), passphrase); err != nil {
+		return fmt.Errorf("could not write encrypted key: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Encrypted key written to %s, use NSIGHT_API_KEY_SOURCE=\"encrypted:%s\"\n", file, file)
+	return nil
 }
 
-func handleGetSiteInstallationPackage(apiClient *nsight.ApiClient, args []string) {
-	if len(args) != 2 {
-		log.Fatalf("Usage: get_site_installation_package <site_id> <package_type>")
+// handleAuditLog prints the audit records of mutating calls that match the filters
+func handleAuditLog(inv *invocation) error {
+	file := inv.String("file")
+	if file == "" {
+		file = audit.LogPath()
 	}
-	siteID, err := strconv.Atoi(args[0])
-	if err != nil {
-		log.Fatalf("Invalid site ID: %v", err)
+	if file == "" {
+		return fmt.Errorf("audit log is disabled (audit.log is off), use --file to read an existing log")
 	}
-	packageData, err := apiClient.GetSiteInstallationPackage(siteID, args[1])
+	filter := audit.Filter{
+		Service: inv.String("service"),
+		User:    inv.String("user"),
+		Tool:    inv.String("tool"),
+		Target:  inv.String("target"),
+		Outcome: inv.String("outcome"),
+	}
+	var err error
+	if inv.Given("limit") {
+		if filter.Limit, err = inv.Int("limit"); err != nil {
+			return err
+		}
+	}
+	if inv.Given("since") {
+		if filter.Since, err = parseAuditTime(inv.String("since")); err != nil {
+			return usageErrorf("invalid --since: %v", err)
+		}
+	}
+	if inv.Given("until") {
+		if filter.Until, err = parseAuditTime(inv.String("until")); err != nil {
+			return usageErrorf("invalid --until: %v", err)
+		}
+	}
+
+	records, skipped, err := audit.ReadFile(file, filter)
 	if err != nil {
-		log.Fatalf("Error getting installation package: %v", err)
+		return fmt.Errorf("could not read audit log: %w", err)
 	}
-	// For binary data, we could base64 encode or save to file
-	fmt.Printf("{\"status\": \"success\", \"package_size\": %d}\n", len(packageData))
+	if skipped > 0 {
+		log.Printf("Warning: Skipped %d malformed lines in %s", skipped, file)
+	}
+	if records == nil {
+		records = []audit.Record{}
+	}
+	return printResult(records)
+}
+
+// handleHelp prints the usage of getdata or of one command
+func handleHelp(inv *invocation) error {
+	if !inv.Given("command") {
+		printUsage(os.Stdout)
+		return nil
+	}
+	cmd := findCommand(inv.String("command"))
+	if cmd == nil {
+		return usageErrorf("unknown command %q, see getdata help", inv.String("command"))
+	}
+	cmd.printHelp(os.Stdout)
+	return nil
+}
+
+// parseAuditTime reads a duration before now, a date or an RFC 3339 timestamp
+func parseAuditTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/output"
+)
+
+// shellKeys are the key hints in the footer of the shell
+const shellKeys = "[yellow]Enter/→[-] open  [yellow]Esc/←[-] back  [yellow]/[-] search  [yellow]r[-] refresh  [yellow]n[-] note  [yellow]c[-] clear check  [yellow]q[-] quit"
+
+// level is one step of the hierarchy shown by the shell
+type level struct {
+	title  string
+	parent *node
+	load   func() ([]node, error) // nil for levels that need no loading
+	nodes  []node
+	shown  []node // nodes matching the search
+	search string
+}
+
+// shell is the interactive browser of getdata shell
+type shell struct {
+	app     *tview.Application
+	pages   *tview.Pages
+	header  *tview.TextView
+	search  *tview.InputField
+	list    *tview.List
+	details *tview.TextView
+	footer  *tview.TextView
+
+	browser *browser
+	source  string // Where the data shown comes from
+	levels  []*level
+	busy    bool // A call is running; only one runs at a time
+}
+
+func handleShell(inv *invocation) error {
+	inst, apiClient, err := openInstance(inv.cfg)
+	var auth *authError
+	if err != nil && (inst == nil || !errors.As(err, &auth)) {
+		return err
+	}
+	return runShell(newBrowser(apiClient, inst.CacheDir, err))
+}
+
+// runShell shows the shell until the user quits
+func runShell(b *browser) error {
+	// Log lines would garble the screen
+	logOutput, stderr := log.Writer(), os.Stderr
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stderr = devNull
+		defer devNull.Close()
+	}
+	log.SetOutput(io.Discard)
+	defer func() {
+		os.Stderr = stderr
+		log.SetOutput(logOutput)
+	}()
+
+	s := newShell(b)
+	s.open(&level{title: "Clients", load: b.clients})
+	if err := s.app.Run(); err != nil {
+		return fmt.Errorf("could not run the shell: %w", err)
+	}
+	return nil
+}
+
+// newShell lays out the shell
+func newShell(b *browser) *shell {
+	s := &shell{
+		app:     tview.NewApplication(),
+		pages:   tview.NewPages(),
+		header:  tview.NewTextView().SetDynamicColors(true),
+		search:  tview.NewInputField().SetLabel("Search: "),
+		list:    tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true),
+		details: tview.NewTextView().SetScrollable(true).SetWrap(false),
+		footer:  tview.NewTextView().SetDynamicColors(true),
+		browser: b,
+		source:  b.source(),
+	}
+	s.list.SetBorder(true)
+	s.details.SetBorder(true).SetTitle(" Details ")
+	s.list.SetChangedFunc(func(index int, _, _ string, _ rune) { s.showDetails(index) })
+	s.list.SetSelectedFunc(func(index int, _, _ string, _ rune) { s.enter(index) })
+	s.list.SetInputCapture(s.listKey)
+	s.search.SetChangedFunc(func(text string) { s.filter(text) })
+	s.search.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			s.search.SetText("")
+		}
+		s.app.SetFocus(s.list)
+	})
+
+	body := tview.NewFlex().
+		AddItem(s.list, 0, 1, true).
+		AddItem(s.details, 0, 1, false)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(s.header, 1, 0, false).
+		AddItem(s.search, 1, 0, false).
+		AddItem(body, 0, 1, true).
+		AddItem(s.footer, 2, 0, false)
+	s.pages.AddPage("main", layout, true, true)
+	s.app.SetRoot(s.pages, true).SetFocus(s.list)
+	return s
+}
+
+// current returns the level shown
+func (s *shell) current() *level {
+	return s.levels[len(s.levels)-1]
+}
+
+// listKey handles the keys of the list that are not list navigation
+func (s *shell) listKey(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyRight:
+		s.enter(s.list.GetCurrentItem())
+		return nil
+	case tcell.KeyLeft, tcell.KeyEscape, tcell.KeyBackspace, tcell.KeyBackspace2:
+		s.back()
+		return nil
+	case tcell.KeyRune:
+		switch event.Rune() {
+		case '/':
+			s.app.SetFocus(s.search)
+		case 'q':
+			s.app.Stop()
+		case 'r':
+			if !s.busy {
+				s.browser.retry()
+				s.reload("")
+			}
+		case 'n':
+			s.addNote()
+		case 'c':
+			s.clearCheck()
+		}
+		return nil
+	}
+	return event
+}
+
+// open shows a new level below the current one
+func (s *shell) open(l *level) {
+	s.levels = append(s.levels, l)
+	s.search.SetText("")
+	if l.load == nil {
+		s.show(l)
+		return
+	}
+	s.reload("")
+}
+
+// back returns to the level above
+func (s *shell) back() {
+	if len(s.levels) == 1 || s.busy {
+		return
+	}
+	s.levels = s.levels[:len(s.levels)-1]
+	l := s.current()
+	s.search.SetText(l.search)
+	s.show(l)
+}
+
+// reload loads the current level again and shows status when it is done
+func (s *shell) reload(status string) {
+	l := s.current()
+	if l.load == nil || s.busy {
+		s.setStatus(status)
+		return
+	}
+	s.busy = true
+	s.setStatus("Loading…")
+	go func() {
+		nodes, err := l.load()
+		source, offline := s.browser.source(), s.browser.offline
+		s.app.QueueUpdateDraw(func() {
+			s.busy = false
+			s.source = source
+			if err != nil {
+				l.nodes = nil
+				s.show(l)
+				s.setError(err)
+				return
+			}
+			l.nodes = nodes
+			s.show(l)
+			if status == "" && offline != nil {
+				status = "Offline: " + offline.Error()
+			}
+			s.setStatus(status)
+		})
+	}()
+}
+
+// show fills the list with the nodes of a level matching the search
+func (s *shell) show(l *level) {
+	l.search = s.search.GetText()
+	l.shown = l.shown[:0]
+	for _, n := range l.nodes {
+		if l.search == "" || n.matches(l.search) {
+			l.shown = append(l.shown, n)
+		}
+	}
+	s.list.Clear()
+	for _, n := range l.shown {
+		s.list.AddItem(n.label(), "", 0, nil)
+	}
+	s.list.SetTitle(fmt.Sprintf(" %s (%d) ", tview.Escape(l.title), len(l.shown)))
+	s.header.SetText(s.breadcrumb() + "  [gray](" + tview.Escape(s.source) + ")[-]")
+	s.showDetails(s.list.GetCurrentItem())
+}
+
+// filter shows the nodes of the current level matching a search text
+func (s *shell) filter(text string) {
+	if len(s.levels) > 0 && text != s.current().search {
+		s.show(s.current())
+	}
+}
+
+// breadcrumb is the path to the current level
+func (s *shell) breadcrumb() string {
+	parts := []string{"Clients"}
+	for _, l := range s.levels[1:] {
+		parts = append(parts, l.title)
+	}
+	return "[::b]" + tview.Escape(strings.Join(parts, " › ")) + "[::-]"
+}
+
+// selected returns the node at a list index, nil if there is none
+func (s *shell) selected(index int) *node {
+	shown := s.current().shown
+	if index < 0 || index >= len(shown) {
+		return nil
+	}
+	n := shown[index]
+	return &n
+}
+
+// showDetails shows the record of the node at a list index
+func (s *shell) showDetails(index int) {
+	n := s.selected(index)
+	if n == nil {
+		s.details.SetText("")
+		return
+	}
+	s.showRecord(n.record)
+}
+
+// showRecord shows a record as YAML in the details pane
+func (s *shell) showRecord(record interface{}) {
+	var buf bytes.Buffer
+	if err := output.Write(&buf, record, output.Options{Format: output.FormatYAML}); err != nil {
+		buf.Reset()
+		fmt.Fprintf(&buf, "could not show the details: %v", err)
+	}
+	s.details.SetText(buf.String()).ScrollToBeginning()
+}
+
+// enter opens the level below the node at a list index
+func (s *shell) enter(index int) {
+	n := s.selected(index)
+	if n == nil || s.busy {
+		return
+	}
+	b := s.browser
+	switch n.kind {
+	case nodeClient:
+		s.open(&level{title: n.name, parent: n, load: func() ([]node, error) { return b.sites(n) }})
+	case nodeSite:
+		s.open(&level{title: n.name, parent: n, load: func() ([]node, error) { return b.devices(n) }})
+	case nodeDevice:
+		s.open(&level{title: n.name, parent: n, nodes: b.views(n)})
+	case nodeView:
+		device := n.parent
+		switch n.name {
+		case viewChecks:
+			s.open(&level{title: viewChecks, parent: device, load: func() ([]node, error) { return b.checks(device) }})
+		case viewPatches:
+			s.open(&level{title: viewPatches, parent: device, load: func() ([]node, error) { return b.patches(device) }})
+		case viewAsset:
+			s.showAssetDetails(device)
+		}
+	}
+}
+
+// showAssetDetails loads the asset details of a device into the details pane
+func (s *shell) showAssetDetails(device *node) {
+	s.busy = true
+	s.setStatus("Loading asset details…")
+	go func() {
+		details, err := s.browser.assetDetails(device)
+		s.app.QueueUpdateDraw(func() {
+			s.busy = false
+			if err != nil {
+				s.setError(err)
+				return
+			}
+			s.showRecord(details)
+			s.setStatus("Asset details of " + device.name)
+		})
+	}()
+}
+
+// selectedCheck returns the selected check for an action, nil after
+// telling the user why there is none
+func (s *shell) selectedCheck() *node {
+	n := s.selected(s.list.GetCurrentItem())
+	switch {
+	case s.busy:
+		return nil
+	case n == nil || n.kind != nodeCheck:
+		s.setStatus("Select a check first")
+		return nil
+	case nsight.ReadOnly():
+		s.setStatus("Read-only mode, checks cannot be changed")
+		return nil
+	case s.browser.api == nil || strings.HasPrefix(s.source, "offline"):
+		s.setStatus("Checks cannot be changed offline, press r to retry online")
+		return nil
+	}
+	return n
+}
+
+// addNote asks for a note and adds it to the selected check
+func (s *shell) addNote() {
+	check := s.selectedCheck()
+	if check == nil {
+		return
+	}
+	form := tview.NewForm()
+	form.AddInputField("Note", "", 50, nil, nil)
+	form.AddButton("Add", func() {
+		note := form.GetFormItemByLabel("Note").(*tview.InputField).GetText()
+		s.closeDialog()
+		if strings.TrimSpace(note) == "" {
+			s.setStatus("No note added")
+			return
+		}
+		s.change(fmt.Sprintf("Note added to check %d", check.id), func() error {
+			return s.browser.api.AddCheckNote(check.id, note)
+		})
+	})
+	form.AddButton("Cancel", s.closeDialog)
+	form.SetCancelFunc(s.closeDialog)
+	form.SetBorder(true).SetTitle(fmt.Sprintf(" Note for check %d %s ", check.id, tview.Escape(check.name)))
+	s.pages.AddPage("dialog", centered(form, 70, 7), true, true)
+}
+
+// clearCheck clears the selected check after confirmation
+func (s *shell) clearCheck() {
+	check := s.selectedCheck()
+	if check == nil {
+		return
+	}
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("Clear check %d %s on %s?", check.id, check.name, check.parent.name)).
+		AddButtons([]string{"Cancel", "Clear"}).
+		SetDoneFunc(func(_ int, label string) {
+			s.closeDialog()
+			if label != "Clear" {
+				return
+			}
+			s.change(fmt.Sprintf("Check %d cleared", check.id), func() error {
+				return s.browser.api.ClearCheck(check.id)
+			})
+		})
+	s.pages.AddPage("dialog", modal, false, true)
+}
+
+// change runs a call that changes data and reloads the level when it succeeded
+func (s *shell) change(done string, call func() error) {
+	s.busy = true
+	s.setStatus("Saving…")
+	go func() {
+		err := call()
+		s.app.QueueUpdateDraw(func() {
+			s.busy = false
+			if err != nil {
+				s.setError(err)
+				return
+			}
+			s.reload(done)
+		})
+	}()
+}
+
+// closeDialog removes a note form or confirmation
+func (s *shell) closeDialog() {
+	s.pages.RemovePage("dialog")
+	s.app.SetFocus(s.list)
+}
+
+// setStatus shows a message above the key hints
+func (s *shell) setStatus(status string) {
+	s.footer.SetText(tview.Escape(status) + "\n" + shellKeys)
+}
+
+// setError shows an error above the key hints
+func (s *shell) setError(err error) {
+	s.footer.SetText("[red]" + tview.Escape(err.Error()) + "[-]\n" + shellKeys)
+}
+
+// centered places a dialog of a size in the middle of the screen
+func centered(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 0, true).
+			AddItem(nil, 0, 1, false), width, 0, true).
+		AddItem(nil, 0, 1, false)
+}
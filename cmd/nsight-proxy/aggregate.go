@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"nsight-proxy/internal/instance"
+	"nsight-proxy/internal/inventory"
+)
+
+// inventoryReloadInterval is how often the fetchall cache is checked for a newer completed fetch
+const inventoryReloadInterval = 30 * time.Second
+
+// inventoryStore holds the nested tree built from the fetchall CSV cache
+type inventoryStore struct {
+	mu      sync.RWMutex
+	dir     string
+	clients []inventory.ClientDetail
+	updated time.Time // Completion time of the loaded fetch, zero if nothing is loaded
+	onLoad  func()    // Called after a new cache has been loaded
+}
+
+// newInventoryStore loads the cache from dir. A missing cache is logged, not fatal.
+func newInventoryStore(dir string, onLoad func()) *inventoryStore {
+	s := &inventoryStore{dir: dir, onLoad: onLoad}
+	if err := s.reload(); err != nil {
+		log.Printf("Warning: Aggregate endpoints unavailable until fetchall completes: %v", err)
+	}
+	return s
+}
+
+// reload rebuilds the tree if the cache was completed after the loaded one
+func (s *inventoryStore) reload() error {
+	updated, err := inventory.Updated(s.dir)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	current := s.updated
+	s.mu.RUnlock()
+	if !updated.After(current) {
+		return nil
+	}
+
+	clients, err := inventory.BuildFromCache(s.dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.clients = clients
+	s.updated = updated
+	s.mu.Unlock()
+	log.Printf("Loaded inventory of %d clients from %s (completed %s)", len(clients), s.dir, updated.Format(time.RFC3339))
+
+	if s.onLoad != nil {
+		s.onLoad()
+	}
+	return nil
+}
+
+// watch reloads the cache whenever fetchall completes a new fetch
+func (s *inventoryStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Failed to reload inventory cache: %v", err)
+		}
+	}
+}
+
+// snapshot returns the loaded tree and its completion time
+func (s *inventoryStore) snapshot() ([]inventory.ClientDetail, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clients, s.updated
+}
+
+// aggregateResponse wraps aggregate results with the age of the cache they come from
+type aggregateResponse struct {
+	CacheUpdated    time.Time                `json:"cache_updated"`
+	CacheAgeSeconds int64                    `json:"cache_age_seconds"`
+	Items           []inventory.ClientDetail `json:"items"`
+}
+
+// aggregateAccess authorizes a request for cached data and returns the
+// instance it is for. Tenant tokens see their own clients; otherwise the apikey
+// must match the key fetchall uses for the instance. The instance is nil for
+// /instances/all, which only the default instance's key may read.
+func (ps *ProxyServer) aggregateAccess(r *http.Request) (*Tenant, *proxyInstance, bool) {
+	if token := requestToken(r); token != "" {
+		tenant := ps.tenants[token]
+		if tenant == nil || pathInstance(r) == instance.All {
+			return nil, nil, false
+		}
+		inst, denied := ps.requestInstance(r, tenant)
+		return tenant, inst, denied == ""
+	}
+
+	inst := ps.defaultInstance
+	if name := pathInstance(r); name != "" && name != instance.All {
+		inst = ps.instances[name]
+	}
+	if !inst.isOwnKey(r.Context(), r.URL.Query().Get("apikey")) {
+		return nil, nil, false
+	}
+	if pathInstance(r) == instance.All {
+		return nil, nil, true
+	}
+	return nil, inst, true
+}
+
+// inventorySnapshot returns the cached tree of one instance, or of all
+// instances for a nil instance. Clients are tagged with their instance when
+// instances are configured; the time is that of the oldest cache.
+func (ps *ProxyServer) inventorySnapshot(inst *proxyInstance) ([]inventory.ClientDetail, time.Time) {
+	instances := ps.instanceOrder
+	if inst != nil {
+		instances = []*proxyInstance{inst}
+	}
+	var merged []inventory.ClientDetail
+	var oldest time.Time
+	for _, pi := range instances {
+		clients, updated := pi.inventory.snapshot()
+		if updated.IsZero() {
+			return nil, time.Time{}
+		}
+		if oldest.IsZero() || updated.Before(oldest) {
+			oldest = updated
+		}
+		if !ps.namedInstances {
+			merged = append(merged, clients...)
+			continue
+		}
+		for _, c := range clients {
+			c.Instance = pi.Name
+			merged = append(merged, c)
+		}
+	}
+	return merged, oldest
+}
+
+// handleAggregate serves nested trees from the fetchall cache. The view
+// selects which part of the asset details is returned.
+func (ps *ProxyServer) handleAggregate(view string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, Link, Content-Disposition, X-Request-ID, Retry-After")
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == "OPTIONS" {
+			return
+		}
+		if r.Method != "GET" {
+			writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only GET method is supported")
+			return
+		}
+
+		tenant, inst, ok := ps.aggregateAccess(r)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid credentials")
+			return
+		}
+
+		clients, updated := ps.inventorySnapshot(inst)
+		if updated.IsZero() {
+			writeProblem(w, r, http.StatusServiceUnavailable, codeCacheMissing, "Inventory cache is not available, run fetchall first")
+			return
+		}
+
+		_, selectSpan := startSpan(r.Context(), "proxy.aggregate.select", attribute.String("aggregate.view", view))
+		query := r.URL.Query()
+		if tenant != nil {
+			clients = inventory.FilterClients(clients, func(c inventory.ClientDetail) bool {
+				return tenant.allowsClient(c.ID)
+			})
+		}
+		clients = inventory.Select(clients, query.Get("client"), query.Get("site"))
+
+		switch view {
+		case "software":
+			clients = inventory.FilterSoftware(clients, query.Get("name"))
+		case "hardware":
+			clients = inventory.FilterHardware(clients, query.Get("name"))
+		}
+
+		selectSpan.SetAttributes(attribute.Int("aggregate.clients", len(clients)))
+		selectSpan.End()
+
+		_, marshalSpan := startSpan(r.Context(), "proxy.marshalJSON")
+		age := time.Since(updated)
+		jsonData, err := json.Marshal(aggregateResponse{
+			CacheUpdated:    updated,
+			CacheAgeSeconds: int64(age.Seconds()),
+			Items:           clients,
+		})
+		marshalSpan.SetAttributes(attribute.Int("response.bytes", len(jsonData)))
+		marshalSpan.End()
+		if err != nil {
+			log.Printf("Error marshaling aggregate %s: %v", view, err)
+			writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to convert response to JSON")
+			return
+		}
+
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		w.Header().Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+		writeResult(w, r, view, jsonData)
+	}
+}
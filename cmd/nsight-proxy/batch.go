@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxBatchItems    = 50      // Invocations accepted in one batch
+	maxBatchBody     = 1 << 20 // Size limit of the batch request body
+	batchConcurrency = 8       // Invocations running at once; upstream calls still share the rate limiter
+)
+
+// batchItem is one service invocation of a batch
+type batchItem struct {
+	ID      string            `json:"id"` // Key of the result, defaults to the service name
+	Service string            `json:"service"`
+	Params  map[string]string `json:"params"` // Service parameters and list options such as fields or limit
+}
+
+// batchResult is the outcome of one invocation. Body holds the service
+// result or, for failed invocations, the problem details.
+type batchResult struct {
+	Status     int             `json:"status"`
+	Cache      string          `json:"cache,omitempty"`       // X-Cache of the invocation
+	RetryAfter string          `json:"retry_after,omitempty"` // Seconds to wait before retrying a throttled invocation
+	Body       json.RawMessage `json:"body"`
+}
+
+// batchResponse keys the results by item ID
+type batchResponse struct {
+	Results   map[string]batchResult `json:"results"`
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+}
+
+// bufferedResponse collects the response of one invocation in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// handleBatch runs several service invocations concurrently and returns their
+// results keyed by ID. Each invocation goes through handleAPI with the batch's
+// credentials, so tenant scope, caching and errors work as for single calls,
+// and a failed invocation does not fail the batch.
+func (ps *ProxyServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cache-Control, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only POST method is supported")
+		return
+	}
+
+	var items []batchItem
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBatchBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&items); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Body must be a JSON array of {\"id\", \"service\", \"params\"} objects")
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchItems {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("A batch must contain 1 to %d invocations", maxBatchItems))
+		return
+	}
+	seen := make(map[string]bool, len(items))
+	for i := range items {
+		if items[i].ID == "" {
+			items[i].ID = items[i].Service
+		}
+		if items[i].ID == "" {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("Invocation %d has no service", i))
+			return
+		}
+		if seen[items[i].ID] {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("Duplicate invocation id %q, set a unique id", items[i].ID))
+			return
+		}
+		seen[items[i].ID] = true
+	}
+
+	results := make([]batchResult, len(items))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = ps.runBatchItem(r, fmt.Sprintf("%s-%d", requestID(r), i), item)
+		}()
+	}
+	wg.Wait()
+
+	resp := batchResponse{Results: make(map[string]batchResult, len(items))}
+	for i, item := range items {
+		resp.Results[item.ID] = results[i]
+		if results[i].Status < http.StatusBadRequest {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runBatchItem runs one invocation through handleAPI. Read services are called
+// with GET and services that change data with POST.
+func (ps *ProxyServer) runBatchItem(parent *http.Request, id string, item batchItem) batchResult {
+	ctx, span := startSpan(parent.Context(), "proxy.batchItem", attribute.String("nsight.service", item.Service))
+	defer span.End()
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	query := url.Values{}
+	for name, value := range item.Params {
+		query.Set(name, value)
+	}
+	query.Set("service", item.Service)
+	query.Set("format", formatJSON)
+	query.Del("apikey")
+	query.Del("token")
+	if apiKey := parent.URL.Query().Get("apikey"); apiKey != "" {
+		query.Set("apikey", apiKey)
+	}
+	if token := parent.URL.Query().Get("token"); token != "" {
+		query.Set("token", token)
+	}
+
+	method := "GET"
+	if spec, ok := services[item.Service]; ok && spec.mutating {
+		method = "POST"
+	}
+	rec := &bufferedResponse{header: make(http.Header)}
+	req, err := http.NewRequestWithContext(ctx, method, "/api/?"+query.Encode(), http.NoBody)
+	if err != nil {
+		writeProblem(rec, parent, http.StatusBadRequest, codeInvalidRequest, "Invalid invocation")
+	} else {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = parent.RemoteAddr
+		for _, name := range []string{"Authorization", "Cache-Control"} {
+			if value := parent.Header.Get(name); value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+		instrument("batch_item", ps.handleAPI)(rec, req)
+	}
+
+	result := batchResult{
+		Status:     rec.status,
+		Cache:      rec.header.Get("X-Cache"),
+		RetryAfter: rec.header.Get("Retry-After"),
+	}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", result.Status))
+	if json.Valid(rec.body.Bytes()) {
+		result.Body = json.RawMessage(rec.body.Bytes())
+	} else {
+		result.Body, _ = json.Marshal(rec.body.String())
+	}
+	return result
+}
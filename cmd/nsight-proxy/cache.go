@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/metrics"
+)
+
+// Cache status values reported in the X-Cache response header
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheStale  = "STALE"
+	cacheBypass = "BYPASS"
+)
+
+// defaultCacheTTLs are the per-service lifetimes of cached responses.
+// Services not listed use defaultCacheTTL; a TTL of zero disables caching.
+var defaultCacheTTLs = map[string]time.Duration{
+	"list_failing_checks":            30 * time.Second,
+	"list_checks":                    time.Minute,
+	"list_device_monitoring_details": time.Minute,
+	"list_clients":                   10 * time.Minute,
+	"list_sites":                     10 * time.Minute,
+	"list_device_asset_details":      time.Hour,
+	"list_hardware":                  time.Hour,
+	"list_software":                  time.Hour,
+	"list_license_groups":            time.Hour,
+	"list_templates":                 time.Hour,
+	"list_antivirus_products":        24 * time.Hour,
+}
+
+// defaultCacheTTL is used for services without a configured lifetime
+const defaultCacheTTL = 5 * time.Minute
+
+// cacheEntry is one cached response body
+type cacheEntry struct {
+	Key     string    `json:"key"`
+	Service string    `json:"service"`
+	KeyHash string    `json:"key_hash"` // Hash of the upstream API key the response belongs to
+	Gen     uint64    `json:"gen"`      // Invalidation generation the response was fetched in
+	Body    []byte    `json:"body"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+}
+
+// responseCache keeps service responses in memory and optionally on disk.
+// Concurrent requests for the same key share a single upstream call.
+type responseCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	ttls     map[string]time.Duration
+	staleFor time.Duration // How long an expired entry may be served while it is refreshed
+	dir      string        // Disk persistence directory, empty for memory only
+	group    singleflight.Group
+	inFlight sync.WaitGroup    // Background refreshes still calling N-Sight
+	gens     map[string]uint64 // Invalidation generation per key hash and service
+}
+
+// generationsFile keeps the invalidation generations next to the persisted
+// entries; it has no .json suffix so loadDisk does not take it for an entry
+const generationsFile = "generations"
+
+// genKey is the generations map key of a service of an API key
+func genKey(keyHash, service string) string {
+	return keyHash + "|" + service
+}
+
+// newResponseCache creates a cache and loads persisted entries from dir if set
+func newResponseCache(ttls map[string]time.Duration, staleFor time.Duration, dir string) (*responseCache, error) {
+	c := &responseCache{
+		entries:  make(map[string]*cacheEntry),
+		gens:     make(map[string]uint64),
+		ttls:     ttls,
+		staleFor: staleFor,
+		dir:      dir,
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+		}
+		c.loadDisk()
+	}
+	go c.sweep()
+	return c, nil
+}
+
+// cacheTTLs applies the configured lifetimes on top of the defaults
+func cacheTTLs(overrides config.TTLs) map[string]time.Duration {
+	ttls := make(map[string]time.Duration)
+	for service, ttl := range defaultCacheTTLs {
+		ttls[service] = ttl
+	}
+	for service, ttl := range overrides {
+		ttls[service] = ttl.D()
+	}
+	return ttls
+}
+
+// ttl returns the cache lifetime of a service
+func (c *responseCache) ttl(service string) time.Duration {
+	if ttl, ok := c.ttls[service]; ok {
+		return ttl
+	}
+	if ttl, ok := c.ttls["default"]; ok {
+		return ttl
+	}
+	return defaultCacheTTL
+}
+
+// hashAPIKey returns a short non-reversible identifier of an API key
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// cacheKey builds the key of a service call from its parameters, the instance,
+// the API key hash and the tenant, so tenants never share scoped responses
+func cacheKey(service string, params []string, query url.Values, instanceName, keyHash, tenant string) string {
+	names := append([]string(nil), params...)
+	sort.Strings(names)
+	parts := []string{instanceName, keyHash, tenant, service}
+	for _, name := range names {
+		if value := query.Get(name); value != "" {
+			parts = append(parts, name+"="+value)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Get returns the response for key, calling fetch on a miss. Expired entries
+// within the stale window are returned immediately and refreshed in the background.
+// It reports the cache status and the time left until the entry expires.
+func (c *responseCache) Get(key, service, keyHash string, bypass bool, fetch func() ([]byte, error)) (body []byte, status string, remaining time.Duration, err error) {
+	defer func() {
+		metrics.CacheRequests.WithLabelValues(service, status).Inc()
+	}()
+
+	ttl := c.ttl(service)
+	if ttl <= 0 {
+		body, err := fetch()
+		return body, cacheBypass, 0, err
+	}
+
+	if !bypass {
+		c.mu.Lock()
+		entry := c.entries[key]
+		c.mu.Unlock()
+		if entry != nil {
+			now := time.Now()
+			if now.Before(entry.Expires) {
+				return entry.Body, cacheHit, entry.Expires.Sub(now), nil
+			}
+			if now.Before(entry.Expires.Add(c.staleFor)) {
+				c.inFlight.Add(1)
+				go func() {
+					defer c.inFlight.Done()
+					if _, err := c.load(key, service, keyHash, ttl, fetch); err != nil {
+						log.Printf("Background refresh of %s failed: %v", service, err)
+					}
+				}()
+				return entry.Body, cacheStale, 0, nil
+			}
+		}
+	}
+
+	body, err = c.load(key, service, keyHash, ttl, fetch)
+	if err != nil {
+		return nil, cacheMiss, 0, err
+	}
+	return body, cacheMiss, ttl, nil
+}
+
+// load fetches and stores a response, sharing the call between concurrent callers.
+// Callers only share calls started in the same invalidation generation, so a
+// caller arriving after an invalidation never gets a response from before it.
+// A response fetched while the service was invalidated is returned to the
+// callers that were waiting for it but not stored.
+func (c *responseCache) load(key, service, keyHash string, ttl time.Duration, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	gen := c.gens[genKey(keyHash, service)]
+	c.mu.Unlock()
+
+	body, err, _ := c.group.Do(key+"#"+strconv.FormatUint(gen, 10), func() (interface{}, error) {
+		body, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		c.put(&cacheEntry{
+			Key:     key,
+			Service: service,
+			KeyHash: keyHash,
+			Gen:     gen,
+			Body:    body,
+			Stored:  now,
+			Expires: now.Add(ttl),
+		})
+		return body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body.([]byte), nil
+}
+
+// Drain waits for background refreshes to finish or ctx to be done
+func (c *responseCache) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// put stores an entry in memory and on disk unless its service was invalidated
+// since the entry was fetched
+func (c *responseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	if c.gens[genKey(entry.KeyHash, entry.Service)] != entry.Gen {
+		c.mu.Unlock()
+		return
+	}
+	c.entries[entry.Key] = entry
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Warning: Failed to encode cache entry for %s: %v", entry.Service, err)
+		return
+	}
+	if err := os.WriteFile(c.path(entry.Key), data, 0600); err != nil {
+		log.Printf("Warning: Failed to persist cache entry for %s: %v", entry.Service, err)
+	}
+}
+
+// Invalidate drops all entries of the given services that belong to keyHash
+func (c *responseCache) Invalidate(keyHash string, services []string) {
+	if len(services) == 0 {
+		return
+	}
+	affected := make(map[string]bool)
+	for _, service := range services {
+		affected[service] = true
+	}
+
+	c.mu.Lock()
+	for service := range affected {
+		c.gens[genKey(keyHash, service)]++
+	}
+	var removed []string
+	for key, entry := range c.entries {
+		if entry.KeyHash == keyHash && affected[entry.Service] {
+			delete(c.entries, key)
+			removed = append(removed, key)
+		}
+	}
+	c.mu.Unlock()
+
+	// Persisted before the files are removed, so a file written by a put that
+	// raced with this call is dropped by loadDisk on the next start
+	c.saveGenerations()
+	for _, key := range removed {
+		c.removeFile(key)
+	}
+	if len(removed) > 0 {
+		log.Printf("Invalidated %d cached responses of %s", len(removed), strings.Join(services, ", "))
+	}
+}
+
+// sweep periodically removes entries past their stale window
+func (c *responseCache) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		c.mu.Lock()
+		var removed []string
+		for key, entry := range c.entries {
+			if now.After(entry.Expires.Add(c.staleFor)) {
+				delete(c.entries, key)
+				removed = append(removed, key)
+			}
+		}
+		c.mu.Unlock()
+		for _, key := range removed {
+			c.removeFile(key)
+		}
+	}
+}
+
+// path returns the file used to persist a key
+func (c *responseCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// removeFile deletes the persisted copy of a key
+func (c *responseCache) removeFile(key string) {
+	if c.dir == "" {
+		return
+	}
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to remove cache file: %v", err)
+	}
+}
+
+// saveGenerations persists the invalidation generations
+func (c *responseCache) saveGenerations() {
+	if c.dir == "" {
+		return
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.gens)
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: Failed to encode cache generations: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, generationsFile), data, 0600); err != nil {
+		log.Printf("Warning: Failed to persist cache generations: %v", err)
+	}
+}
+
+// loadDisk restores persisted entries that are still within their stale window
+// and were not invalidated after they were fetched
+func (c *responseCache) loadDisk() {
+	if data, err := os.ReadFile(filepath.Join(c.dir, generationsFile)); err == nil {
+		if err := json.Unmarshal(data, &c.gens); err != nil {
+			log.Printf("Warning: Failed to decode cache generations: %v", err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		log.Printf("Warning: Failed to list cache directory %s: %v", c.dir, err)
+		return
+	}
+	now := time.Now()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil || now.After(entry.Expires.Add(c.staleFor)) ||
+			entry.Gen != c.gens[genKey(entry.KeyHash, entry.Service)] {
+			os.Remove(file)
+			continue
+		}
+		c.entries[entry.Key] = &entry
+	}
+	log.Printf("Loaded %d cached responses from %s", len(c.entries), c.dir)
+}
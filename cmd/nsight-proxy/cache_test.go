@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheInvalidateDuringFetch(t *testing.T) {
+	cache, err := newResponseCache(map[string]time.Duration{"list_failing_checks": time.Minute}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fetch started before the change is still running when it is invalidated
+	started := make(chan struct{})
+	release := make(chan struct{})
+	oldDone := make(chan []byte)
+	go func() {
+		body, _, _, _ := cache.Get("key", "list_failing_checks", "hash", false, func() ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("before"), nil
+		})
+		oldDone <- body
+	}()
+	<-started
+	cache.Invalidate("hash", []string{"list_failing_checks"})
+
+	// A caller arriving after the invalidation must not join the old fetch
+	newDone := make(chan struct{})
+	var body []byte
+	var status string
+	go func() {
+		defer close(newDone)
+		body, status, _, err = cache.Get("key", "list_failing_checks", "hash", false, func() ([]byte, error) {
+			return []byte("after"), nil
+		})
+	}()
+	select {
+	case <-newDone:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Get after Invalidate waited for the fetch started before it")
+	}
+	if err != nil || string(body) != "after" || status != cacheMiss {
+		t.Fatalf("Get after Invalidate = %q, %s, %v, want a fresh fetch", body, status, err)
+	}
+
+	close(release)
+	if body := <-oldDone; string(body) != "before" {
+		t.Errorf("caller of the old fetch got %q", body)
+	}
+	body, status, _, _ = cache.Get("key", "list_failing_checks", "hash", false, func() ([]byte, error) {
+		t.Error("cached response was not used")
+		return nil, nil
+	})
+	if string(body) != "after" || status != cacheHit {
+		t.Errorf("Get = %q, %s, want the response fetched after the invalidation", body, status)
+	}
+}
+
+func TestCacheDiskSkipsInvalidated(t *testing.T) {
+	dir := t.TempDir()
+	ttls := map[string]time.Duration{"list_clients": time.Minute}
+	cache, err := newResponseCache(ttls, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := cache.Get("clients", "list_clients", "hash", false, func() ([]byte, error) {
+		return []byte("before"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(cache.path("clients"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate("hash", []string{"list_clients"})
+
+	// A racing put wrote the old entry back after Invalidate removed it
+	if err := os.WriteFile(cache.path("clients"), stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newResponseCache(ttls, 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.entries) != 0 {
+		t.Errorf("restart revived %d invalidated entries", len(restarted.entries))
+	}
+	if _, err := os.Stat(filepath.Join(dir, generationsFile)); err != nil {
+		t.Errorf("generations were not persisted: %v", err)
+	}
+}
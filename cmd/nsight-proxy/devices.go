@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/overview"
+)
+
+// handleDeviceOverview serves /v1/devices/{id}/overview, merging the device's
+// listing, asset details, checks, patches, antivirus and backup state. The
+// device is given by ID, hostname, serial number, IP or MAC address. Parts
+// that fail are annotated in the errors member instead of failing the request.
+func (ps *ProxyServer) handleDeviceOverview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, X-Request-ID, Retry-After")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only GET method is supported")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request parameters")
+		return
+	}
+
+	tenant, apiKey, denied := ps.requestCredentials(r, r.Form)
+	if denied != "" {
+		writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, denied)
+		return
+	}
+	inst, denied := ps.requestInstance(r, tenant)
+	if denied != "" {
+		writeProblem(w, r, http.StatusForbidden, codeTenantDenied, denied)
+		return
+	}
+	opts, err := overviewOptions(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+		return
+	}
+
+	// Names are resolved in the instance's name index, limited to the tenant's clients
+	identifier := r.PathValue("id")
+	var keep func(inventory.ClientDetail) bool
+	if tenant != nil {
+		keep = func(c inventory.ClientDetail) bool { return tenant.allowsClient(c.ID) }
+	}
+	var location *inventory.DeviceLocation
+	deviceID, err := strconv.Atoi(identifier)
+	if err == nil {
+		location = inst.names.Locate(deviceID, keep)
+	} else {
+		location, err = inst.names.Device(inventory.DeviceQuery{Identifier: identifier, Client: r.Form.Get("client"), Site: r.Form.Get("site")}, keep)
+		var ambiguous *inventory.AmbiguousError
+		switch {
+		case errors.As(err, &ambiguous):
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		case errors.Is(err, inventory.ErrNoDevice):
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, err.Error())
+			return
+		case err != nil:
+			writeCallError(w, r, "device_overview", err)
+			return
+		}
+		deviceID = location.DeviceID
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("nsight.device_id", deviceID))
+
+	client, err := nsight.NewApiClientWithCredentials(apiKey, inst.Server)
+	if err != nil {
+		log.Printf("Error creating API client: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to create API client")
+		return
+	}
+	client = client.WithContext(r.Context())
+
+	// Devices missing from the tenant's part of the cache are checked upstream
+	if tenant != nil && location == nil {
+		ok, err := inst.ownership.ownsDevice(client, tenant, deviceID)
+		if err != nil {
+			log.Printf("Error resolving ownership for tenant %s: %v", tenant.Name, err)
+			writeCallError(w, r, "device_overview", err)
+			return
+		}
+		if !ok {
+			writeProblem(w, r, http.StatusForbidden, codeTenantDenied, "Access to this device is not allowed")
+			return
+		}
+	}
+
+	log.Printf("[%s] Building overview of device %d", requestID(r), deviceID)
+	device := overview.Build(client, deviceID, location, opts)
+	if err := device.Err(); err != nil {
+		writeCallError(w, r, "device_overview", err)
+		return
+	}
+	body, err := json.Marshal(device)
+	if err != nil {
+		log.Printf("Error marshaling overview of device %d: %v", deviceID, err)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to convert response to JSON")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeResult(w, r, "device_overview", body)
+}
+
+// overviewOptions reads the days and backups parameters
+func overviewOptions(r *http.Request) (overview.Options, error) {
+	var opts overview.Options
+	for _, param := range []struct {
+		name   string
+		target *int
+	}{
+		{"days", &opts.Days},
+		{"backups", &opts.BackupSessions},
+	} {
+		if value := r.Form.Get(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("%s must be a positive number", param.name)
+			}
+			*param.target = n
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/nsight"
+)
+
+// Timing of the failing check event stream
+const (
+	eventsHeartbeat    = 15 * time.Second
+	eventsWriteTimeout = 30 * time.Second // Per event, replacing the server's write timeout
+)
+
+// newCheckWatcher creates the poller behind /v1/events. It returns nil if key
+// yields no API key or the interval is 0.
+func newCheckWatcher(server string, key credentials.Provider, cfg config.Events) (*checkwatch.Watcher, error) {
+	interval, history := cfg.Interval.D(), cfg.History
+	if interval == 0 {
+		return nil, nil
+	}
+	if apiKey, err := key.Key(context.Background()); err != nil || apiKey == "" {
+		return nil, err
+	}
+
+	client, err := nsight.NewApiClientWithProvider(key, server)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Polling failing checks every %s for /v1/events", interval)
+	return checkwatch.New(client.FetchFailingChecks, interval, history), nil
+}
+
+// eventStream holds the parameters of one /v1/events subscriber
+type eventStream struct {
+	tenant *Tenant
+	client *nsight.ApiClient // Resolves device ownership for tenants
+	lastID uint64
+	resume bool            // lastID was given by the client
+	types  map[string]bool // Event types to send, all if empty
+}
+
+// openEventStream authorizes an events request and reads its resume and filter
+// parameters. It writes a problem and returns nil if the request is refused.
+func (ps *ProxyServer) openEventStream(w http.ResponseWriter, r *http.Request) *eventStream {
+	if ps.events == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, codeEventsDisabled, "Event stream is disabled, set NSIGHT_API_KEY and NSIGHT_EVENTS_INTERVAL")
+		return nil
+	}
+	// Same access as the cache: the proxy's own key polls the checks
+	tenant, inst, ok := ps.aggregateAccess(r)
+	if !ok {
+		writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid credentials")
+		return nil
+	}
+	if inst != ps.defaultInstance {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "Event stream is only available for the default instance")
+		return nil
+	}
+	stream := &eventStream{tenant: tenant}
+	if tenant != nil {
+		var client *nsight.ApiClient
+		var err error
+		if tenant.APIKey != "" {
+			client, err = nsight.NewApiClientWithCredentials(tenant.APIKey, inst.Server)
+		} else {
+			client, err = nsight.NewApiClientWithProvider(inst.key, inst.Server)
+		}
+		if err != nil {
+			log.Printf("Error creating API client: %v", err)
+			writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to create API client")
+			return nil
+		}
+		stream.client = client
+	}
+
+	// EventSource resends the last ID in a header, other clients use the parameter
+	query := r.URL.Query()
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("last_event_id")
+	}
+	if lastID != "" {
+		id, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, "last_event_id must be an event ID")
+			return nil
+		}
+		stream.lastID, stream.resume = id, true
+	}
+	if value := query.Get("types"); value != "" {
+		stream.types = make(map[string]bool)
+		for _, t := range strings.Split(value, ",") {
+			switch t = strings.TrimSpace(t); t {
+			case checkwatch.EventNew, checkwatch.EventResolved, checkwatch.EventChanged:
+				stream.types[t] = true
+			default:
+				writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("Unknown event type %q", t))
+				return nil
+			}
+		}
+	}
+	return stream
+}
+
+// run sends the backlog and then new events until ctx is done or the
+// subscription ends. Snapshots are always sent; heartbeat is called when
+// no event was sent for a while.
+func (s *eventStream) run(ctx context.Context, ps *ProxyServer, send func(checkwatch.Event) error, heartbeat func() error) error {
+	sub := ps.events.Subscribe(s.lastID, s.resume)
+	defer sub.Close()
+
+	deliver := func(event checkwatch.Event) error {
+		if event.Type != checkwatch.EventSnapshot && len(s.types) > 0 && !s.types[event.Type] {
+			return nil
+		}
+		event, ok, err := ps.scopeEvent(s.client, s.tenant, event)
+		if err != nil || !ok {
+			return err
+		}
+		return send(event)
+	}
+	for _, event := range sub.Backlog {
+		if err := deliver(event); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(eventsHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-sub.C():
+			if !ok {
+				// Dropped for falling behind or shutting down; the client resumes
+				return nil
+			}
+			if err := deliver(event); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// scopeEvent limits an event to the tenant's devices. It reports false if
+// the tenant may not see the event at all.
+func (ps *ProxyServer) scopeEvent(client *nsight.ApiClient, tenant *Tenant, event checkwatch.Event) (checkwatch.Event, bool, error) {
+	if tenant == nil {
+		return event, true, nil
+	}
+	if event.Type == checkwatch.EventSnapshot {
+		scoped, err := ps.defaultInstance.scopeResult(client, tenant, event.Checks)
+		if err != nil {
+			return event, false, err
+		}
+		event.Checks = scoped.([]nsight.Check)
+		return event, true, nil
+	}
+	ok, err := ps.defaultInstance.ownership.ownsDevice(client, tenant, event.Check.DeviceID)
+	return event, ok, err
+}
+
+// handleEvents streams changes of the failing checks as Server-Sent Events.
+// A new subscriber first gets a snapshot of all failing checks; a reconnecting
+// one gets the events it missed, or a snapshot if they are no longer kept.
+func (ps *ProxyServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only GET method is supported")
+		return
+	}
+	stream := ps.openEventStream(w, r)
+	if stream == nil {
+		return
+	}
+
+	// Each write gets its own deadline so the stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	write := func(text string) error {
+		rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := write(fmt.Sprintf("retry: %d\n\n", eventsHeartbeat.Milliseconds())); err != nil {
+		return
+	}
+
+	log.Printf("[%s] Event stream opened", requestID(r))
+	err := stream.run(r.Context(), ps, func(event checkwatch.Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data))
+	}, func() error {
+		return write(": heartbeat\n\n")
+	})
+	if err != nil {
+		log.Printf("[%s] Event stream ended: %v", requestID(r), err)
+		return
+	}
+	log.Printf("[%s] Event stream closed", requestID(r))
+}
+
+// handleEventsWebSocket streams the same events as JSON messages over a
+// WebSocket. Browsers cannot set headers there, so credentials and the last
+// event ID are passed as parameters.
+func (ps *ProxyServer) handleEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	stream := ps.openEventStream(w, r)
+	if stream == nil {
+		return
+	}
+
+	server := websocket.Server{
+		// Any origin may connect, as with the CORS headers of the other endpoints
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			// Incoming messages are ignored; reading detects a closed connection
+			go func() {
+				io.Copy(io.Discard, conn)
+				cancel()
+			}()
+
+			send := func(message any) error {
+				conn.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+				return websocket.JSON.Send(conn, message)
+			}
+			log.Printf("[%s] WebSocket event stream opened", requestID(r))
+			err := stream.run(ctx, ps, func(event checkwatch.Event) error {
+				return send(event)
+			}, func() error {
+				return send(map[string]any{"type": "heartbeat", "time": time.Now().UTC()})
+			})
+			if err != nil {
+				log.Printf("[%s] WebSocket event stream ended: %v", requestID(r), err)
+				return
+			}
+			log.Printf("[%s] WebSocket event stream closed", requestID(r))
+		},
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/nsight"
+)
+
+// Check statuses, from best to worst
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+const upstreamProbeTimeout = 10 * time.Second
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Detail    string    `json:"detail,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// healthReport is the body of /ready and /health?verbose=1
+type healthReport struct {
+	Status  string        `json:"status"`
+	Service string        `json:"service"`
+	Checks  []checkResult `json:"checks"`
+}
+
+// readiness runs the checks behind /ready. The upstream probes are API calls,
+// so their results are reused for interval to keep frequent probes off N-Sight.
+type readiness struct {
+	probes      []*upstreamProbe // One per instance
+	service     string           // Cheap service called by the upstream probes
+	interval    time.Duration    // How long an upstream probe result is reused
+	maxCacheAge time.Duration    // Age at which the fetchall cache counts as stale
+}
+
+// upstreamProbe checks that the N-Sight server of one instance answers
+type upstreamProbe struct {
+	name   string // Check name, "upstream" or "upstream:<instance>"
+	server string
+	key    credentials.Provider // Key for the probe, an empty key only checks DNS and TLS
+
+	mu   sync.Mutex
+	last *checkResult
+}
+
+// newReadiness creates the checks from the configured probe settings. Each
+// instance is probed with its own key; proxy.ready.api_key replaces the key
+// of the default instance.
+func newReadiness(instances []*proxyInstance, defaultInstance *proxyInstance, named bool, cfg config.Ready) (*readiness, error) {
+	rd := &readiness{
+		service:     cfg.Service,
+		interval:    cfg.Interval.D(),
+		maxCacheAge: cfg.MaxCacheAge.D(),
+	}
+	for _, inst := range instances {
+		probe := &upstreamProbe{name: "upstream", server: inst.Server, key: inst.key}
+		if named {
+			probe.name += ":" + inst.Name
+		}
+		if key := cfg.APIKey.Value(); key != "" && inst == defaultInstance {
+			probe.key = credentials.Static(key)
+		}
+		rd.probes = append(rd.probes, probe)
+	}
+	spec, ok := services[rd.service]
+	if !ok {
+		return nil, fmt.Errorf("invalid proxy.ready.service: unknown service %q", rd.service)
+	}
+	if spec.mutating {
+		return nil, fmt.Errorf("invalid proxy.ready.service: %s changes data", rd.service)
+	}
+	// The probe calls the service without parameters
+	if len(spec.params) > 0 {
+		return nil, fmt.Errorf("invalid proxy.ready.service: %s needs the parameters %s", rd.service, strings.Join(spec.params, ", "))
+	}
+	return rd, nil
+}
+
+// runCheck times a check and records its result
+func runCheck(name string, check func() (string, string)) checkResult {
+	start := time.Now()
+	status, detail := check()
+	return checkResult{
+		Name:      name,
+		Status:    status,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Detail:    detail,
+		CheckedAt: start.UTC(),
+	}
+}
+
+// report runs all checks concurrently
+func (ps *ProxyServer) report(ctx context.Context) healthReport {
+	var checks []func() checkResult
+	for _, probe := range ps.readiness.probes {
+		checks = append(checks, func() checkResult { return probe.check(ctx, ps.readiness.service, ps.readiness.interval) })
+	}
+	checks = append(checks,
+		func() checkResult { return runCheck("inventory_cache", ps.checkInventoryAge) },
+		func() checkResult { return runCheck("store", ps.checkStores) },
+		func() checkResult { return runCheck("rate_limiter", checkRateLimiter) },
+	)
+
+	rep := healthReport{Status: checkOK, Service: "nsight-proxy", Checks: make([]checkResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rep.Checks[i] = check()
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range rep.Checks {
+		if result.Status == checkFail || (result.Status == checkWarn && rep.Status == checkOK) {
+			rep.Status = result.Status
+		}
+	}
+	return rep
+}
+
+// check returns the last result of the probe, calling service again once it
+// is older than interval
+func (p *upstreamProbe) check(ctx context.Context, service string, interval time.Duration) checkResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last != nil && time.Since(p.last.CheckedAt) < interval {
+		return *p.last
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upstreamProbeTimeout)
+	defer cancel()
+	result := runCheck(p.name, func() (string, string) {
+		apiKey, err := p.key.Key(ctx)
+		if err != nil {
+			return checkFail, err.Error()
+		}
+		if apiKey == "" {
+			return p.dial(ctx)
+		}
+		client, err := nsight.NewApiClientWithProvider(p.key, p.server)
+		if err != nil {
+			return checkFail, err.Error()
+		}
+		if _, err := client.WithContext(ctx).FetchRaw(service, nil); err != nil {
+			return checkFail, err.Error()
+		}
+		return checkOK, fmt.Sprintf("%s on %s succeeded", service, p.server)
+	})
+	p.last = &result
+	return result
+}
+
+// dial resolves the server and completes a TLS handshake without calling the API
+func (p *upstreamProbe) dial(ctx context.Context) (string, string) {
+	host, port, err := net.SplitHostPort(p.server)
+	if err != nil {
+		host, port = p.server, "443"
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return checkFail, fmt.Sprintf("DNS lookup failed: %v", err)
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return checkFail, fmt.Sprintf("TLS handshake failed: %v", err)
+	}
+	conn.Close()
+	return checkOK, fmt.Sprintf("TLS handshake with %s succeeded, no probe API key configured", p.server)
+}
+
+// checkInventoryAge compares the age of the oldest fetchall cache with the
+// threshold. A stale cache only affects the aggregate endpoints, so it is a warning.
+func (ps *ProxyServer) checkInventoryAge() (string, string) {
+	_, updated := ps.inventorySnapshot(nil)
+	if updated.IsZero() {
+		return checkWarn, "no completed fetchall cache loaded"
+	}
+	age := time.Since(updated).Round(time.Second)
+	if age > ps.readiness.maxCacheAge {
+		return checkWarn, fmt.Sprintf("cache is %s old, threshold %s", age, ps.readiness.maxCacheAge)
+	}
+	return checkOK, fmt.Sprintf("cache is %s old", age)
+}
+
+// checkStores verifies that the response cache directory is writable and the
+// fetchall cache directory is readable
+func (ps *ProxyServer) checkStores() (string, string) {
+	if ps.cache.dir != "" {
+		probe, err := os.CreateTemp(ps.cache.dir, ".ready-*")
+		if err != nil {
+			return checkFail, fmt.Sprintf("response cache directory not writable: %v", err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	dirs := make([]string, 0, len(ps.instanceOrder))
+	for _, inst := range ps.instanceOrder {
+		if _, err := os.ReadDir(inst.CacheDir); err != nil && !os.IsNotExist(err) {
+			return checkFail, fmt.Sprintf("inventory directory not readable: %v", err)
+		}
+		dirs = append(dirs, filepath.Clean(inst.CacheDir))
+	}
+	if ps.cache.dir == "" {
+		return checkOK, "response cache in memory, " + strings.Join(dirs, ", ") + " readable"
+	}
+	return checkOK, filepath.Clean(ps.cache.dir) + " writable, " + strings.Join(dirs, ", ") + " readable"
+}
+
+// checkRateLimiter warns when calls are queueing for the shared limiter
+func checkRateLimiter() (string, string) {
+	state := nsight.CurrentRateLimit()
+	if !state.Limited {
+		return checkOK, "not limited"
+	}
+	detail := fmt.Sprintf("%.1f of %d calls available at %g per second", max(state.Tokens, 0), state.Burst, state.PerSecond)
+	if state.Tokens < 1 {
+		return checkWarn, "saturated, " + detail
+	}
+	return checkOK, detail
+}
+
+// readyCheck reports whether the proxy can serve requests. Failed checks
+// return 503 so load balancers stop routing to the instance.
+func (ps *ProxyServer) readyCheck(w http.ResponseWriter, r *http.Request) {
+	rep := ps.report(r.Context())
+	status := http.StatusOK
+	if rep.Status == checkFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthReport(w, status, rep)
+}
+
+// writeHealthReport writes a report as JSON
+func writeHealthReport(w http.ResponseWriter, status int, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rep)
+}
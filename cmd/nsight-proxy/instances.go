@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/instance"
+	"nsight-proxy/internal/resolver"
+)
+
+// proxyInstance is the proxy's state for one N-Sight instance
+type proxyInstance struct {
+	*instance.Instance
+	key       credentials.Provider // Key that grants full access to the fetchall cache
+	inventory *inventoryStore      // Nested tree from the fetchall cache
+	names     *resolver.Resolver   // Device names, rebuilt with the instance's own key
+	ownership *ownershipIndex
+}
+
+// newProxyInstance loads the instance's fetchall cache and keeps it current
+func newProxyInstance(inst *instance.Instance, names config.Resolver) (*proxyInstance, error) {
+	key, err := inst.Provider()
+	if err != nil {
+		return nil, err
+	}
+	pi := &proxyInstance{Instance: inst, key: key, ownership: newOwnershipIndex(inst.CacheDir)}
+	pi.names = resolver.New(inst.CacheDir, names.TTL.D(), inst.Client)
+
+	// Aggregated data from the fetchall cache, reloaded when fetchall completes
+	pi.inventory = newInventoryStore(inst.CacheDir, pi.ownership.reset)
+	go pi.inventory.watch(inventoryReloadInterval)
+	return pi, nil
+}
+
+// isOwnKey reports whether apiKey is the instance's current key. The key is
+// read from its source each time, so a rotated key is accepted at once.
+func (pi *proxyInstance) isOwnKey(ctx context.Context, apiKey string) bool {
+	own, err := pi.key.Key(ctx)
+	if err != nil {
+		log.Printf("Error reading API key of instance %s: %v", pi.Name, err)
+		return false
+	}
+	return own != "" && apiKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(own)) == 1
+}
+
+// instanceKey is the context key of the instance named in the request path
+type instanceKey struct{}
+
+// outerURLKey is the context key of the request URL before withInstance
+// removed the instance prefix
+type outerURLKey struct{}
+
+// withInstance serves /instances/{name}/<path> with the handler of /<path>
+// for the named instance. The name "all" is passed on for the aggregate
+// endpoints, which merge every instance.
+func (ps *ProxyServer) withInstance(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("instance")
+		if _, ok := ps.instances[name]; !ok && name != instance.All {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("Unknown instance %q", name))
+			return
+		}
+		rest := strings.TrimPrefix(r.URL.Path, "/instances/"+name)
+		if name == instance.All && !strings.HasPrefix(rest, "/v1/aggregate/") {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, "Instance all is only available for /v1/aggregate endpoints")
+			return
+		}
+		if _, nested := r.Context().Value(instanceKey{}).(string); nested {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, "Instance prefixes cannot be nested")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), instanceKey{}, name)
+		inner := r.Clone(context.WithValue(ctx, outerURLKey{}, r.URL))
+		inner.URL.Path = rest
+		inner.URL.RawPath = ""
+		next.ServeHTTP(w, inner)
+	}
+}
+
+// outerURL returns the URL the client requested, including an instance prefix
+func outerURL(r *http.Request) *url.URL {
+	if u, ok := r.Context().Value(outerURLKey{}).(*url.URL); ok {
+		return u
+	}
+	return r.URL
+}
+
+// pathInstance returns the instance name from the request path, if any
+func pathInstance(r *http.Request) string {
+	name, _ := r.Context().Value(instanceKey{}).(string)
+	return name
+}
+
+// requestInstance returns the instance a request is for: the one in the path,
+// otherwise the tenant's, otherwise the default instance. It returns a reason
+// instead if the tenant is bound to another instance.
+func (ps *ProxyServer) requestInstance(r *http.Request, tenant *Tenant) (*proxyInstance, string) {
+	name := pathInstance(r)
+	if tenant != nil {
+		own := ps.tenantInstance(tenant)
+		if name != "" && name != own.Name {
+			return nil, fmt.Sprintf("Access token is not valid for instance %s", name)
+		}
+		return own, ""
+	}
+	if name == "" {
+		return ps.defaultInstance, ""
+	}
+	return ps.instances[name], ""
+}
+
+// tenantInstance returns the instance a tenant is bound to
+func (ps *ProxyServer) tenantInstance(tenant *Tenant) *proxyInstance {
+	if tenant.Instance == "" {
+		return ps.defaultInstance
+	}
+	return ps.instances[tenant.Instance]
+}
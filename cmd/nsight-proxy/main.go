@@ -1,36 +1,128 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"nsight-proxy/internal/audit"
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/instance"
 	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/tracing"
+	"nsight-proxy/internal/webhook"
 )
 
 // ProxyServer handles API requests
 type ProxyServer struct {
-	server string
+	instances       map[string]*proxyInstance // N-Sight servers and accounts by name
+	instanceOrder   []*proxyInstance
+	defaultInstance *proxyInstance     // Used without an instance prefix or tenant instance
+	namedInstances  bool               // Instances come from an instances file and are named in aggregates
+	tenants         map[string]*Tenant // Access tokens scoped to specific clients
+	cache           *responseCache
+	readiness       *readiness          // Checks behind /ready
+	events          *checkwatch.Watcher // Failing check changes of the default instance, nil if disabled
+	webhooks        *webhook.Dispatcher // Delivers the same changes to webhooks, nil if not configured
 }
 
 // NewProxyServer creates a new proxy server instance
-func NewProxyServer() (*ProxyServer, error) {
+func NewProxyServer(cfg *config.Config) (*ProxyServer, error) {
 	// Only require server configuration, API key will come from requests
-	err := godotenv.Load()
+	nsight.Configure(cfg.Client)
+	audit.Configure(cfg.Audit)
+
+	// One or more N-Sight servers and accounts, each with its own fetchall cache
+	instances, err := instance.Load(cfg)
 	if err != nil {
-		log.Println("Warning: Could not load .env file:", err)
+		return nil, err
+	}
+	if instances.Default().Server == "" {
+		return nil, fmt.Errorf("no N-Sight server, set server in the config file or NSIGHT_SERVER")
+	}
+
+	ps := &ProxyServer{instances: make(map[string]*proxyInstance)}
+	for _, inst := range instances.List() {
+		pi, err := newProxyInstance(inst, cfg.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		ps.instances[inst.Name] = pi
+		ps.instanceOrder = append(ps.instanceOrder, pi)
+	}
+	ps.defaultInstance = ps.instances[instances.Default().Name]
+	ps.namedInstances = instances.Configured()
+	if ps.namedInstances {
+		log.Printf("Loaded %d N-Sight instances, default %s", len(ps.instanceOrder), ps.defaultInstance.Name)
+	}
+	server := ps.defaultInstance.Server
+
+	// Response cache with per-service TTLs, optionally persisted to disk
+	ps.cache, err = newResponseCache(cacheTTLs(cfg.Proxy.Cache.TTL), cfg.Proxy.Cache.Stale.D(), cfg.Proxy.Cache.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mutating calls are refused without a writable audit log, so report it at startup
+	if !nsight.ReadOnly() {
+		if _, err := audit.Default(); err != nil {
+			log.Printf("Warning: Services that change data will be refused: %v", err)
+		}
 	}
 
-	server := os.Getenv("NSIGHT_SERVER")
-	if server == "" {
-		return nil, fmt.Errorf("NSIGHT_SERVER must be set in .env file or environment variables")
+	// Upstream probes of every instance and thresholds for /ready
+	ps.readiness, err = newReadiness(ps.instanceOrder, ps.defaultInstance, ps.namedInstances, cfg.Proxy.Ready)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing check changes pushed over /v1/events
+	ps.events, err = newCheckWatcher(server, ps.defaultInstance.key, cfg.Proxy.Events)
+	if err != nil {
+		return nil, err
+	}
+	if ps.events != nil {
+		go ps.events.Run()
+	}
+	ps.webhooks, err = ps.newWebhookDispatcher(cfg.Proxy.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if ps.webhooks != nil {
+		ps.webhooks.Start()
+	}
+
+	// Optional tenant tokens for self-service access limited to selected clients
+	if tenantsFile := cfg.Proxy.TenantsFile; tenantsFile != "" {
+		tenants, err := loadTenants(tenantsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, tenant := range tenants {
+			if _, ok := ps.instances[tenant.Instance]; tenant.Instance != "" && !ok {
+				return nil, fmt.Errorf("tenant %s uses unknown instance %q", tenant.Name, tenant.Instance)
+			}
+		}
+		ps.tenants = tenants
+		log.Printf("Loaded %d tenant tokens from %s", len(tenants), tenantsFile)
 	}
-	
-	return &ProxyServer{server: server}, nil
+
+	return ps, nil
 }
 
 // handleAPI routes API requests based on service parameter
@@ -38,7 +130,8 @@ func (ps *ProxyServer) handleAPI(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cache-Control, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Cache, X-Total-Count, X-Next-Cursor, Link, Content-Disposition, X-Request-ID, Retry-After")
 	w.Header().Set("Content-Type", "application/json")
 
 	// Handle preflight requests
@@ -46,260 +139,262 @@ func (ps *ProxyServer) handleAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Only accept GET requests
-	if r.Method != "GET" {
-		http.Error(w, `{"error": "Only GET method is supported"}`, http.StatusMethodNotAllowed)
+	// Read-only services use GET, services that change data use POST
+	if r.Method != "GET" && r.Method != "POST" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only GET and POST methods are supported")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request parameters")
 		return
 	}
+	params := r.Form
 
 	// Extract required parameters
-	service := r.URL.Query().Get("service")
+	service := params.Get("service")
 	if service == "" {
-		http.Error(w, `{"error": "Missing service parameter"}`, http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, "Missing service parameter")
 		return
 	}
 
-	apiKey := r.URL.Query().Get("apikey")
-	if apiKey == "" {
-		http.Error(w, `{"error": "Missing apikey parameter"}`, http.StatusBadRequest)
+	spec, ok := services[service]
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, "Unsupported service: "+service)
 		return
 	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("nsight.service", service))
+	if spec.mutating && r.Method != "POST" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, fmt.Sprintf("Service %s changes data and requires POST", service))
+		return
+	}
+	if spec.mutating && nsight.ReadOnly() {
+		writeProblem(w, r, http.StatusForbidden, codeReadOnly, fmt.Sprintf("Service %s changes data and the proxy is read-only", service))
+		return
+	}
+	if spec.mutating {
+		if _, err := audit.Default(); err != nil {
+			log.Printf("Refusing %s without an audit log: %v", service, err)
+			writeProblem(w, r, http.StatusServiceUnavailable, codeAuditUnavailable, fmt.Sprintf("Service %s changes data and the audit log is not available", service))
+			return
+		}
+	}
 
-	log.Printf("Handling request for service: %s", service)
+	tenant, apiKey, denied := ps.requestCredentials(r, params)
+	if denied != "" {
+		writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, denied)
+		return
+	}
+	inst, denied := ps.requestInstance(r, tenant)
+	if denied != "" {
+		writeProblem(w, r, http.StatusForbidden, codeTenantDenied, denied)
+		return
+	}
+
+	log.Printf("[%s] Handling request for service: %s", requestID(r), service)
 
 	// Create API client with provided credentials
-	client, err := nsight.NewApiClientWithCredentials(apiKey, ps.server)
+	client, err := nsight.NewApiClientWithCredentials(apiKey, inst.Server)
 	if err != nil {
 		log.Printf("Error creating API client: %v", err)
-		http.Error(w, `{"error": "Failed to create API client"}`, http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to create API client")
 		return
 	}
+	// Upstream calls are traced below the request but not cancelled with it,
+	// since cached calls are shared with other requests
+	client = client.WithContext(context.WithoutCancel(r.Context()))
 
-	// Route to appropriate handler based on service
-	var result interface{}
-
-	switch service {
-	case "list_clients":
-		result, err = client.FetchClients()
-	
-	case "list_sites":
-		clientID, parseErr := strconv.Atoi(r.URL.Query().Get("clientid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid clientid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchSites(clientID)
-	
-	case "list_servers":
-		siteID, parseErr := strconv.Atoi(r.URL.Query().Get("siteid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid siteid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchServers(siteID)
-	
-	case "list_workstations":
-		siteID, parseErr := strconv.Atoi(r.URL.Query().Get("siteid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid siteid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchWorkstations(siteID)
-	
-	case "list_devices":
-		siteID, parseErr := strconv.Atoi(r.URL.Query().Get("siteid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid siteid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchDevicesBySite(siteID)
-	
-	case "list_devices_at_client":
-		clientID, parseErr := strconv.Atoi(r.URL.Query().Get("clientid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid clientid parameter"}`, http.StatusBadRequest)
+	// Reject requests for clients, sites or devices outside the tenant's scope
+	tenantName := ""
+	if tenant != nil {
+		tenantName = tenant.Name
+		allowed, reason, authErr := inst.authorizeTenant(client, tenant, service, params)
+		if authErr != nil {
+			log.Printf("Error resolving ownership for tenant %s: %v", tenant.Name, authErr)
+			writeCallError(w, r, service, authErr)
 			return
 		}
-		result, err = client.FetchDevices(clientID)
-	
-	case "list_device_asset_details":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
+		if !allowed {
+			log.Printf("Tenant %s denied for service %s: %s", tenant.Name, service, reason)
+			writeProblem(w, r, http.StatusForbidden, codeTenantDenied, reason)
 			return
 		}
-		result, err = client.FetchDeviceAssetDetails(deviceID)
-	
-	case "list_failing_checks":
-		result, err = client.FetchFailingChecks()
-	
-	case "list_checks":
-		deviceIDStr := r.URL.Query().Get("deviceid")
-		siteIDStr := r.URL.Query().Get("siteid")
-		
-		if deviceIDStr != "" {
-			deviceID, parseErr := strconv.Atoi(deviceIDStr)
-			if parseErr != nil {
-				http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
-				return
-			}
-			result, err = client.FetchChecks(deviceID)
-		} else if siteIDStr != "" {
-			siteID, parseErr := strconv.Atoi(siteIDStr)
-			if parseErr != nil {
-				http.Error(w, `{"error": "Invalid siteid parameter"}`, http.StatusBadRequest)
-				return
-			}
-			result, err = client.FetchChecksBySite(siteID)
-		} else {
-			http.Error(w, `{"error": "Missing deviceid or siteid parameter"}`, http.StatusBadRequest)
-			return
-		}
-	
-	case "list_device_monitoring_details":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchDeviceMonitoringDetails(deviceID)
-	
-	case "list_agentless_assets":
-		siteID, parseErr := strconv.Atoi(r.URL.Query().Get("siteid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid siteid parameter"}`, http.StatusBadRequest)
-			return
-		}
-		result, err = client.FetchAgentlessAssets(siteID)
-	
-	case "list_hardware":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
+	}
+
+	keyHash := hashAPIKey(apiKey)
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, err.Error())
+		return
+	}
+	if format == formatXML {
+		if spec.mutating {
+			writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, "Raw XML is only available for read services")
 			return
 		}
-		result, err = client.FetchHardware(deviceID)
-	
-	case "list_software":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
+		if tenant != nil && tenantFilteredServices[service] {
+			writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, fmt.Sprintf("Raw XML of %s is not available to tenant tokens", service))
 			return
 		}
-		result, err = client.FetchSoftware(deviceID)
-	
-	case "list_license_groups":
-		result, err = client.FetchLicenseGroups()
-	
-	case "list_patches":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
-			return
+	}
+
+	// Mutating calls go straight upstream and invalidate the responses they affect
+	if spec.mutating {
+		actor := audit.Actor{Tool: "nsight-proxy", RequestID: requestID(r), Remote: r.RemoteAddr}
+		if tenant != nil {
+			actor.User = tenant.Name
+			actor.Tenant = tenant.Name
+			actor.TokenHash = audit.Hash(requestToken(r))
 		}
-		result, err = client.FetchPatches(deviceID)
-	
-	case "list_antivirus_products":
-		result, err = client.FetchAntivirusProducts()
-	
-	case "list_antivirus_definitions":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
+		result, err := spec.call(client.WithActor(actor), params)
+		if err != nil {
+			writeCallError(w, r, service, err)
 			return
 		}
-		result, err = client.FetchAntivirusDefinitions(deviceID)
-	
-	case "list_quarantine":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
+		ps.cache.Invalidate(keyHash, spec.invalidates)
+		jsonData, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error marshaling JSON for service %s: %v", service, err)
+			writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to convert response to JSON")
 			return
 		}
-		result, err = client.FetchQuarantineList(deviceID)
-	
-	case "list_performance_history":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
-			return
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(jsonData)
+		return
+	}
+
+	// Serve from the response cache, calling N-Sight on a miss
+	key := cacheKey(service, spec.params, params, inst.Name, keyHash, tenantName)
+	bypass := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+	cacheCtx, cacheSpan := startSpan(r.Context(), "proxy.cache", attribute.String("nsight.service", service))
+	client = client.WithContext(context.WithoutCancel(cacheCtx))
+	fetch := func() ([]byte, error) {
+		result, err := spec.call(client, params)
+		if err != nil {
+			return nil, err
 		}
-		checkID, parseErr := strconv.Atoi(r.URL.Query().Get("checkid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid checkid parameter"}`, http.StatusBadRequest)
-			return
+		// Limit aggregate results to the tenant's clients and devices
+		if tenant != nil {
+			result, err = inst.scopeResult(client, tenant, result)
+			if err != nil {
+				return nil, fmt.Errorf("applying tenant scope: %w", err)
+			}
 		}
-		startDate := r.URL.Query().Get("startdate")
-		endDate := r.URL.Query().Get("enddate")
-		result, err = client.FetchPerformanceHistory(deviceID, checkID, startDate, endDate)
-	
-	case "list_drive_space_history":
-		deviceID, parseErr := strconv.Atoi(r.URL.Query().Get("deviceid"))
-		if parseErr != nil {
-			http.Error(w, `{"error": "Invalid deviceid parameter"}`, http.StatusBadRequest)
-			return
+		_, span := startSpan(cacheCtx, "proxy.marshalJSON")
+		defer span.End()
+		body, err := json.Marshal(result)
+		span.SetAttributes(attribute.Int("response.bytes", len(body)))
+		return body, err
+	}
+	if format == formatXML {
+		// Raw responses are cached next to the decoded ones
+		key += "|xml"
+		fetch = func() ([]byte, error) {
+			return client.FetchRaw(service, upstreamParams(spec, params))
 		}
-		startDate := r.URL.Query().Get("startdate")
-		endDate := r.URL.Query().Get("enddate")
-		result, err = client.FetchDriveSpaceHistory(deviceID, startDate, endDate)
-	
-	case "list_templates":
-		result, err = client.FetchTemplates()
-	
-	default:
-		http.Error(w, fmt.Sprintf(`{"error": "Unsupported service: %s"}`, service), http.StatusBadRequest)
-		return
 	}
-
-	// Handle any error from the API call
+	body, cacheStatus, remaining, err := ps.cache.Get(key, service, keyHash, bypass, fetch)
+	cacheSpan.SetAttributes(attribute.String("cache.result", cacheStatus))
 	if err != nil {
-		log.Printf("Error calling API service %s: %v", service, err)
-		http.Error(w, fmt.Sprintf(`{"error": "API call failed: %s"}`, err.Error()), http.StatusInternalServerError)
+		cacheSpan.SetStatus(codes.Error, err.Error())
+		cacheSpan.End()
+		writeCallError(w, r, service, err)
 		return
 	}
+	cacheSpan.End()
 
-	// Convert result to JSON
-	jsonData, err := json.Marshal(result)
-	if err != nil {
-		log.Printf("Error marshaling JSON for service %s: %v", service, err)
-		http.Error(w, `{"error": "Failed to convert response to JSON"}`, http.StatusInternalServerError)
-		return
+	w.Header().Set("X-Cache", cacheStatus)
+	switch cacheStatus {
+	case cacheHit, cacheMiss:
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(remaining.Seconds())))
+	case cacheStale:
+		w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	default:
+		w.Header().Set("Cache-Control", "no-store")
 	}
 
-	// Write JSON response
-	w.Write(jsonData)
+	if format == formatXML {
+		writeRawXML(w, r, body)
+		return
+	}
+	// Write the response with the requested filtering, sorting, paging and format
+	writeResult(w, r, service, body)
 }
 
-// healthCheck provides a simple health check endpoint
+// healthCheck provides a simple liveness endpoint. With verbose=1 it also
+// reports the readiness checks, still with status 200.
 func (ps *ProxyServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		writeHealthReport(w, http.StatusOK, ps.report(r.Context()))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "ok", "service": "nsight-proxy"}`))
 }
 
+// routes registers the proxy's endpoints on a dedicated mux
+func (ps *ProxyServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", observe("api", "handleAPI", ps.handleAPI))
+	mux.HandleFunc("/v1/aggregate/inventory", observe("aggregate_inventory", "handleAggregate inventory", ps.handleAggregate("inventory")))
+	mux.HandleFunc("/v1/aggregate/software", observe("aggregate_software", "handleAggregate software", ps.handleAggregate("software")))
+	mux.HandleFunc("/v1/aggregate/hardware", observe("aggregate_hardware", "handleAggregate hardware", ps.handleAggregate("hardware")))
+	mux.HandleFunc("/v1/devices/{id}/overview", observe("device_overview", "handleDeviceOverview", ps.handleDeviceOverview))
+	mux.HandleFunc("/v1/batch", observe("batch", "handleBatch", ps.handleBatch))
+	// Streams are long-lived, so they get metrics but no request span
+	mux.HandleFunc("/v1/events", instrument("events", ps.handleEvents))
+	mux.HandleFunc("/v1/events/ws", instrument("events_ws", ps.handleEventsWebSocket))
+	mux.HandleFunc("/v1/webhooks/test", observe("webhook_test", "handleWebhookTest", ps.handleWebhookTest))
+	// The same endpoints for a named instance, or all instances for aggregates
+	mux.Handle("/instances/{instance}/", ps.withInstance(mux))
+	mux.HandleFunc("/health", ps.healthCheck)
+	mux.HandleFunc("/ready", ps.readyCheck)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"service": "N-Sight JSON Proxy", "version": "1.0", "endpoints": ["/api/", "/v1/aggregate/inventory", "/v1/aggregate/software", "/v1/aggregate/hardware", "/v1/devices/{id}/overview", "/v1/batch", "/v1/events", "/v1/events/ws", "/v1/webhooks/test", "/instances/{name}/...", "/health", "/ready", "/metrics"]}`))
+	})
+	return mux
+}
+
 func main() {
 	log.Println("Starting N-Sight JSON Proxy Server...")
 
+	// Defaults, then the config file, the environment (including .env) and flags
+	flags := config.RegisterFlags(flag.CommandLine, config.ScopeProxy)
+	flag.Parse()
+	cfg, err := config.Load(flags)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if cfg.File != "" {
+		log.Printf("Loaded configuration from %s", cfg.File)
+	}
+
 	// Create proxy server instance
-	proxy, err := NewProxyServer()
+	proxy, err := NewProxyServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize proxy server: %v", err)
 	}
 
-	// Set up routes
-	http.HandleFunc("/api/", proxy.handleAPI)
-	http.HandleFunc("/health", proxy.healthCheck)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"service": "N-Sight JSON Proxy", "version": "1.0", "endpoints": ["/api/", "/health"]}`))
-	})
+	// Trace context is always propagated, spans are exported if OTLP is configured
+	shutdownTracing, err := tracing.Setup(context.Background(), "nsight-proxy")
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
 
-	// Start server on port 80
-	log.Println("Server starting on port 80...")
-	log.Println("API endpoint: http://localhost/api/?service=<service_name>&<parameters>")
-	log.Println("Health check: http://localhost/health")
-	
-	if err := http.ListenAndServe(":80", nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	// Serve until SIGINT or SIGTERM, then drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := proxy.serve(ctx, cfg.Proxy, withRequestID(proxy.routes()))
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Warning: Failed to flush traces: %v", err)
+	}
+	if serveErr != nil {
+		log.Fatalf("Server failed: %v", serveErr)
 	}
-}
\ No newline at end of file
+}
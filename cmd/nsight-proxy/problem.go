@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// problem is an RFC 7807 error body. Code is a stable machine-readable reason.
+type problem struct {
+	Type            string `json:"type"`
+	Title           string `json:"title"`
+	Status          int    `json:"status"`
+	Detail          string `json:"detail,omitempty"`
+	Instance        string `json:"instance,omitempty"`
+	Code            string `json:"code,omitempty"`
+	RequestID       string `json:"request_id,omitempty"`
+	Service         string `json:"service,omitempty"`
+	UpstreamStatus  int    `json:"upstream_status,omitempty"`
+	UpstreamCode    string `json:"upstream_code,omitempty"`
+	UpstreamMessage string `json:"upstream_message,omitempty"`
+}
+
+// Problem codes of errors not caused by N-Sight
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidParam     = "invalid_parameter"
+	codeUnauthorized     = "unauthorized"
+	codeTenantDenied     = "tenant_denied"
+	codeNotFound         = "not_found"
+	codeNotAcceptable    = "not_acceptable"
+	codeMethod           = "method_not_allowed"
+	codeReadOnly         = "read_only"
+	codeCacheMissing     = "cache_unavailable"
+	codeAuditUnavailable = "audit_unavailable"
+	codeEventsDisabled   = "events_disabled"
+	codeWebhooksDisabled = "webhooks_disabled"
+	codeInternal         = "internal_error"
+	codeUpstreamUnknown  = "upstream_error"
+)
+
+// upstreamProblems map the kinds of failed N-Sight calls to statuses and codes
+var upstreamProblems = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{nsight.ErrUnauthorized, http.StatusUnauthorized, "invalid_api_key"},
+	{nsight.ErrForbidden, http.StatusForbidden, "api_key_forbidden"},
+	{nsight.ErrNotFound, http.StatusNotFound, codeNotFound},
+	{nsight.ErrThrottled, http.StatusTooManyRequests, "throttled"},
+	{nsight.ErrTimeout, http.StatusGatewayTimeout, "upstream_timeout"},
+	{nsight.ErrUnavailable, http.StatusBadGateway, "upstream_unavailable"},
+	{nsight.ErrDecode, http.StatusBadGateway, "upstream_invalid_response"},
+	{nsight.ErrUpstream, http.StatusBadGateway, codeUpstreamUnknown},
+}
+
+// writeProblem writes an application/problem+json error response
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	p := &problem{Status: status, Code: code, Detail: detail}
+	if r.Form != nil {
+		p.Service = r.Form.Get("service")
+	}
+	sendProblem(w, r, p)
+}
+
+// sendProblem fills in the common members and writes the body
+func sendProblem(w http.ResponseWriter, r *http.Request, p *problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	if name := pathInstance(r); name != "" {
+		p.Instance = "/instances/" + name + r.URL.Path
+	}
+	p.RequestID = requestID(r)
+
+	header := w.Header()
+	header.Del("Content-Disposition")
+	header.Set("Content-Type", "application/problem+json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(p)
+}
+
+// writeCallError reports a failed service call. Bad parameters are client
+// errors, N-Sight failures are mapped by kind and anything else is internal.
+func writeCallError(w http.ResponseWriter, r *http.Request, service string, err error) {
+	var pErr *paramError
+	if errors.As(err, &pErr) {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, pErr.Error())
+		return
+	}
+	log.Printf("[%s] Error calling API service %s: %v", requestID(r), service, err)
+
+	p := &problem{Status: http.StatusInternalServerError, Code: codeInternal, Service: service}
+	for _, entry := range upstreamProblems {
+		if errors.Is(err, entry.kind) {
+			p.Status, p.Code = entry.status, entry.code
+			break
+		}
+	}
+	p.Detail = http.StatusText(p.Status)
+
+	var apiErr *nsight.APIError
+	if errors.As(err, &apiErr) {
+		p.Detail = "N-Sight " + apiErr.Kind.Error()
+		p.UpstreamStatus = apiErr.StatusCode
+		p.UpstreamCode = apiErr.Code
+		p.UpstreamMessage = apiErr.Message
+		if apiErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+		}
+	} else if errors.Is(err, nsight.ErrDecode) {
+		p.Detail = "N-Sight " + nsight.ErrDecode.Error()
+	}
+	sendProblem(w, r, p)
+}
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// validRequestID limits client supplied request IDs to safe characters
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID assigns every request an ID, reusing a valid X-Request-ID
+// header, and returns it in the X-Request-ID response header
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the ID assigned by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
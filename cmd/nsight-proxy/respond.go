@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"nsight-proxy/internal/export"
+	"nsight-proxy/internal/listquery"
+	"nsight-proxy/internal/query"
+)
+
+// queryTimeout bounds the evaluation of a q expression
+const queryTimeout = 5 * time.Second
+
+// querySlots limits how many q expressions are evaluated at once, since a
+// runaway expression can use a lot of memory until its timeout
+var querySlots = make(chan struct{}, 2)
+
+// errNotAList is returned when list options are used on a single object
+var errNotAList = errors.New("filter, sort and pagination apply only to list results")
+
+// Response formats selected with the format parameter or the Accept header
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	formatXLSX   = "xlsx"
+	formatXML    = "xml" // Raw upstream response, /api/ only
+)
+
+// formatMediaTypes maps Accept media types to response formats
+var formatMediaTypes = map[string]string{
+	"application/json":     formatJSON,
+	"application/*":        formatJSON,
+	"*/*":                  formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": formatXLSX,
+	"application/xml": formatXML,
+	"text/xml":        formatXML,
+}
+
+// formatContentTypes are the Content-Type headers of the formats
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+	formatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	formatXML:    "application/xml",
+}
+
+// negotiateFormat picks the response format. The format parameter wins over
+// the Accept header; among Accept entries the highest quality is used.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.Form.Get("format")); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format %q, expected one of json, csv, ndjson, xlsx, xml", format)
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, nil
+	}
+	best, bestQuality := "", -1.0
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(entry, ";")
+		format, ok := formatMediaTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > bestQuality && quality > 0 {
+			best, bestQuality = format, quality
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("none of the accepted media types is supported, use application/json, text/csv, application/x-ndjson, xlsx or application/xml")
+	}
+	return best, nil
+}
+
+// writeResult writes a JSON body in the negotiated format, applying the
+// filter, sort, limit/offset, cursor and fields options of the request and
+// then its q expression. List results are the top-level array or the items
+// array of an aggregate response. name is used for download file names.
+func writeResult(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	_, span := startSpan(r.Context(), "proxy.writeResult", attribute.String("result.name", name))
+	defer span.End()
+
+	r.ParseForm()
+	format, err := negotiateFormat(r)
+	span.SetAttributes(attribute.String("result.format", format))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, err.Error())
+		return
+	}
+	if format == formatXML {
+		writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, "Raw XML is only available for /api/ services")
+		return
+	}
+	opts, err := listquery.Parse(r.Form)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+		return
+	}
+	if !opts.Empty() {
+		body, err = applyListOptions(w.Header(), outerURL(r), body, opts)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		}
+	}
+	if expr := r.Form.Get("q"); expr != "" {
+		body, err = applyQuery(r.Context(), expr, body)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	switch format {
+	case formatJSON:
+		w.Write(body)
+
+	case formatNDJSON:
+		flusher, _ := w.(http.Flusher)
+		err = export.StreamNDJSON(w, body, func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if err != nil {
+			log.Printf("Error streaming %s as NDJSON: %v", name, err)
+		}
+
+	case formatCSV, formatXLSX:
+		table, err := export.Flatten(body)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		table.Reorder(opts.Fields)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+		var buf bytes.Buffer
+		if format == formatCSV {
+			err = export.WriteCSV(&buf, table, ',')
+		} else {
+			err = export.WriteXLSX(&buf, table, name)
+		}
+		if err != nil {
+			log.Printf("Error converting %s to %s: %v", name, format, err)
+			writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Failed to convert response to "+strings.ToUpper(format))
+			return
+		}
+		w.Write(buf.Bytes())
+	}
+}
+
+// writeRawXML passes an upstream XML response through unchanged. List options
+// need a decoded result and are rejected.
+func writeRawXML(w http.ResponseWriter, r *http.Request, body []byte) {
+	opts, err := listquery.Parse(r.Form)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+		return
+	}
+	if !opts.Empty() || r.Form.Get("q") != "" {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, "filter, sort, pagination, fields and q are not available for raw XML")
+		return
+	}
+	// The XML declaration names the upstream charset
+	w.Header().Set("Content-Type", formatContentTypes[formatXML])
+	w.Write(body)
+}
+
+// applyQuery evaluates the jq expression of the q parameter over body. A
+// single emitted value is the result, several are returned as an array.
+func applyQuery(ctx context.Context, expr string, body []byte) ([]byte, error) {
+	ctx, span := startSpan(ctx, "proxy.query")
+	defer span.End()
+	q, err := query.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	select {
+	case querySlots <- struct{}{}:
+		defer func() { <-querySlots }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("too many queries running, try again later")
+	}
+	result, err := q.Apply(ctx, body)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("query took longer than %s", queryTimeout)
+	}
+	return result, err
+}
+
+// applyListOptions decodes body, applies opts and sets the pagination headers
+func applyListOptions(header http.Header, requestURL *url.URL, body []byte, opts *listquery.Options) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("result is not valid JSON")
+	}
+
+	var page *listquery.Page
+	var err error
+	switch v := value.(type) {
+	case []interface{}:
+		if page, err = listquery.Apply(v, opts); err != nil {
+			return nil, err
+		}
+		value = page.Items
+	case map[string]interface{}:
+		items, ok := v["items"].([]interface{})
+		if !ok {
+			if len(opts.Filters) > 0 || len(opts.Sort) > 0 || opts.Limit > 0 || opts.Offset > 0 {
+				return nil, errNotAList
+			}
+			value = listquery.Project(v, opts.Fields)
+			break
+		}
+		if page, err = listquery.Apply(items, opts); err != nil {
+			return nil, err
+		}
+		v["items"] = page.Items
+	}
+
+	if page != nil {
+		header.Set("X-Total-Count", strconv.Itoa(page.Total))
+		if page.NextCursor != "" {
+			header.Set("X-Next-Cursor", page.NextCursor)
+			next := *requestURL
+			query := next.Query()
+			// Credentials are not repeated in the link
+			query.Del("apikey")
+			query.Del("token")
+			query.Del("offset")
+			query.Set("cursor", page.NextCursor)
+			next.RawQuery = query.Encode()
+			header.Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+		}
+	}
+	return json.Marshal(value)
+}
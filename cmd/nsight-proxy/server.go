@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/config"
+)
+
+// certReloadInterval is how often the TLS certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// listenAddress applies the port override to the listen address
+func listenAddress(cfg config.Proxy) string {
+	if cfg.Port == 0 || cfg.Listen == "" {
+		return cfg.Listen
+	}
+	host, _, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		host = cfg.Listen
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+}
+
+// certReloader serves a certificate pair and reloads it when the files change,
+// so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// newCertReloader loads the certificate pair
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the pair if either file changed since the last load
+func (c *certReloader) reload() error {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	c.mu.RLock()
+	current := c.modTime
+	c.mu.RUnlock()
+	if !latest.After(current) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = latest
+	c.mu.Unlock()
+	log.Printf("Loaded TLS certificate %s", c.certFile)
+	return nil
+}
+
+// watch reloads the pair periodically. A broken pair keeps the previous certificate.
+func (c *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.reload(); err != nil {
+			log.Printf("Warning: Keeping previous TLS certificate: %v", err)
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// listenUnix listens on a unix socket, replacing a stale socket file left by
+// an earlier run
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serve runs the HTTP server on the configured listeners until ctx is done,
+// then stops accepting requests and waits for in-flight requests and
+// background upstream calls to finish
+func (ps *ProxyServer) serve(ctx context.Context, cfg config.Proxy, handler http.Handler) error {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout.D(),
+		ReadHeaderTimeout: min(cfg.ReadTimeout.D(), 10*time.Second),
+		WriteTimeout:      cfg.WriteTimeout.D(),
+		IdleTimeout:       cfg.IdleTimeout.D(),
+	}
+
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		go certs.watch(certReloadInterval)
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	// Shutdown waits for active connections, so end the event streams first
+	if ps.events != nil {
+		srv.RegisterOnShutdown(ps.events.CloseAll)
+	}
+
+	errs := make(chan error, 2)
+	if addr := listenAddress(cfg); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		scheme := "http"
+		if srv.TLSConfig != nil {
+			scheme = "https"
+		}
+		log.Printf("Listening on %s://%s", scheme, listener.Addr())
+		go func() {
+			if srv.TLSConfig != nil {
+				errs <- srv.ServeTLS(listener, "", "")
+			} else {
+				errs <- srv.Serve(listener)
+			}
+		}()
+	}
+	if cfg.UnixSocket != "" {
+		listener, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			srv.Close()
+			return fmt.Errorf("failed to listen on unix socket %s: %w", cfg.UnixSocket, err)
+		}
+		log.Printf("Listening on unix socket %s", cfg.UnixSocket)
+		go func() { errs <- srv.Serve(listener) }()
+	}
+
+	select {
+	case err := <-errs:
+		srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.D())
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown did not complete: %w", err)
+	}
+	if err := ps.cache.Drain(shutdownCtx); err != nil {
+		return fmt.Errorf("background cache refreshes did not complete: %w", err)
+	}
+	if err := ps.closeWebhooks(shutdownCtx); err != nil {
+		return fmt.Errorf("webhook deliveries did not complete: %w", err)
+	}
+	log.Println("Shutdown complete")
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// serviceSpec describes how the proxy calls one N-Sight service
+type serviceSpec struct {
+	params      []string // Request parameters used by the service (and the cache key)
+	mutating    bool     // Changes state in N-Sight; never cached, requires POST
+	invalidates []string // Cached services made stale by a successful mutating call
+	call        func(client *nsight.ApiClient, params url.Values) (interface{}, error)
+}
+
+// paramError reports a missing or invalid request parameter
+type paramError struct {
+	name string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("Invalid %s parameter", e.name)
+}
+
+// intParam parses a required integer parameter
+func intParam(params url.Values, name string) (int, error) {
+	value, err := strconv.Atoi(params.Get(name))
+	if err != nil {
+		return 0, &paramError{name: name}
+	}
+	return value, nil
+}
+
+// stringParam returns a required string parameter
+func stringParam(params url.Values, name string) (string, error) {
+	value := params.Get(name)
+	if value == "" {
+		return "", &paramError{name: name}
+	}
+	return value, nil
+}
+
+// intListParam parses a comma separated list of integers
+func intListParam(params url.Values, name string) ([]int, error) {
+	parts := strings.Split(params.Get(name), ",")
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, &paramError{name: name}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// upstreamParams copies the service's parameters for a raw call. The proxy
+// uses the N-Sight parameter names, so values pass through unchanged.
+func upstreamParams(spec serviceSpec, params url.Values) map[string]string {
+	upstream := make(map[string]string)
+	for _, name := range spec.params {
+		if value := params.Get(name); value != "" {
+			upstream[name] = value
+		}
+	}
+	return upstream
+}
+
+// checkInvalidations lists the services affected by changes to checks
+var checkInvalidations = []string{"list_failing_checks", "list_checks", "list_device_monitoring_details"}
+
+// services maps the proxy's service names to their N-Sight calls
+var services = map[string]serviceSpec{
+	"list_clients": {
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			return c.FetchClients()
+		},
+	},
+	"list_sites": {
+		params: []string{"clientid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			clientID, err := intParam(p, "clientid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchSites(clientID)
+		},
+	},
+	"list_servers": {
+		params: []string{"siteid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			siteID, err := intParam(p, "siteid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchServers(siteID)
+		},
+	},
+	"list_workstations": {
+		params: []string{"siteid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			siteID, err := intParam(p, "siteid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchWorkstations(siteID)
+		},
+	},
+	"list_devices": {
+		params: []string{"siteid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			siteID, err := intParam(p, "siteid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchDevicesBySite(siteID)
+		},
+	},
+	"list_devices_at_client": {
+		params: []string{"clientid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			clientID, err := intParam(p, "clientid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchDevices(clientID)
+		},
+	},
+	"list_device_asset_details": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchDeviceAssetDetails(deviceID)
+		},
+	},
+	"list_failing_checks": {
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			return c.FetchFailingChecks()
+		},
+	},
+	"list_checks": {
+		params: []string{"deviceid", "siteid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			if p.Get("deviceid") != "" {
+				deviceID, err := intParam(p, "deviceid")
+				if err != nil {
+					return nil, err
+				}
+				return c.FetchChecks(deviceID)
+			}
+			if p.Get("siteid") != "" {
+				siteID, err := intParam(p, "siteid")
+				if err != nil {
+					return nil, err
+				}
+				return c.FetchChecksBySite(siteID)
+			}
+			return nil, &paramError{name: "deviceid or siteid"}
+		},
+	},
+	"list_device_monitoring_details": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchDeviceMonitoringDetails(deviceID)
+		},
+	},
+	"list_agentless_assets": {
+		params: []string{"siteid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			siteID, err := intParam(p, "siteid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchAgentlessAssets(siteID)
+		},
+	},
+	"list_hardware": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchHardware(deviceID)
+		},
+	},
+	"list_software": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchSoftware(deviceID)
+		},
+	},
+	"list_license_groups": {
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			return c.FetchLicenseGroups()
+		},
+	},
+	"list_patches": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchPatches(deviceID)
+		},
+	},
+	"list_antivirus_products": {
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			return c.FetchAntivirusProducts()
+		},
+	},
+	"list_antivirus_definitions": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchAntivirusDefinitions(deviceID)
+		},
+	},
+	"list_quarantine": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchQuarantineList(deviceID)
+		},
+	},
+	"list_performance_history": {
+		params: []string{"deviceid", "checkid", "startdate", "enddate"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			checkID, err := intParam(p, "checkid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchPerformanceHistory(deviceID, checkID, p.Get("startdate"), p.Get("enddate"))
+		},
+	},
+	"list_drive_space_history": {
+		params: []string{"deviceid", "startdate", "enddate"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchDriveSpaceHistory(deviceID, p.Get("startdate"), p.Get("enddate"))
+		},
+	},
+	"list_templates": {
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			return c.FetchTemplates()
+		},
+	},
+	"list_backup_sessions": {
+		params: []string{"deviceid"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			return c.FetchBackupSessions(deviceID)
+		},
+	},
+
+	// -- Mutating services --
+
+	"clear_check": {
+		params:      []string{"checkid"},
+		mutating:    true,
+		invalidates: checkInvalidations,
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			checkID, err := intParam(p, "checkid")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Check cleared"), c.ClearCheck(checkID)
+		},
+	},
+	"add_check_note": {
+		params:      []string{"checkid", "note"},
+		mutating:    true,
+		invalidates: checkInvalidations,
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			checkID, err := intParam(p, "checkid")
+			if err != nil {
+				return nil, err
+			}
+			note, err := stringParam(p, "note")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Note added to check"), c.AddCheckNote(checkID, note)
+		},
+	},
+	"approve_patch": {
+		params:      []string{"deviceid", "patchids"},
+		mutating:    true,
+		invalidates: []string{"list_patches"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			patchIDs, err := intListParam(p, "patchids")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Patches approved"), c.ApprovePatches(deviceID, patchIDs)
+		},
+	},
+	"ignore_patch": {
+		params:      []string{"deviceid", "patchids"},
+		mutating:    true,
+		invalidates: []string{"list_patches"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			patchIDs, err := intListParam(p, "patchids")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Patches ignored"), c.IgnorePatches(deviceID, patchIDs)
+		},
+	},
+	"start_scan": {
+		params:      []string{"deviceid", "scantype"},
+		mutating:    true,
+		invalidates: []string{"list_quarantine", "list_antivirus_definitions"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			deviceID, err := intParam(p, "deviceid")
+			if err != nil {
+				return nil, err
+			}
+			scanType, err := stringParam(p, "scantype")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Antivirus scan started"), c.StartAntivirusScan(deviceID, scanType)
+		},
+	},
+	"run_task_now": {
+		params:      []string{"taskid"},
+		mutating:    true,
+		invalidates: checkInvalidations,
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			taskID, err := intParam(p, "taskid")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Task started"), c.RunTaskNow(taskID)
+		},
+	},
+	"add_client": {
+		params:      []string{"name", "contactname", "contactemail"},
+		mutating:    true,
+		invalidates: []string{"list_clients"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			name, err := stringParam(p, "name")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Client added"), c.AddClient(name, p.Get("contactname"), p.Get("contactemail"))
+		},
+	},
+	"add_site": {
+		params:      []string{"clientid", "name", "contactname", "contactemail"},
+		mutating:    true,
+		invalidates: []string{"list_sites"},
+		call: func(c *nsight.ApiClient, p url.Values) (interface{}, error) {
+			clientID, err := intParam(p, "clientid")
+			if err != nil {
+				return nil, err
+			}
+			name, err := stringParam(p, "name")
+			if err != nil {
+				return nil, err
+			}
+			return statusResult("Site added"), c.AddSite(clientID, name, p.Get("contactname"), p.Get("contactemail"))
+		},
+	},
+}
+
+// statusResult is the response body of a successful mutating call
+func statusResult(message string) map[string]string {
+	return map[string]string{"status": "success", "message": message}
+}
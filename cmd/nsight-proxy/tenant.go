@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// ownershipRefreshInterval limits how often the API is rescanned for a client
+// when an ID cannot be resolved from the cache or earlier lookups
+const ownershipRefreshInterval = 10 * time.Minute
+
+// Tenant binds an access token to the N-Sight clients it may see
+type Tenant struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	APIKey    string `json:"apikey"`     // Upstream key used for this tenant's requests
+	Instance  string `json:"instance"`   // N-Sight instance of the clients, the default one if empty
+	ClientIDs []int  `json:"client_ids"` // Clients (and their sites and devices) the tenant may access
+}
+
+// allowsClient reports whether the tenant may access the given client
+func (t *Tenant) allowsClient(clientID int) bool {
+	for _, id := range t.ClientIDs {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantServices lists the services a tenant token may call. Account-wide
+// services such as templates or license groups are not scoped to a client.
+var tenantServices = map[string]bool{
+	"list_clients":                   true,
+	"list_sites":                     true,
+	"list_servers":                   true,
+	"list_workstations":              true,
+	"list_devices":                   true,
+	"list_devices_at_client":         true,
+	"list_device_asset_details":      true,
+	"list_failing_checks":            true,
+	"list_checks":                    true,
+	"list_device_monitoring_details": true,
+	"list_agentless_assets":          true,
+	"list_hardware":                  true,
+	"list_software":                  true,
+	"list_patches":                   true,
+	"list_antivirus_definitions":     true,
+	"list_quarantine":                true,
+	"list_performance_history":       true,
+	"list_drive_space_history":       true,
+	"list_backup_sessions":           true,
+}
+
+// tenantFilteredServices return account-wide lists that scopeResult narrows to
+// the tenant. Their raw XML would expose other clients, so it is not passed through.
+var tenantFilteredServices = map[string]bool{
+	"list_clients":        true,
+	"list_failing_checks": true,
+}
+
+// loadTenants reads the tenant definitions from a JSON file
+func loadTenants(path string) (map[string]*Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file %s: %w", path, err)
+	}
+	var tenants []*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", path, err)
+	}
+
+	byToken := make(map[string]*Tenant)
+	for _, t := range tenants {
+		if t.Token == "" {
+			return nil, fmt.Errorf("tenant %q has no token", t.Name)
+		}
+		if len(t.ClientIDs) == 0 {
+			return nil, fmt.Errorf("tenant %q has no client_ids", t.Name)
+		}
+		if _, dup := byToken[t.Token]; dup {
+			return nil, fmt.Errorf("tenant %q reuses a token of another tenant", t.Name)
+		}
+		byToken[t.Token] = t
+	}
+	return byToken, nil
+}
+
+// requestToken extracts the access token from the Authorization header or the token parameter
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// requestCredentials returns the caller's tenant, if any, and the upstream API
+// key. A tenant token replaces the apikey parameter and limits what the caller
+// can see. It returns a reason instead if the credentials are missing or invalid.
+func (ps *ProxyServer) requestCredentials(r *http.Request, params url.Values) (*Tenant, string, string) {
+	var tenant *Tenant
+	apiKey := params.Get("apikey")
+	if token := requestToken(r); token != "" {
+		tenant = ps.tenants[token]
+		if tenant == nil {
+			return nil, "", "Invalid access token"
+		}
+		if tenant.APIKey != "" {
+			apiKey = tenant.APIKey
+		}
+	}
+	if apiKey == "" {
+		return nil, "", "Missing apikey parameter"
+	}
+	return tenant, apiKey, ""
+}
+
+// ownershipIndex maps sites and devices to their owning client. It is filled
+// from the fetchall CSV cache and, for IDs missing there, from the API.
+// The lock only guards the maps; API scans run outside it, one per client at a time.
+type ownershipIndex struct {
+	mu            sync.Mutex
+	scans         singleflight.Group
+	cacheDir      string
+	cacheLoaded   bool
+	siteClient    map[int]int
+	deviceClient  map[int]int
+	clientScanned map[int]time.Time
+}
+
+// newOwnershipIndex creates an empty index backed by the given cache directory
+func newOwnershipIndex(cacheDir string) *ownershipIndex {
+	return &ownershipIndex{
+		cacheDir:      cacheDir,
+		siteClient:    make(map[int]int),
+		deviceClient:  make(map[int]int),
+		clientScanned: make(map[int]time.Time),
+	}
+}
+
+// loadCache reads site and device ownership from the CSV cache once.
+// Missing cache files are not an error; the API is used instead.
+func (o *ownershipIndex) loadCache() {
+	if o.cacheLoaded {
+		return
+	}
+	o.cacheLoaded = true
+
+	// sites.csv: site_id, name, client_id
+	for _, rec := range readOwnershipCsv(o.cacheDir, "sites.csv") {
+		if len(rec) < 3 {
+			continue
+		}
+		siteID, errS := strconv.Atoi(rec[0])
+		clientID, errC := strconv.Atoi(rec[2])
+		if errS == nil && errC == nil {
+			o.siteClient[siteID] = clientID
+		}
+	}
+
+	// servers.csv and workstations.csv: device ID first, client_id last (index 11)
+	for _, name := range []string{"servers.csv", "workstations.csv"} {
+		for _, rec := range readOwnershipCsv(o.cacheDir, name) {
+			if len(rec) < 12 {
+				continue
+			}
+			deviceID, errD := strconv.Atoi(rec[0])
+			clientID, errC := strconv.Atoi(rec[11])
+			if errD == nil && errC == nil {
+				o.deviceClient[deviceID] = clientID
+			}
+		}
+	}
+	log.Printf("Loaded ownership of %d sites and %d devices from cache", len(o.siteClient), len(o.deviceClient))
+}
+
+// readOwnershipCsv returns the records of a cache file, or nil if it cannot be read
+func readOwnershipCsv(dir, name string) [][]string {
+	records, err := inventory.ReadCSV(dir, name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: %v", err)
+		}
+		return nil
+	}
+	return records
+}
+
+// reset forgets cached ownership so the next lookup reloads the CSV cache
+func (o *ownershipIndex) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cacheLoaded = false
+	o.siteClient = make(map[int]int)
+	o.deviceClient = make(map[int]int)
+	o.clientScanned = make(map[int]time.Time)
+}
+
+// scanClient records all sites and devices of a client from the API.
+// Concurrent scans of the same client share one set of calls.
+func (o *ownershipIndex) scanClient(client *nsight.ApiClient, clientID int) error {
+	o.mu.Lock()
+	scanned, ok := o.clientScanned[clientID]
+	o.mu.Unlock()
+	if ok && time.Since(scanned) < ownershipRefreshInterval {
+		return nil
+	}
+
+	_, err, _ := o.scans.Do(strconv.Itoa(clientID), func() (interface{}, error) {
+		sites, err := client.FetchSites(clientID)
+		if err != nil {
+			return nil, err
+		}
+		devices, err := client.FetchDevices(clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		for _, site := range sites {
+			o.siteClient[site.SiteID] = clientID
+		}
+		for _, device := range devices {
+			o.deviceClient[device.DeviceID] = clientID
+		}
+		o.clientScanned[clientID] = time.Now()
+		return nil, nil
+	})
+	return err
+}
+
+// resolve marks the IDs the index assigns to one of the tenant's clients as
+// owned and returns the rest. It looks up device IDs if devices is set, site IDs otherwise.
+func (o *ownershipIndex) resolve(tenant *Tenant, devices bool, ids []int, owned map[int]bool) []int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.loadCache()
+	owners := o.siteClient
+	if devices {
+		owners = o.deviceClient
+	}
+	var missing []int
+	for _, id := range ids {
+		if owner, ok := owners[id]; ok && tenant.allowsClient(owner) {
+			owned[id] = true
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// owned reports which of the IDs the tenant owns, consulting the cache first
+// and then the API for each of the tenant's clients until all are resolved
+func (o *ownershipIndex) owned(client *nsight.ApiClient, tenant *Tenant, devices bool, ids []int) (map[int]bool, error) {
+	owned := make(map[int]bool, len(ids))
+	missing := o.resolve(tenant, devices, ids, owned)
+	for _, clientID := range tenant.ClientIDs {
+		if len(missing) == 0 {
+			break
+		}
+		if err := o.scanClient(client, clientID); err != nil {
+			return nil, fmt.Errorf("resolving ownership for client %d: %w", clientID, err)
+		}
+		missing = o.resolve(tenant, devices, missing, owned)
+	}
+	return owned, nil
+}
+
+// ownsSite reports whether the site belongs to one of the tenant's clients
+func (o *ownershipIndex) ownsSite(client *nsight.ApiClient, tenant *Tenant, siteID int) (bool, error) {
+	owned, err := o.owned(client, tenant, false, []int{siteID})
+	return owned[siteID], err
+}
+
+// ownsDevice reports whether the device belongs to one of the tenant's clients
+func (o *ownershipIndex) ownsDevice(client *nsight.ApiClient, tenant *Tenant, deviceID int) (bool, error) {
+	owned, err := o.owned(client, tenant, true, []int{deviceID})
+	return owned[deviceID], err
+}
+
+// authorizeTenant checks the clientid, siteid and deviceid parameters of a
+// request against the tenant. It returns false with a message when access is denied.
+func (pi *proxyInstance) authorizeTenant(client *nsight.ApiClient, tenant *Tenant, service string, query url.Values) (bool, string, error) {
+	if !tenantServices[service] {
+		return false, fmt.Sprintf("Service %s is not available to tenant tokens", service), nil
+	}
+
+	if v := query.Get("clientid"); v != "" {
+		clientID, err := strconv.Atoi(v)
+		if err != nil || !tenant.allowsClient(clientID) {
+			return false, "Access to this client is not allowed", nil
+		}
+	}
+	if v := query.Get("siteid"); v != "" {
+		siteID, err := strconv.Atoi(v)
+		if err != nil {
+			return false, "Access to this site is not allowed", nil
+		}
+		ok, err := pi.ownership.ownsSite(client, tenant, siteID)
+		if err != nil || !ok {
+			return false, "Access to this site is not allowed", err
+		}
+	}
+	if v := query.Get("deviceid"); v != "" {
+		deviceID, err := strconv.Atoi(v)
+		if err != nil {
+			return false, "Access to this device is not allowed", nil
+		}
+		ok, err := pi.ownership.ownsDevice(client, tenant, deviceID)
+		if err != nil || !ok {
+			return false, "Access to this device is not allowed", err
+		}
+	}
+	return true, "", nil
+}
+
+// scopeResult removes entries the tenant may not see from aggregate results
+func (pi *proxyInstance) scopeResult(client *nsight.ApiClient, tenant *Tenant, result interface{}) (interface{}, error) {
+	switch items := result.(type) {
+	case []nsight.Client:
+		scoped := []nsight.Client{}
+		for _, c := range items {
+			if tenant.allowsClient(c.ClientID) {
+				scoped = append(scoped, c)
+			}
+		}
+		return scoped, nil
+
+	case []nsight.Check:
+		deviceIDs := make([]int, len(items))
+		for i, check := range items {
+			deviceIDs[i] = check.DeviceID
+		}
+		owned, err := pi.ownership.owned(client, tenant, true, deviceIDs)
+		if err != nil {
+			return nil, err
+		}
+		scoped := []nsight.Check{}
+		for _, check := range items {
+			if owned[check.DeviceID] {
+				scoped = append(scoped, check)
+			}
+		}
+		return scoped, nil
+	}
+	return result, nil
+}
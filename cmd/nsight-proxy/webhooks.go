@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/webhook"
+)
+
+// newWebhookDispatcher creates the dispatcher for the configured subscriptions
+// file, fed by the failing check poller of /v1/events. It returns nil if no
+// file is set.
+func (ps *ProxyServer) newWebhookDispatcher(cfg config.Webhooks) (*webhook.Dispatcher, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	if ps.events == nil {
+		return nil, fmt.Errorf("webhooks need the failing check poller, set an API key and a non-zero proxy.events.interval")
+	}
+	subs, err := webhook.LoadSubscriptions(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := webhook.Options{
+		Attempts:       cfg.Attempts,
+		InitialBackoff: cfg.Backoff.D(),
+		DeadLetter:     cfg.DeadLetter,
+	}
+	log.Printf("Loaded %d webhooks from %s", len(subs), cfg.File)
+	return webhook.New(ps.events, subs, ps.locateDevice, opts), nil
+}
+
+// locateDevice finds a device in the default instance's fetchall cache, or
+// returns nil
+func (ps *ProxyServer) locateDevice(deviceID int) *inventory.DeviceLocation {
+	clients, _ := ps.defaultInstance.inventory.snapshot()
+	location, err := inventory.FindDevice(clients, strconv.Itoa(deviceID))
+	if err != nil || location == nil || location.DeviceID != deviceID {
+		return nil
+	}
+	return location
+}
+
+// webhookTestResult reports one test delivery
+type webhookTestResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status,omitempty"` // HTTP status returned by the receiver
+	Error  string `json:"error,omitempty"`
+}
+
+// handleWebhookTest sends a sample event to the configured webhooks, once and
+// without retries, so receivers and templates can be checked. The name
+// parameter selects one webhook and event selects the event type.
+func (ps *ProxyServer) handleWebhookTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethod, "Only POST method is supported")
+		return
+	}
+	// Only the proxy's own key may trigger deliveries, tenant tokens may not
+	if !ps.defaultInstance.isOwnKey(r.Context(), r.URL.Query().Get("apikey")) {
+		writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid credentials")
+		return
+	}
+	if ps.webhooks == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, codeWebhooksDisabled, "Webhooks are not configured, set NSIGHT_WEBHOOKS_FILE")
+		return
+	}
+
+	eventType := r.URL.Query().Get("event")
+	switch eventType {
+	case "":
+		eventType = checkwatch.EventNew
+	case checkwatch.EventNew, checkwatch.EventChanged, checkwatch.EventResolved:
+	default:
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("Unknown event type %q", eventType))
+		return
+	}
+	check := nsight.Check{Name: "Test check", DeviceName: "nsight-proxy", Severity: 2, Message: "Test delivery from nsight-proxy"}
+	event := checkwatch.Event{Type: eventType, Time: time.Now().UTC(), Check: &check}
+	if eventType == checkwatch.EventChanged {
+		previous := check
+		previous.Message = "Previous message"
+		event.Previous, event.Changes = &previous, []string{"message"}
+	}
+
+	name := r.URL.Query().Get("name")
+	results := []webhookTestResult{}
+	for _, sub := range ps.webhooks.Subscriptions() {
+		if name != "" && sub.Name != name {
+			continue
+		}
+		payload := webhook.NewPayload(event, nil)
+		payload.Subscription = sub.Name
+		result := ps.webhooks.Send(r.Context(), sub, payload, nil)
+		entry := webhookTestResult{Name: sub.Name, Status: result.Status}
+		if result.Err != nil {
+			entry.Error = result.Err.Error()
+		}
+		results = append(results, entry)
+	}
+	if len(results) == 0 {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("No webhook named %q", name))
+		return
+	}
+	log.Printf("[%s] Sent test event to %d webhooks", requestID(r), len(results))
+	json.NewEncoder(w).Encode(results)
+}
+
+// closeWebhooks stops the dispatcher on shutdown, dead-lettering what is left
+func (ps *ProxyServer) closeWebhooks(ctx context.Context) error {
+	if ps.webhooks == nil {
+		return nil
+	}
+	return ps.webhooks.Close(ctx)
+}
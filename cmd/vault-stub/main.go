@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// secretsFile maps secret paths (as after /v1/) to their fields
+type secretsFile map[string]map[string]string
+
+func main() {
+	// Define and parse flags
+	listen := flag.String("listen", "127.0.0.1:8200", "Address to listen on")
+	token := flag.String("token", "dev-token", "Token clients must send in X-Vault-Token")
+	file := flag.String("secrets", "vault-secrets.json", "JSON file mapping secret paths to fields, read on every request")
+	flag.Parse()
+
+	// Secrets are read on every request, so editing the file simulates rotation
+	http.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeErrors(w, http.StatusMethodNotAllowed, "only reads are supported")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Vault-Token")), []byte(*token)) != 1 {
+			log.Printf("GET %s rejected: invalid token", r.URL.Path)
+			writeErrors(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var secrets secretsFile
+		if err := json.Unmarshal(data, &secrets); err != nil {
+			writeErrors(w, http.StatusInternalServerError, "invalid secrets file: "+err.Error())
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		fields, ok := secrets[path]
+		if !ok {
+			log.Printf("GET %s: not found", r.URL.Path)
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		log.Printf("GET %s: %d fields", r.URL.Path, len(fields))
+
+		// KV version 2 paths contain /data/ and nest the fields
+		if strings.Contains(path, "/data/") {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"data": fields, "metadata": map[string]int{"version": 1}},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": fields})
+	})
+
+	fmt.Printf("Vault stand-in listening on http://%s, secrets from %s\n", *listen, *file)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+// writeErrors answers like Vault does for failed requests
+func writeErrors(w http.ResponseWriter, status int, errors ...string) {
+	w.WriteHeader(status)
+	if errors == nil {
+		errors = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errors})
+}
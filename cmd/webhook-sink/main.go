@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"nsight-proxy/internal/webhook"
+)
+
+// maxSkew is how old a signed delivery may be before it is rejected as a replay
+const maxSkew = 5 * time.Minute
+
+func main() {
+	// Define and parse flags
+	listen := flag.String("listen", "127.0.0.1:8099", "Address to listen on")
+	secret := flag.String("secret", "", "Verify signatures with this secret and reject invalid ones")
+	failFirst := flag.Int("fail", 0, "Answer the first N deliveries with -fail-status to exercise retries")
+	failStatus := flag.Int("fail-status", http.StatusServiceUnavailable, "Status of the failed deliveries")
+	retryAfter := flag.Int("retry-after", 0, "Retry-After seconds sent with failed deliveries")
+	flag.Parse()
+
+	var received atomic.Int64
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n := received.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		signature := "unsigned"
+		if *secret != "" {
+			timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+			switch {
+			case !webhook.Verify(*secret, timestamp, body, r.Header.Get(webhook.HeaderSignature)):
+				log.Printf("#%d rejected: invalid signature", n)
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			case time.Since(time.Unix(timestamp, 0)).Abs() > maxSkew:
+				log.Printf("#%d rejected: timestamp too old", n)
+				http.Error(w, "stale timestamp", http.StatusUnauthorized)
+				return
+			}
+			signature = "signature ok"
+		}
+
+		if n <= int64(*failFirst) {
+			log.Printf("#%d %s %s event %s: failing with %d (%s)", n, r.Method, r.URL.Path, r.Header.Get(webhook.HeaderDelivery), *failStatus, signature)
+			if *retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(*retryAfter))
+			}
+			http.Error(w, "simulated failure", *failStatus)
+			return
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Write(body)
+		}
+		log.Printf("#%d %s %s %s event %s (%s)\n%s", n, r.Method, r.URL.Path, r.Header.Get(webhook.HeaderEvent), r.Header.Get(webhook.HeaderDelivery), signature, pretty.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	fmt.Printf("Webhook sink listening on http://%s\n", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
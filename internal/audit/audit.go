@@ -0,0 +1,349 @@
+// Package audit records calls that change state in N-Sight. Records are
+// appended as JSON lines to a local file and optionally sent to an HTTP
+// collector. Secrets are never recorded, only short hashes of keys and tokens.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/config"
+)
+
+// defaultLogFile is used when no log file is configured
+const defaultLogFile = "audit.jsonl"
+
+// maxLineSize bounds a single record when reading the log
+const maxLineSize = 1 << 20
+
+// Actor identifies who triggered a call
+type Actor struct {
+	Tool      string `json:"tool"`                 // Program that made the call, e.g. getdata or nsight-proxy
+	User      string `json:"user,omitempty"`       // Local user or tenant name
+	Tenant    string `json:"tenant,omitempty"`     // Proxy tenant, if a tenant token was used
+	TokenHash string `json:"token_hash,omitempty"` // Hash of the caller's proxy token
+	RequestID string `json:"request_id,omitempty"` // Proxy request ID
+	Remote    string `json:"remote,omitempty"`     // Address of the proxy client
+}
+
+// Record is one audited call
+type Record struct {
+	Time time.Time `json:"time"`
+	Actor
+	KeyHash        string            `json:"key_hash"` // Hash of the N-Sight API key used
+	Service        string            `json:"service"`
+	Targets        map[string]string `json:"targets,omitempty"` // IDs of the affected entities
+	Params         map[string]string `json:"params,omitempty"`
+	Outcome        string            `json:"outcome"` // "ok" or the kind of error
+	Error          string            `json:"error,omitempty"`
+	UpstreamStatus int               `json:"upstream_status,omitempty"`
+	Response       string            `json:"response,omitempty"` // Excerpt of the upstream response
+	DurationMs     int64             `json:"duration_ms"`
+}
+
+// Store receives audit records
+type Store interface {
+	Append(rec Record) error
+}
+
+// Hash returns a short non-reversible identifier of a key or token, matching
+// the hashes the proxy uses for its cache
+func Hash(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// DefaultActor identifies the local user running tool
+func DefaultActor(tool string) Actor {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return Actor{Tool: tool, User: name}
+}
+
+// ProcessActor identifies the local user running the current program
+func ProcessActor() Actor {
+	return DefaultActor(strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe"))
+}
+
+// Targets picks the entity IDs from call parameters
+func Targets(params map[string]string) map[string]string {
+	targets := make(map[string]string)
+	for name, value := range params {
+		if strings.HasSuffix(name, "id") || strings.HasSuffix(name, "ids") {
+			targets[name] = value
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return targets
+}
+
+// FileStore appends records to a JSON lines file. The file is reopened for
+// every record, so it can be rotated while tools are running.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore creates the log file if needed and checks that it is writable
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	f.Close()
+	return &FileStore{path: path}, nil
+}
+
+// Append writes rec as a single line
+func (s *FileStore) Append(rec Record) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false) // Keep upstream XML readable
+	if err := encoder.Encode(rec); err != nil {
+		return err
+	}
+	line := buf.Bytes()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTPStore posts each record as JSON to a collector
+type HTTPStore struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPStore creates a store posting to url
+func NewHTTPStore(url string) *HTTPStore {
+	return &HTTPStore{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Append posts rec and fails on any non-2xx response
+func (s *HTTPStore) Append(rec Record) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("audit collector unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// multiStore appends to several stores
+type multiStore []Store
+
+func (m multiStore) Append(rec Record) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Append(rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The default store is shared by all API clients of the process
+var (
+	defaultMu    sync.Mutex
+	defaultStore Store
+	defaultErr   error
+	defaultReady bool         // The store was built or set
+	settings     config.Audit // Set by Configure
+)
+
+// SetDefault replaces the configured store. nil disables auditing.
+func SetDefault(s Store) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	// Explicit stores win over Configure
+	defaultStore, defaultErr, defaultReady = s, nil, true
+}
+
+// Default returns the store configured by Configure. It returns nil if
+// auditing is disabled. A store that could not be built, e.g. because the log
+// file was not writable yet, is built again on the next call.
+func Default() (Store, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if !defaultReady || defaultErr != nil {
+		defaultStore, defaultErr = newDefaultStore(settings)
+		defaultReady = true
+	}
+	return defaultStore, defaultErr
+}
+
+// Configure sets the log file ("off" to disable the file) and the optional
+// collector URL of the default store. It must be called before first use.
+func Configure(c config.Audit) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	settings = c
+}
+
+// LogPath returns the configured audit log file, empty if disabled
+func LogPath() string {
+	defaultMu.Lock()
+	c := settings
+	defaultMu.Unlock()
+	return logPath(c)
+}
+
+// logPath returns the log file of the given settings, empty if disabled
+func logPath(c config.Audit) string {
+	path := c.Log
+	switch {
+	case path == "":
+		return defaultLogFile
+	case strings.EqualFold(path, "off"):
+		return ""
+	}
+	return path
+}
+
+// newDefaultStore builds the default store from the given settings
+func newDefaultStore(c config.Audit) (Store, error) {
+	var stores multiStore
+	if path := logPath(c); path != "" {
+		file, err := NewFileStore(path)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, file)
+	}
+	if c.URL != "" {
+		stores = append(stores, NewHTTPStore(c.URL))
+	}
+	switch len(stores) {
+	case 0:
+		log.Println("Warning: Audit log disabled, changes made through the N-Sight API are not recorded")
+		return nil, nil
+	case 1:
+		return stores[0], nil
+	}
+	return stores, nil
+}
+
+// Filter selects records when reading the log. Zero fields match everything.
+type Filter struct {
+	Since   time.Time
+	Until   time.Time
+	Service string
+	User    string // Matches the user or tenant
+	Tool    string
+	Target  string // Matches any target ID
+	Outcome string
+	Limit   int // Keep only the most recent records
+}
+
+// Match reports whether rec passes the filter
+func (f Filter) Match(rec Record) bool {
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Time.After(f.Until) {
+		return false
+	}
+	if f.Service != "" && rec.Service != f.Service {
+		return false
+	}
+	if f.User != "" && !strings.EqualFold(rec.User, f.User) && !strings.EqualFold(rec.Tenant, f.User) {
+		return false
+	}
+	if f.Tool != "" && rec.Tool != f.Tool {
+		return false
+	}
+	if f.Outcome != "" && rec.Outcome != f.Outcome {
+		return false
+	}
+	if f.Target != "" && !matchesTarget(rec.Targets, f.Target) {
+		return false
+	}
+	return true
+}
+
+// matchesTarget reports whether id is one of the target IDs, including ID lists
+func matchesTarget(targets map[string]string, id string) bool {
+	for _, value := range targets {
+		ids := strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '[' || r == ']'
+		})
+		for _, candidate := range ids {
+			if candidate == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadFile returns the records of a log file that match filter, oldest first.
+// Lines that are not valid records are skipped and counted.
+func ReadFile(path string, filter Filter) (records []Record, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			skipped++
+			continue
+		}
+		if filter.Match(rec) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[len(records)-filter.Limit:]
+	}
+	return records, skipped, nil
+}
@@ -0,0 +1,260 @@
+// Package checkwatch polls the failing checks of an account and turns the
+// differences between polls into events. Recent events are kept so that
+// subscribers can resume after a reconnect without missing changes.
+package checkwatch
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// Event types
+const (
+	EventNew      = "new"      // A check started failing
+	EventResolved = "resolved" // A check is no longer failing
+	EventChanged  = "changed"  // A failing check changed state, severity or message
+	EventSnapshot = "snapshot" // All failing checks, sent when a subscriber cannot resume
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 256
+
+// Event is one change of the failing checks
+type Event struct {
+	ID       uint64         `json:"id"`
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	Check    *nsight.Check  `json:"check,omitempty"`
+	Previous *nsight.Check  `json:"previous,omitempty"` // State before a change
+	Changes  []string       `json:"changes,omitempty"`  // Fields that changed
+	Checks   []nsight.Check `json:"checks,omitempty"`   // Failing checks of a snapshot
+}
+
+// Watcher polls the failing checks and distributes the changes
+type Watcher struct {
+	fetch    func() ([]nsight.Check, error)
+	interval time.Duration
+	history  int
+
+	mu       sync.Mutex
+	current  map[int]nsight.Check
+	primed   bool    // The first poll only records the current state
+	events   []Event // Recent events, oldest first
+	lastID   uint64
+	subs     map[*Subscription]struct{}
+	lastPoll time.Time
+	lastErr  error
+}
+
+// New creates a watcher that calls fetch every interval and keeps the last
+// history events for resuming subscribers. Event IDs start from the current
+// time, so they keep increasing across restarts.
+func New(fetch func() ([]nsight.Check, error), interval time.Duration, history int) *Watcher {
+	return &Watcher{
+		fetch:    fetch,
+		interval: interval,
+		history:  history,
+		current:  make(map[int]nsight.Check),
+		lastID:   uint64(time.Now().UnixMilli()) * 1000,
+		subs:     make(map[*Subscription]struct{}),
+	}
+}
+
+// Run polls until the process exits
+func (w *Watcher) Run() {
+	for {
+		if err := w.Poll(); err != nil {
+			log.Printf("Warning: Failed to poll failing checks: %v", err)
+		}
+		time.Sleep(w.interval)
+	}
+}
+
+// Status returns the time and error of the last poll
+func (w *Watcher) Status() (time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastPoll, w.lastErr
+}
+
+// Poll fetches the failing checks once and publishes the differences
+func (w *Watcher) Poll() error {
+	checks, err := w.fetch()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastPoll, w.lastErr = time.Now(), err
+	if err != nil {
+		return err
+	}
+
+	next := make(map[int]nsight.Check, len(checks))
+	for _, check := range checks {
+		next[check.CheckID] = check
+	}
+	if !w.primed {
+		// Subscribers that connected before the first poll got an empty snapshot
+		w.current, w.primed = next, true
+		snapshot := w.snapshot()
+		for sub := range w.subs {
+			select {
+			case sub.ch <- snapshot:
+			default:
+				w.unsubscribe(sub)
+			}
+		}
+		return nil
+	}
+	for _, event := range Diff(w.current, next) {
+		w.publish(event)
+	}
+	w.current = next
+	return nil
+}
+
+// Diff compares two polls keyed by check ID. Events are ordered by check ID
+// and have no ID or time yet.
+func Diff(previous, current map[int]nsight.Check) []Event {
+	var events []Event
+	for id, check := range current {
+		check := check
+		old, existed := previous[id]
+		if !existed {
+			events = append(events, Event{Type: EventNew, Check: &check})
+			continue
+		}
+		if changes := changedFields(old, check); len(changes) > 0 {
+			old := old
+			events = append(events, Event{Type: EventChanged, Check: &check, Previous: &old, Changes: changes})
+		}
+	}
+	for id, check := range previous {
+		if _, ok := current[id]; !ok {
+			check := check
+			events = append(events, Event{Type: EventResolved, Check: &check})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Check.CheckID < events[j].Check.CheckID })
+	return events
+}
+
+// changedFields lists the fields that make a failing check a different alert
+func changedFields(old, check nsight.Check) []string {
+	var changes []string
+	if old.State != check.State {
+		changes = append(changes, "state")
+	}
+	if old.Severity != check.Severity {
+		changes = append(changes, "severity")
+	}
+	if old.Message != check.Message {
+		changes = append(changes, "message")
+	}
+	if old.Name != check.Name || old.Description != check.Description {
+		changes = append(changes, "name")
+	}
+	return changes
+}
+
+// publish assigns the next ID, records the event and sends it to subscribers.
+// Subscribers that fall too far behind are dropped and can resume later.
+func (w *Watcher) publish(event Event) {
+	w.lastID++
+	event.ID = w.lastID
+	event.Time = time.Now().UTC()
+
+	w.events = append(w.events, event)
+	if len(w.events) > w.history {
+		w.events = w.events[len(w.events)-w.history:]
+	}
+	for sub := range w.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			w.unsubscribe(sub)
+		}
+	}
+}
+
+// snapshot returns the current failing checks as an event
+func (w *Watcher) snapshot() Event {
+	checks := make([]nsight.Check, 0, len(w.current))
+	for _, check := range w.current {
+		checks = append(checks, check)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].CheckID < checks[j].CheckID })
+	return Event{ID: w.lastID, Type: EventSnapshot, Time: time.Now().UTC(), Checks: checks}
+}
+
+// Subscription receives the events of a watcher
+type Subscription struct {
+	w  *Watcher
+	ch chan Event
+	// Backlog holds the events to send before reading C: the missed events
+	// when resuming, otherwise a snapshot
+	Backlog []Event
+}
+
+// C delivers new events. It is closed when the subscriber falls behind or is
+// unsubscribed; the subscriber may then resume from its last event.
+func (s *Subscription) C() <-chan Event {
+	return s.ch
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	s.w.unsubscribe(s)
+}
+
+// unsubscribe removes a subscriber; the caller holds the lock
+func (w *Watcher) unsubscribe(sub *Subscription) {
+	if _, ok := w.subs[sub]; ok {
+		delete(w.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Subscribe starts a subscription. With resume set, the backlog holds the
+// events after lastID; if some of them are no longer kept, or resume is not
+// set, it holds a snapshot of all failing checks instead.
+func (w *Watcher) Subscribe(lastID uint64, resume bool) *Subscription {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sub := &Subscription{w: w, ch: make(chan Event, subscriberBuffer)}
+	w.subs[sub] = struct{}{}
+
+	if resume && lastID <= w.lastID && w.canResume(lastID) {
+		for _, event := range w.events {
+			if event.ID > lastID {
+				sub.Backlog = append(sub.Backlog, event)
+			}
+		}
+		return sub
+	}
+	sub.Backlog = []Event{w.snapshot()}
+	return sub
+}
+
+// canResume reports whether all events after lastID are still kept
+func (w *Watcher) canResume(lastID uint64) bool {
+	if lastID == w.lastID {
+		return true
+	}
+	return len(w.events) > 0 && w.events[0].ID <= lastID+1
+}
+
+// CloseAll ends all subscriptions, e.g. on shutdown
+func (w *Watcher) CloseAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for sub := range w.subs {
+		w.unsubscribe(sub)
+	}
+}
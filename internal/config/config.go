@@ -0,0 +1,327 @@
+// Package config holds the settings of all commands. Values come from
+// defaults, then a YAML or TOML file, then NSIGHT_* environment variables
+// (including .env), then command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultFiles are looked up in the working directory if no file is named
+var defaultFiles = []string{"nsight.yaml", "nsight.yml", "nsight.toml"}
+
+// redacted replaces secrets when a config is shown
+const redacted = "[redacted]"
+
+// Config is the settings of all commands
+type Config struct {
+	Server        string `yaml:"server" toml:"server" json:"server"` // N-Sight hostname without https://
+	APIKey        Secret `yaml:"api_key" toml:"api_key" json:"api_key"`
+	APIKeySource  string `yaml:"api_key_source" toml:"api_key_source" json:"api_key_source"` // See credentials.Parse, wins over api_key
+	InstancesFile string `yaml:"instances_file" toml:"instances_file" json:"instances_file"`
+	Instance      string `yaml:"instance" toml:"instance" json:"instance"` // Instance used by getdata and fetchall
+	DataDir       string `yaml:"data_dir" toml:"data_dir" json:"data_dir"` // fetchall cache, per instance below it
+
+	Client   Client   `yaml:"client" toml:"client" json:"client"`
+	Audit    Audit    `yaml:"audit" toml:"audit" json:"audit"`
+	Resolver Resolver `yaml:"resolver" toml:"resolver" json:"resolver"`
+	Proxy    Proxy    `yaml:"proxy" toml:"proxy" json:"proxy"`
+
+	File string `yaml:"-" toml:"-" json:"-"` // File the config was read from, empty if none
+}
+
+// Client configures calls to the N-Sight API
+type Client struct {
+	Timeout      Duration `yaml:"timeout" toml:"timeout" json:"timeout"`                   // Limit of one call
+	Retries      int      `yaml:"retries" toml:"retries" json:"retries"`                   // Repeats of failed read calls
+	RetryBackoff Duration `yaml:"retry_backoff" toml:"retry_backoff" json:"retry_backoff"` // First wait between repeats, doubled each time
+	RateLimit    float64  `yaml:"rate_limit" toml:"rate_limit" json:"rate_limit"`          // Calls per second, 0 for no limit
+	RateBurst    int      `yaml:"rate_burst" toml:"rate_burst" json:"rate_burst"`
+	ReadOnly     bool     `yaml:"readonly" toml:"readonly" json:"readonly"` // Refuse every call that changes data
+	Debug        bool     `yaml:"debug" toml:"debug" json:"debug"`          // Log the URL of every call, the key masked
+}
+
+// Audit configures the audit log of mutating calls
+type Audit struct {
+	Log string `yaml:"log" toml:"log" json:"log"` // File, "off" to disable
+	URL string `yaml:"url" toml:"url" json:"url"` // Optional HTTP collector
+}
+
+// Resolver configures the index used to resolve client, site and device names
+type Resolver struct {
+	TTL Duration `yaml:"ttl" toml:"ttl" json:"ttl"` // Age at which the index is rebuilt, 0 rebuilds it for every lookup
+}
+
+// Proxy configures nsight-proxy. The listener settings are also read from the
+// older JSON file named by NSIGHT_PROXY_CONFIG.
+type Proxy struct {
+	Listen          string   `yaml:"listen" toml:"listen" json:"listen"`                // TCP address, empty disables TCP
+	Port            int      `yaml:"port" toml:"port" json:"port"`                      // Overrides the port of Listen if set
+	TLSCert         string   `yaml:"tls_cert" toml:"tls_cert" json:"tls_cert"`          // Certificate file, reloaded when it changes
+	TLSKey          string   `yaml:"tls_key" toml:"tls_key" json:"tls_key"`             // Private key file
+	UnixSocket      string   `yaml:"unix_socket" toml:"unix_socket" json:"unix_socket"` // Optional unix socket path, served without TLS
+	ReadTimeout     Duration `yaml:"read_timeout" toml:"read_timeout" json:"read_timeout"`
+	WriteTimeout    Duration `yaml:"write_timeout" toml:"write_timeout" json:"write_timeout"`
+	IdleTimeout     Duration `yaml:"idle_timeout" toml:"idle_timeout" json:"idle_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" json:"shutdown_timeout"` // How long to wait for in-flight requests on shutdown
+	TenantsFile     string   `yaml:"tenants_file" toml:"tenants_file" json:"tenants_file"`
+
+	Cache    Cache    `yaml:"cache" toml:"cache" json:"cache"`
+	Events   Events   `yaml:"events" toml:"events" json:"events"`
+	Webhooks Webhooks `yaml:"webhooks" toml:"webhooks" json:"webhooks"`
+	Ready    Ready    `yaml:"ready" toml:"ready" json:"ready"`
+}
+
+// Cache configures the proxy's response cache
+type Cache struct {
+	TTL   TTLs     `yaml:"ttl" toml:"ttl" json:"ttl"`       // Per-service lifetimes, "default" for the rest
+	Stale Duration `yaml:"stale" toml:"stale" json:"stale"` // How long expired entries may still be served
+	Dir   string   `yaml:"dir" toml:"dir" json:"dir"`       // Persist entries here, memory only if empty
+}
+
+// Events configures the failing check poller behind /v1/events and webhooks
+type Events struct {
+	Interval Duration `yaml:"interval" toml:"interval" json:"interval"` // 0 disables the poller
+	History  int      `yaml:"history" toml:"history" json:"history"`    // Events kept for resuming clients
+}
+
+// Webhooks configures webhook delivery
+type Webhooks struct {
+	File       string   `yaml:"file" toml:"file" json:"file"` // Subscriptions, webhooks are off if empty
+	Attempts   int      `yaml:"attempts" toml:"attempts" json:"attempts"`
+	Backoff    Duration `yaml:"backoff" toml:"backoff" json:"backoff"`
+	DeadLetter string   `yaml:"dead_letter" toml:"dead_letter" json:"dead_letter"`
+}
+
+// Ready configures the checks behind /ready
+type Ready struct {
+	Service     string   `yaml:"service" toml:"service" json:"service"`
+	APIKey      Secret   `yaml:"api_key" toml:"api_key" json:"api_key"` // Probe key, the proxy's own key if empty
+	Interval    Duration `yaml:"interval" toml:"interval" json:"interval"`
+	MaxCacheAge Duration `yaml:"max_cache_age" toml:"max_cache_age" json:"max_cache_age"`
+}
+
+// Default returns the settings used when nothing is configured
+func Default() *Config {
+	return &Config{
+		DataDir: "data",
+		Client: Client{
+			Timeout:      Duration(60 * time.Second),
+			RetryBackoff: Duration(time.Second),
+		},
+		Audit:    Audit{Log: "audit.jsonl"},
+		Resolver: Resolver{TTL: Duration(24 * time.Hour)},
+		Proxy: Proxy{
+			Listen:          ":80",
+			ReadTimeout:     Duration(30 * time.Second),
+			WriteTimeout:    Duration(90 * time.Second),
+			IdleTimeout:     Duration(120 * time.Second),
+			ShutdownTimeout: Duration(30 * time.Second),
+			Cache:           Cache{Stale: Duration(time.Minute)},
+			Events:          Events{Interval: Duration(time.Minute), History: 1000},
+			Webhooks:        Webhooks{Attempts: 5, Backoff: Duration(time.Second), DeadLetter: "webhooks-dead.jsonl"},
+			Ready: Ready{
+				Service:     "list_clients",
+				Interval:    Duration(30 * time.Second),
+				MaxCacheAge: Duration(24 * time.Hour),
+			},
+		},
+	}
+}
+
+// Load builds the config from the file named by -config or NSIGHT_CONFIG
+// (otherwise nsight.yaml, nsight.yml or nsight.toml if present), the
+// environment and the flags registered with RegisterFlags. flags may be nil.
+func Load(flags *Flags) (*Config, error) {
+	// A missing .env is fine, the environment may be set directly
+	godotenv.Load()
+
+	cfg := Default()
+	path := os.Getenv("NSIGHT_CONFIG")
+	if flags != nil && flags.file != "" {
+		path = flags.file
+	}
+	// JSON files are the older nsight-proxy listener config, also given by NSIGHT_PROXY_CONFIG
+	legacy := os.Getenv("NSIGHT_PROXY_CONFIG")
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		path, legacy = "", path
+	}
+	if path == "" {
+		for _, name := range defaultFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+	}
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+		cfg.File = path
+	}
+	if legacy != "" {
+		if err := readProxyJSON(legacy, &cfg.Proxy); err != nil {
+			return nil, err
+		}
+		if cfg.File == "" {
+			cfg.File = legacy
+		}
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := s.apply(cfg, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", s.env, value)
+			}
+		}
+	}
+	if flags != nil {
+		if err := flags.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		if cfg.File != "" {
+			return nil, fmt.Errorf("%w (config file %s)", err, cfg.File)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile decodes a YAML or TOML file, rejecting unknown keys
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("failed to parse config file %s: unknown key %s", path, undecoded[0])
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// readProxyJSON applies the listener settings of an NSIGHT_PROXY_CONFIG file
+func readProxyJSON(path string, proxy *Proxy) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	// JSON is YAML, so the same decoder checks the keys
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(proxy); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks values that have no valid meaning
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.DataDir != "", "data_dir must not be empty")
+	check(c.Client.Timeout > 0, "client.timeout must be positive")
+	check(c.Client.Retries >= 0, "client.retries must not be negative")
+	check(c.Client.RetryBackoff >= 0, "client.retry_backoff must not be negative")
+	check(c.Client.RateLimit >= 0, "client.rate_limit must not be negative")
+	check(c.Client.RateBurst >= 0, "client.rate_burst must not be negative")
+	check(c.Resolver.TTL >= 0, "resolver.ttl must not be negative")
+
+	p := c.Proxy
+	check(p.Port >= 0 && p.Port <= 65535, "proxy.port must be between 0 and 65535")
+	check((p.TLSCert == "") == (p.TLSKey == ""), "proxy.tls_cert and proxy.tls_key must be set together")
+	check(p.Listen != "" || p.UnixSocket != "", "nothing to listen on, set proxy.listen or proxy.unix_socket")
+	for name, d := range map[string]Duration{
+		"proxy.read_timeout":        p.ReadTimeout,
+		"proxy.write_timeout":       p.WriteTimeout,
+		"proxy.idle_timeout":        p.IdleTimeout,
+		"proxy.shutdown_timeout":    p.ShutdownTimeout,
+		"proxy.cache.stale":         p.Cache.Stale,
+		"proxy.events.interval":     p.Events.Interval,
+		"proxy.ready.interval":      p.Ready.Interval,
+		"proxy.ready.max_cache_age": p.Ready.MaxCacheAge,
+	} {
+		check(d >= 0, "%s must not be negative", name)
+	}
+	for service, ttl := range p.Cache.TTL {
+		check(ttl >= 0, "proxy.cache.ttl of %s must not be negative", service)
+	}
+	check(p.Events.History >= 1, "proxy.events.history must be at least 1")
+	check(p.Webhooks.Attempts >= 1, "proxy.webhooks.attempts must be at least 1")
+	check(p.Webhooks.Backoff > 0, "proxy.webhooks.backoff must be positive")
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Redacted returns a copy with secrets replaced, for showing the config.
+// Credentials and query values of URLs in the key source and the audit
+// collector are replaced too.
+func (c *Config) Redacted() *Config {
+	clone := *c
+	clone.APIKey = clone.APIKey.redact()
+	clone.APIKeySource = redactURLs(clone.APIKeySource)
+	clone.Audit.URL = redactURLs(clone.Audit.URL)
+	clone.Proxy.Ready.APIKey = clone.Proxy.Ready.APIKey.redact()
+	return &clone
+}
+
+// Write encodes the config as "yaml", "toml" or "json". Secrets are written
+// as they are, use Redacted to hide them.
+func (c *Config) Write(w io.Writer, format string) error {
+	switch format {
+	case "yaml", "yml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		defer encoder.Close()
+		return encoder.Encode(c)
+	case "toml":
+		return toml.NewEncoder(w).Encode(c)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(c)
+	}
+	return fmt.Errorf("unknown format %q, use yaml, toml or json", format)
+}
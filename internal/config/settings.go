@@ -0,0 +1,162 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Scope selects which commands register a flag
+type Scope int
+
+const (
+	ScopeAll   Scope = iota // Every command
+	ScopeCLI                // getdata and fetchall
+	ScopeProxy              // nsight-proxy
+)
+
+// setting ties a config value to its environment variable and flag
+type setting struct {
+	key   string // Key in the config file
+	env   string // Environment variable, empty for none
+	flag  string // Command line flag, empty for none
+	scope Scope  // Commands that have the flag
+	usage string
+	field func(*Config) interface{} // Pointer to the value
+}
+
+// settings lists every value that can be overridden. Secrets have no flags,
+// since command lines are visible to other users.
+var settings = []setting{
+	{"server", "NSIGHT_SERVER", "server", ScopeAll, "N-Sight server hostname", func(c *Config) interface{} { return &c.Server }},
+	{"api_key", "NSIGHT_API_KEY", "", ScopeAll, "", func(c *Config) interface{} { return &c.APIKey }},
+	{"api_key_source", "NSIGHT_API_KEY_SOURCE", "api-key-source", ScopeAll, "API key source such as file:PATH or vault:PATH#FIELD", func(c *Config) interface{} { return &c.APIKeySource }},
+	{"instances_file", "NSIGHT_INSTANCES_FILE", "instances-file", ScopeAll, "JSON file defining N-Sight instances", func(c *Config) interface{} { return &c.InstancesFile }},
+	{"instance", "NSIGHT_INSTANCE", "instance", ScopeCLI, "N-Sight instance to use, \"all\" to merge every instance where supported", func(c *Config) interface{} { return &c.Instance }},
+	{"data_dir", "NSIGHT_DATA_DIR", "data-dir", ScopeAll, "Directory of the fetchall cache", func(c *Config) interface{} { return &c.DataDir }},
+
+	{"client.timeout", "NSIGHT_TIMEOUT", "timeout", ScopeAll, "Timeout of one N-Sight API call", func(c *Config) interface{} { return &c.Client.Timeout }},
+	{"client.retries", "NSIGHT_RETRIES", "retries", ScopeAll, "Repeats of read calls that failed with a transient error", func(c *Config) interface{} { return &c.Client.Retries }},
+	{"client.retry_backoff", "NSIGHT_RETRY_BACKOFF", "", ScopeAll, "", func(c *Config) interface{} { return &c.Client.RetryBackoff }},
+	{"client.rate_limit", "NSIGHT_RATE_LIMIT", "rate-limit", ScopeAll, "N-Sight API calls per second, 0 for no limit", func(c *Config) interface{} { return &c.Client.RateLimit }},
+	{"client.rate_burst", "NSIGHT_RATE_BURST", "", ScopeAll, "", func(c *Config) interface{} { return &c.Client.RateBurst }},
+	{"client.debug", "NSIGHT_DEBUG", "debug", ScopeAll, "Log the URL of every N-Sight API call, with the API key masked", func(c *Config) interface{} { return &c.Client.Debug }},
+	{"client.readonly", "NSIGHT_READONLY", "readonly", ScopeAll, "Refuse every call that changes data in N-Sight", func(c *Config) interface{} { return &c.Client.ReadOnly }},
+
+	{"audit.log", "NSIGHT_AUDIT_LOG", "", ScopeAll, "", func(c *Config) interface{} { return &c.Audit.Log }},
+	{"audit.url", "NSIGHT_AUDIT_URL", "", ScopeAll, "", func(c *Config) interface{} { return &c.Audit.URL }},
+	{"resolver.ttl", "NSIGHT_RESOLVER_TTL", "resolver-ttl", ScopeAll, "Age at which the name index is rebuilt, 0 to rebuild it for every lookup", func(c *Config) interface{} { return &c.Resolver.TTL }},
+
+	{"proxy.listen", "", "listen", ScopeProxy, "TCP listen address, empty to disable", func(c *Config) interface{} { return &c.Proxy.Listen }},
+	{"proxy.port", "", "port", ScopeProxy, "Port to listen on, overrides the port of -listen", func(c *Config) interface{} { return &c.Proxy.Port }},
+	{"proxy.tls_cert", "", "tls-cert", ScopeProxy, "TLS certificate file", func(c *Config) interface{} { return &c.Proxy.TLSCert }},
+	{"proxy.tls_key", "", "tls-key", ScopeProxy, "TLS private key file", func(c *Config) interface{} { return &c.Proxy.TLSKey }},
+	{"proxy.unix_socket", "", "unix-socket", ScopeProxy, "Also listen on this unix socket", func(c *Config) interface{} { return &c.Proxy.UnixSocket }},
+	{"proxy.read_timeout", "", "read-timeout", ScopeProxy, "Maximum time to read a request", func(c *Config) interface{} { return &c.Proxy.ReadTimeout }},
+	{"proxy.write_timeout", "", "write-timeout", ScopeProxy, "Maximum time to write a response", func(c *Config) interface{} { return &c.Proxy.WriteTimeout }},
+	{"proxy.idle_timeout", "", "idle-timeout", ScopeProxy, "Keep-alive idle timeout", func(c *Config) interface{} { return &c.Proxy.IdleTimeout }},
+	{"proxy.shutdown_timeout", "", "shutdown-timeout", ScopeProxy, "Time to drain in-flight requests on shutdown", func(c *Config) interface{} { return &c.Proxy.ShutdownTimeout }},
+	{"proxy.tenants_file", "NSIGHT_TENANTS_FILE", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.TenantsFile }},
+
+	{"proxy.cache.ttl", "NSIGHT_CACHE_TTL", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Cache.TTL }},
+	{"proxy.cache.stale", "NSIGHT_CACHE_STALE", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Cache.Stale }},
+	{"proxy.cache.dir", "NSIGHT_CACHE_DIR", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Cache.Dir }},
+	{"proxy.events.interval", "NSIGHT_EVENTS_INTERVAL", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Events.Interval }},
+	{"proxy.events.history", "NSIGHT_EVENTS_HISTORY", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Events.History }},
+	{"proxy.webhooks.file", "NSIGHT_WEBHOOKS_FILE", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Webhooks.File }},
+	{"proxy.webhooks.attempts", "NSIGHT_WEBHOOKS_ATTEMPTS", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Webhooks.Attempts }},
+	{"proxy.webhooks.backoff", "NSIGHT_WEBHOOKS_BACKOFF", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Webhooks.Backoff }},
+	{"proxy.webhooks.dead_letter", "NSIGHT_WEBHOOKS_DEAD_LETTER", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Webhooks.DeadLetter }},
+	{"proxy.ready.service", "NSIGHT_READY_SERVICE", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Ready.Service }},
+	{"proxy.ready.api_key", "NSIGHT_READY_API_KEY", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Ready.APIKey }},
+	{"proxy.ready.interval", "NSIGHT_READY_INTERVAL", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Ready.Interval }},
+	{"proxy.ready.max_cache_age", "NSIGHT_READY_MAX_CACHE_AGE", "", ScopeProxy, "", func(c *Config) interface{} { return &c.Proxy.Ready.MaxCacheAge }},
+}
+
+// apply parses value into the setting's field
+func (s setting) apply(c *Config, value string) error {
+	switch target := s.field(c).(type) {
+	case *string:
+		*target = value
+	case *Secret:
+		*target = Secret(value)
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*target = b
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*target = f
+	case *Duration:
+		return target.UnmarshalText([]byte(value))
+	case *TTLs:
+		// Services not named keep the lifetimes of the file
+		ttls, err := parseTTLs(value)
+		if err != nil {
+			return err
+		}
+		if *target == nil {
+			*target = make(TTLs)
+		}
+		for service, ttl := range ttls {
+			(*target)[service] = ttl
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", target)
+	}
+	return nil
+}
+
+// Flags holds the command line overrides until the config is loaded
+type Flags struct {
+	file   string
+	values map[string]string // Given flags by name, in the order of settings
+}
+
+// RegisterFlags adds -config and the override flags of scope to fs. Only
+// flags given on the command line override the file and the environment.
+func RegisterFlags(fs *flag.FlagSet, scope Scope) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	fs.StringVar(&f.file, "config", "", "Configuration file (YAML or TOML), default $NSIGHT_CONFIG or nsight.yaml")
+	for _, s := range settings {
+		if s.flag == "" || (s.scope != ScopeAll && s.scope != scope) {
+			continue
+		}
+		name := s.flag
+		set := func(value string) error {
+			f.values[name] = value
+			return nil
+		}
+		if _, ok := s.field(Default()).(*bool); ok {
+			fs.BoolFunc(name, s.usage, set)
+			continue
+		}
+		fs.Func(name, s.usage, set)
+	}
+	return f
+}
+
+// apply sets the values of the given flags
+func (f *Flags) apply(c *Config) error {
+	for _, s := range settings {
+		value, ok := f.values[s.flag]
+		if s.flag == "" || !ok {
+			continue
+		}
+		if err := s.apply(c, value); err != nil {
+			return fmt.Errorf("invalid -%s: %q", s.flag, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secret is a value that is never shown, e.g. an API key
+type Secret string
+
+// Value returns the secret itself
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String hides the secret from fmt and logs
+func (s Secret) String() string {
+	return string(s.redact())
+}
+
+// redact replaces a set secret with a placeholder
+func (s Secret) redact() Secret {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// urlPattern finds URLs in settings that may embed credentials, such as key
+// source specifications with a helper command
+var urlPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s'"]+`)
+
+// redactURLs replaces the user info and query values of URLs in s
+func redactURLs(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, redactURL)
+}
+
+// redactURL replaces the user info and query values of a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, url.QueryEscape(name)+"="+redacted)
+		}
+		sort.Strings(names)
+		u.RawQuery = strings.Join(names, "&")
+	}
+	if u.User == nil {
+		return u.String()
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://"+redacted+"@", 1)
+}
+
+// Duration is a time.Duration written as a string such as "30s"
+type Duration time.Duration
+
+// D returns the duration as a time.Duration
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// TTLs maps services to cache lifetimes. In the environment it is written
+// as "service=duration,service=duration".
+type TTLs map[string]Duration
+
+// parseTTLs reads the environment form
+func parseTTLs(spec string) (TTLs, error) {
+	ttls := make(TTLs)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		service, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache TTL %q, expected service=duration", part)
+		}
+		var ttl Duration
+		if err := ttl.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+			return nil, fmt.Errorf("invalid cache TTL for %s: %w", service, err)
+		}
+		ttls[strings.TrimSpace(service)] = ttl
+	}
+	return ttls, nil
+}
+
+// String returns the environment form, sorted by service
+func (t TTLs) String() string {
+	parts := make([]string, 0, len(t))
+	for service, ttl := range t {
+		parts = append(parts, service+"="+ttl.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,148 @@
+// Package credentials supplies N-Sight API keys from pluggable sources. A
+// provider is asked for the key on every call, so a rotated key is picked up
+// without restarting; slow sources are cached for a refresh interval.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRefresh is how long keys from commands and Vault are reused
+const defaultRefresh = 5 * time.Minute
+
+// Provider returns the current API key
+type Provider interface {
+	Key(ctx context.Context) (string, error)
+	String() string // Describes the source without revealing the key
+}
+
+// Static is a key given directly, e.g. with a request
+type Static string
+
+// Key returns the key itself
+func (s Static) Key(context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s Static) String() string {
+	return "static key"
+}
+
+// Env reads the key from an environment variable
+type Env string
+
+// Key returns the variable's value, which may be empty
+func (e Env) Key(context.Context) (string, error) {
+	return os.Getenv(string(e)), nil
+}
+
+func (e Env) String() string {
+	return "environment variable " + string(e)
+}
+
+// Parse creates a provider from a source specification:
+//
+//	env:NAME           environment variable
+//	file:PATH          file readable only by its owner
+//	encrypted:PATH     file encrypted with the passphrase in NSIGHT_KEY_PASSPHRASE
+//	exec:COMMAND ARGS  output of a helper command
+//	vault:PATH#FIELD   secret from a Vault-compatible API at VAULT_ADDR
+//
+// Keys from commands and Vault are reused for NSIGHT_KEY_REFRESH (default 5m).
+func Parse(spec string) (Provider, error) {
+	scheme, value, ok := strings.Cut(spec, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid key source %q, expected scheme:value", spec)
+	}
+	switch scheme {
+	case "env":
+		return Env(value), nil
+	case "file":
+		return NewFile(value), nil
+	case "encrypted":
+		passphrase := os.Getenv("NSIGHT_KEY_PASSPHRASE")
+		if passphrase == "" {
+			return nil, errors.New("key source encrypted: needs NSIGHT_KEY_PASSPHRASE")
+		}
+		return NewEncryptedFile(value, passphrase), nil
+	case "exec":
+		command := strings.Fields(value)
+		return cachedFromEnv(&Exec{Command: command})
+	case "vault":
+		vault, err := NewVault(value)
+		if err != nil {
+			return nil, err
+		}
+		return cachedFromEnv(vault)
+	}
+	return nil, fmt.Errorf("unknown key source %q, use env, file, encrypted, exec or vault", scheme)
+}
+
+// Select returns the provider of a configured key: source if set (see
+// Parse), otherwise the key itself
+func Select(source, key string) (Provider, error) {
+	if source != "" {
+		return Parse(source)
+	}
+	return Static(key), nil
+}
+
+// cachedFromEnv wraps p in a cache refreshed after NSIGHT_KEY_REFRESH
+func cachedFromEnv(p Provider) (Provider, error) {
+	refresh := defaultRefresh
+	if value := os.Getenv("NSIGHT_KEY_REFRESH"); value != "" {
+		var err error
+		refresh, err = time.ParseDuration(value)
+		if err != nil || refresh < 0 {
+			return nil, fmt.Errorf("invalid NSIGHT_KEY_REFRESH: %q", value)
+		}
+	}
+	return Cached(p, refresh), nil
+}
+
+// cached reuses the key of a slow provider for a refresh interval
+type cached struct {
+	provider Provider
+	refresh  time.Duration
+
+	mu      sync.Mutex
+	key     string
+	fetched time.Time
+}
+
+// Cached wraps p so its key is fetched at most once per refresh interval. If
+// a refresh fails, the previous key is kept until the source recovers.
+func Cached(p Provider, refresh time.Duration) Provider {
+	return &cached{provider: p, refresh: refresh}
+}
+
+// Key returns the cached key, fetching a new one when it is due
+func (c *cached) Key(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key != "" && time.Since(c.fetched) < c.refresh {
+		return c.key, nil
+	}
+	key, err := c.provider.Key(ctx)
+	if err != nil {
+		if c.key == "" {
+			return "", err
+		}
+		log.Printf("Warning: Failed to refresh API key from %s, keeping the previous key: %v", c.provider, err)
+		c.fetched = time.Now()
+		return c.key, nil
+	}
+	c.key, c.fetched = key, time.Now()
+	return key, nil
+}
+
+func (c *cached) String() string {
+	return c.provider.String()
+}
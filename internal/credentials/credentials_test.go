@@ -0,0 +1,58 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// sequence returns its keys in turn, an empty key meaning a failed fetch
+type sequence struct {
+	keys  []string
+	calls int
+}
+
+func (s *sequence) Key(context.Context) (string, error) {
+	key := s.keys[min(s.calls, len(s.keys)-1)]
+	s.calls++
+	if key == "" {
+		return "", errors.New("source unavailable")
+	}
+	return key, nil
+}
+
+func (s *sequence) String() string {
+	return "test sequence"
+}
+
+func TestCachedKeepsKeyOnFailedRefresh(t *testing.T) {
+	source := &sequence{keys: []string{"first", "", "second"}}
+	provider := Cached(source, 0) // Every call refreshes
+
+	for i, want := range []string{"first", "first", "second"} {
+		key, err := provider.Key(context.Background())
+		if err != nil || key != want {
+			t.Fatalf("call %d: Key = %q, %v, want %q", i+1, key, err, want)
+		}
+	}
+}
+
+func TestCachedFailsWithoutKey(t *testing.T) {
+	provider := Cached(&sequence{keys: []string{""}}, 0)
+	if key, err := provider.Key(context.Background()); err == nil {
+		t.Fatalf("Key = %q, want the source's error", key)
+	}
+}
+
+func TestCachedReusesKey(t *testing.T) {
+	source := &sequence{keys: []string{"first", "second"}}
+	provider := Cached(source, defaultRefresh)
+	for range 3 {
+		if key, err := provider.Key(context.Background()); err != nil || key != "first" {
+			t.Fatalf("Key = %q, %v, want first", key, err)
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("source was asked %d times within the refresh interval, want once", source.calls)
+	}
+}
@@ -0,0 +1,52 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execTimeout bounds a run of a helper command
+const execTimeout = 30 * time.Second
+
+// Exec runs a helper command, like a git credential helper, and uses the
+// first line of its output as the key
+type Exec struct {
+	Command []string
+}
+
+// Key runs the command
+func (e *Exec) Key(ctx context.Context) (string, error) {
+	if len(e.Command) == 0 {
+		return "", errors.New("key source exec: no command")
+	}
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("key helper %s failed: %w: %s", e.Command[0], err, msg)
+		}
+		return "", fmt.Errorf("key helper %s failed: %w", e.Command[0], err)
+	}
+	key, _, _ := strings.Cut(stdout.String(), "\n")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("key helper %s returned no key", e.Command[0])
+	}
+	return key, nil
+}
+
+func (e *Exec) String() string {
+	if len(e.Command) == 0 {
+		return "command"
+	}
+	return "command " + e.Command[0]
+}
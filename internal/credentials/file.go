@@ -0,0 +1,199 @@
+package credentials
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parameters of newly encrypted key files
+const (
+	encryptedVersion = 1
+	pbkdf2Iterations = 600000
+	saltSize         = 16
+)
+
+// keyFile reads a key from a file and reads it again only when the file
+// changes, so replacing the file rotates the key
+type keyFile struct {
+	path  string
+	parse func([]byte) (string, error)
+
+	mu      sync.Mutex
+	key     string
+	modTime time.Time
+	size    int64
+}
+
+// load returns the key, checking that only the owner can read the file
+func (f *keyFile) load() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 && runtime.GOOS != "windows" {
+		return "", fmt.Errorf("API key file %s has permissions %04o, it must not be accessible by group or others (chmod 600)", f.path, perm)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.key != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.key, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key: %w", err)
+	}
+	key, err := f.parse(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key from %s: %w", f.path, err)
+	}
+	f.key, f.modTime, f.size = key, info.ModTime(), info.Size()
+	return key, nil
+}
+
+// File reads the key from a plain text file
+type File struct {
+	file keyFile
+}
+
+// NewFile creates a provider for the key in path
+func NewFile(path string) *File {
+	return &File{file: keyFile{path: path, parse: func(data []byte) (string, error) {
+		return strings.TrimSpace(string(data)), nil
+	}}}
+}
+
+// Key returns the file's content without surrounding whitespace
+func (f *File) Key(context.Context) (string, error) {
+	return f.file.load()
+}
+
+func (f *File) String() string {
+	return "file " + f.file.path
+}
+
+// encryptedKey is the JSON content of an encrypted key file
+type encryptedKey struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptedFile reads the key from a file written by WriteEncrypted
+type EncryptedFile struct {
+	file keyFile
+}
+
+// NewEncryptedFile creates a provider for the key in path, encrypted with passphrase
+func NewEncryptedFile(path, passphrase string) *EncryptedFile {
+	return &EncryptedFile{file: keyFile{path: path, parse: func(data []byte) (string, error) {
+		return decrypt(data, passphrase)
+	}}}
+}
+
+// Key returns the decrypted key
+func (e *EncryptedFile) Key(context.Context) (string, error) {
+	return e.file.load()
+}
+
+func (e *EncryptedFile) String() string {
+	return "encrypted file " + e.file.path
+}
+
+// WriteEncrypted stores key in path, encrypted with AES-256-GCM under a key
+// derived from passphrase. The file is readable only by its owner.
+func WriteEncrypted(path, key, passphrase string) error {
+	if key == "" || passphrase == "" {
+		return errors.New("key and passphrase must not be empty")
+	}
+	enc := encryptedKey{Version: encryptedVersion, KDF: "pbkdf2-sha256", Iterations: pbkdf2Iterations, Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, enc.Salt, enc.Iterations)
+	if err != nil {
+		return err
+	}
+	enc.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(enc.Nonce); err != nil {
+		return err
+	}
+	enc.Ciphertext = aead.Seal(nil, enc.Nonce, []byte(key), nil)
+
+	data, err := json.MarshalIndent(enc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// decrypt returns the key from the content of an encrypted key file
+func decrypt(data []byte, passphrase string) (string, error) {
+	var enc encryptedKey
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return "", fmt.Errorf("not an encrypted key file: %w", err)
+	}
+	if enc.Version != encryptedVersion || enc.KDF != "pbkdf2-sha256" || enc.Iterations < 1 {
+		return "", fmt.Errorf("unsupported encrypted key file version %d", enc.Version)
+	}
+	aead, err := newAEAD(passphrase, enc.Salt, enc.Iterations)
+	if err != nil {
+		return "", err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return "", errors.New("invalid nonce")
+	}
+	key, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+	if err != nil {
+		return "", errors.New("wrong passphrase or corrupted file")
+	}
+	return string(key), nil
+}
+
+// newAEAD derives the file key from the passphrase
+func newAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var derived []byte
+	for block := uint32(1); len(derived) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:keyLen]
+}
@@ -0,0 +1,116 @@
+package credentials
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a key file with the given permissions through a rename,
+// the way rotation tools replace a key
+func writeKeyFile(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not checked on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "key")
+	writeKeyFile(t, path, "secret\n", 0o644)
+
+	file := NewFile(path)
+	if _, err := file.Key(context.Background()); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Fatalf("Key of a 0644 file = %v, want a permissions error", err)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := file.Key(context.Background())
+	if err != nil || key != "secret" {
+		t.Fatalf("Key of a 0600 file = %q, %v, want secret", key, err)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	writeKeyFile(t, path, "first-key\n", 0o600)
+
+	file := NewFile(path)
+	if key, err := file.Key(context.Background()); err != nil || key != "first-key" {
+		t.Fatalf("Key = %q, %v, want first-key", key, err)
+	}
+	writeKeyFile(t, path, "rotated-longer-key\n", 0o600)
+	if key, err := file.Key(context.Background()); err != nil || key != "rotated-longer-key" {
+		t.Fatalf("Key after replacing the file = %q, %v, want rotated-longer-key", key, err)
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.enc")
+	if err := WriteEncrypted(path, "api-key", "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "api-key") {
+		t.Fatal("encrypted file contains the key in plain text")
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+			t.Fatalf("encrypted file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+		}
+	}
+
+	key, err := NewEncryptedFile(path, "passphrase").Key(context.Background())
+	if err != nil || key != "api-key" {
+		t.Fatalf("Key = %q, %v, want api-key", key, err)
+	}
+	if _, err := decrypt(data, "wrong"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("decrypt with a wrong passphrase = %v, want a wrong passphrase error", err)
+	}
+	if _, err := decrypt([]byte("plain-key"), "passphrase"); err == nil {
+		t.Fatal("decrypt accepted a plain text file")
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		// RFC 7914, section 11
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		// RFC 6070 inputs with HMAC-SHA256
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, len(tt.want)/2))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
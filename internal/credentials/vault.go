@@ -0,0 +1,104 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultTimeout bounds a request to the Vault API
+const vaultTimeout = 10 * time.Second
+
+// defaultVaultField is the secret field read when the source names none
+const defaultVaultField = "api_key"
+
+// Vault reads the key from a HashiCorp Vault compatible HTTP API. Both KV
+// version 1 (PATH is mount/path) and version 2 (PATH is mount/data/path)
+// secrets are supported.
+type Vault struct {
+	Addr      string // Base URL, e.g. https://vault.example.com:8200
+	Token     string
+	Namespace string // Enterprise namespace, optional
+	Path      string // Secret path below /v1/
+	Field     string
+}
+
+// NewVault creates a provider for "PATH#FIELD" using VAULT_ADDR, VAULT_TOKEN
+// and VAULT_NAMESPACE
+func NewVault(spec string) (*Vault, error) {
+	path, field, _ := strings.Cut(spec, "#")
+	if field == "" {
+		field = defaultVaultField
+	}
+	v := &Vault{
+		Addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Path:      strings.Trim(path, "/"),
+		Field:     field,
+	}
+	if v.Addr == "" || v.Token == "" {
+		return nil, errors.New("key source vault: needs VAULT_ADDR and VAULT_TOKEN")
+	}
+	if v.Path == "" {
+		return nil, errors.New("key source vault: no secret path")
+	}
+	return v, nil
+}
+
+// vaultResponse is the part of a secret read response the provider uses
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// Key reads the secret and returns its field
+func (v *Vault) Key(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, vaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.Addr+"/v1/"+v.Path, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from Vault: %w", v.Path, err)
+	}
+	defer resp.Body.Close()
+
+	var body vaultResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("invalid Vault response for %s: %w", v.Path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body.Errors) > 0 {
+			return "", fmt.Errorf("Vault returned %d for %s: %s", resp.StatusCode, v.Path, strings.Join(body.Errors, "; "))
+		}
+		return "", fmt.Errorf("Vault returned %d for %s", resp.StatusCode, v.Path)
+	}
+
+	// KV version 2 nests the fields in data.data
+	fields := body.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+	key, _ := fields[v.Field].(string)
+	if key == "" {
+		return "", fmt.Errorf("Vault secret %s has no field %s", v.Path, v.Field)
+	}
+	return key, nil
+}
+
+func (v *Vault) String() string {
+	return "Vault secret " + v.Path + "#" + v.Field
+}
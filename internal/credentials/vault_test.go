@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// vaultStandIn serves KV version 1 and 2 secrets to requests with the right token
+func vaultStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/nsight":
+			if r.Header.Get("X-Vault-Namespace") != "team" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			w.Write([]byte(`{"data":{"data":{"api_key":"kv2-key","other":"x"},"metadata":{"version":3}}}`))
+		case "/v1/kv/nsight":
+			w.Write([]byte(`{"data":{"key":"kv1-key"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVault(t *testing.T) {
+	server := vaultStandIn(t)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_NAMESPACE", "team")
+
+	tests := []struct {
+		spec    string
+		token   string
+		want    string
+		wantErr string
+	}{
+		{spec: "secret/data/nsight", token: "token", want: "kv2-key"},
+		{spec: "/kv/nsight#key", token: "token", want: "kv1-key"},
+		{spec: "secret/data/nsight#missing", token: "token", wantErr: "has no field missing"},
+		{spec: "secret/data/other", token: "token", wantErr: "Vault returned 404"},
+		{spec: "secret/data/nsight", token: "wrong", wantErr: "permission denied"},
+	}
+	for _, tt := range tests {
+		t.Setenv("VAULT_TOKEN", tt.token)
+		vault, err := NewVault(tt.spec)
+		if err != nil {
+			t.Fatalf("NewVault(%q): %v", tt.spec, err)
+		}
+		key, err := vault.Key(context.Background())
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s with token %s: Key = %q, %v, want error containing %q", tt.spec, tt.token, key, err, tt.wantErr)
+			}
+		case err != nil || key != tt.want:
+			t.Errorf("%s: Key = %q, %v, want %q", tt.spec, key, err, tt.want)
+		}
+	}
+}
+
+func TestNewVaultNeedsAddress(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "token")
+	if _, err := NewVault("secret/data/nsight"); err == nil {
+		t.Fatal("NewVault accepted a missing VAULT_ADDR")
+	}
+}
+
+func TestParseVault(t *testing.T) {
+	server := vaultStandIn(t)
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	t.Setenv("VAULT_NAMESPACE", "")
+	t.Setenv("NSIGHT_KEY_REFRESH", "1m")
+
+	provider, err := Parse("vault:kv/nsight#key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := provider.Key(context.Background()); err != nil || key != "kv1-key" {
+		t.Fatalf("Key = %q, %v, want kv1-key", key, err)
+	}
+	if s := provider.String(); s != "Vault secret kv/nsight#key" {
+		t.Errorf("String = %q", s)
+	}
+}
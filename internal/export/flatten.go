@@ -0,0 +1,380 @@
+// Package export converts JSON results into tabular formats such as CSV and
+// XLSX and streams lists as newline-delimited JSON.
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Table is a flattened result with one row per leaf record
+type Table struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Flatten turns a JSON document into a table using these rules:
+//   - nested objects become dotted columns (asset_details.Manufacturer)
+//   - lists of objects are expanded into separate rows that repeat the parent
+//     columns; sibling lists (e.g. Hardware and Software) add rows one after
+//     another instead of multiplying each other
+//   - lists of scalars are joined with "; "
+//   - XMLName fields are dropped
+//   - custom fields ({Name, Value}) become a column with the value and a
+//     ".Name" column with the field's name
+//
+// Columns keep the order in which they first appear in the document.
+func Flatten(body []byte) (*Table, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("result is not valid JSON: %w", err)
+	}
+	order, err := pathOrder(body)
+	if err != nil {
+		return nil, err
+	}
+	f := &flattener{position: positions(order)}
+
+	var rows []map[string]string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			rows = append(rows, f.flatten(item, "")...)
+		}
+	case map[string]interface{}:
+		// Aggregate responses carry their list in items
+		if items, ok := v["items"].([]interface{}); ok {
+			f.position = positions(stripItemsPrefix(order))
+			for _, item := range items {
+				rows = append(rows, f.flatten(item, "")...)
+			}
+		} else {
+			rows = f.flatten(v, "")
+		}
+	default:
+		rows = []map[string]string{{"value": scalarString(v)}}
+	}
+
+	return buildTable(rows, f.position), nil
+}
+
+// positions indexes paths by their first appearance
+func positions(order []string) map[string]int {
+	position := make(map[string]int, len(order))
+	for i, path := range order {
+		if _, seen := position[path]; !seen {
+			position[path] = i
+		}
+	}
+	return position
+}
+
+// stripItemsPrefix drops the items. prefix of aggregate response paths
+func stripItemsPrefix(order []string) []string {
+	stripped := make([]string, 0, len(order))
+	for _, path := range order {
+		if rest, ok := strings.CutPrefix(path, "items."); ok {
+			stripped = append(stripped, rest)
+		}
+	}
+	return stripped
+}
+
+// buildTable orders the columns by their first appearance and fills the rows
+func buildTable(rows []map[string]string, position map[string]int) *Table {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, row := range rows {
+		for column := range row {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.SliceStable(columns, func(i, j int) bool {
+		pi, okI := position[columns[i]]
+		pj, okJ := position[columns[j]]
+		switch {
+		case okI && okJ:
+			return pi < pj
+		case okI != okJ:
+			return okI
+		}
+		return columns[i] < columns[j]
+	})
+
+	table := &Table{Columns: columns}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		table.Rows = append(table.Rows, record)
+	}
+	return table
+}
+
+// joinPath appends a key to a dotted column prefix
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// isCustomField reports whether an object is a custom field with only a name and a value
+func isCustomField(obj map[string]interface{}) bool {
+	if len(obj) != 2 {
+		return false
+	}
+	_, hasName := obj["Name"]
+	_, hasValue := obj["Value"]
+	return hasName && hasValue
+}
+
+// flattener holds the document order used to keep rows and columns stable
+type flattener struct {
+	position map[string]int
+}
+
+// orderedKeys returns the keys of obj in document order
+func (f *flattener) orderedKeys(obj map[string]interface{}, prefix string) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, okI := f.position[joinPath(prefix, keys[i])]
+		pj, okJ := f.position[joinPath(prefix, keys[j])]
+		if okI && okJ && pi != pj {
+			return pi < pj
+		}
+		if okI != okJ {
+			return okI
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// flatten returns the rows of one value under the given column prefix
+func (f *flattener) flatten(value interface{}, prefix string) []map[string]string {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		column := prefix
+		if column == "" {
+			column = "value"
+		}
+		return []map[string]string{{column: scalarString(value)}}
+	}
+
+	base := make(map[string]string)
+	var expansions [][]map[string]string
+
+	for _, key := range f.orderedKeys(obj, prefix) {
+		field := obj[key]
+		if key == "XMLName" {
+			continue
+		}
+		path := joinPath(prefix, key)
+		switch v := field.(type) {
+		case map[string]interface{}:
+			if isCustomField(v) {
+				base[path] = scalarString(v["Value"])
+				base[path+".Name"] = scalarString(v["Name"])
+				continue
+			}
+			nested := f.flatten(v, path)
+			if len(nested) == 1 {
+				for column, text := range nested[0] {
+					base[column] = text
+				}
+			} else {
+				expansions = append(expansions, nested)
+			}
+		case []interface{}:
+			if !containsObjects(v) {
+				base[path] = joinScalars(v)
+				continue
+			}
+			var childRows []map[string]string
+			for _, item := range v {
+				childRows = append(childRows, f.flatten(item, path)...)
+			}
+			if len(childRows) > 0 {
+				expansions = append(expansions, childRows)
+			}
+		default:
+			base[path] = scalarString(v)
+		}
+	}
+
+	if len(expansions) == 0 {
+		return []map[string]string{base}
+	}
+	var rows []map[string]string
+	for _, expansion := range expansions {
+		for _, child := range expansion {
+			row := make(map[string]string, len(base)+len(child))
+			for column, text := range base {
+				row[column] = text
+			}
+			for column, text := range child {
+				row[column] = text
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// containsObjects reports whether a list holds objects rather than scalars
+func containsObjects(list []interface{}) bool {
+	for _, item := range list {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			return true
+		}
+	}
+	return false
+}
+
+// joinScalars renders a list of scalars as a single cell
+func joinScalars(list []interface{}) string {
+	parts := make([]string, len(list))
+	for i, item := range list {
+		parts[i] = scalarString(item)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// scalarString renders a JSON scalar as cell text
+func scalarString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	}
+	return fmt.Sprint(value)
+}
+
+// pathOrder lists the dotted paths of a JSON document in the order they appear
+func pathOrder(body []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var order []string
+	seen := make(map[string]bool)
+
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := token.(json.Delim)
+		if !ok {
+			return nil
+		}
+		switch delim {
+		case '{':
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				path := joinPath(prefix, keyToken.(string))
+				if !seen[path] {
+					seen[path] = true
+					order = append(order, path)
+				}
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for decoder.More() {
+				if err := walk(prefix); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = decoder.Token() // closing delimiter
+		return err
+	}
+
+	if err := walk(""); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("result is not valid JSON: %w", err)
+	}
+	return order, nil
+}
+
+// Reorder moves the columns selected by fields to the front in the order the
+// fields are given. A field also selects the columns nested below it, and names
+// match regardless of case and underscores like list queries do.
+func (t *Table) Reorder(fields []string) {
+	rank := func(column string) int { return fieldRank(fields, column) }
+	index := make([]int, len(t.Columns))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		return rank(t.Columns[index[a]]) < rank(t.Columns[index[b]])
+	})
+
+	columns := make([]string, len(index))
+	for i, from := range index {
+		columns[i] = t.Columns[from]
+	}
+	t.Columns = columns
+	for r, row := range t.Rows {
+		reordered := make([]string, len(index))
+		for i, from := range index {
+			reordered[i] = row[from]
+		}
+		t.Rows[r] = reordered
+	}
+}
+
+// Select keeps only the columns selected by fields, in the order the fields
+// are given, matching names like Reorder
+func (t *Table) Select(fields []string) {
+	t.Reorder(fields)
+	keep := 0
+	for keep < len(t.Columns) && fieldRank(fields, t.Columns[keep]) < len(fields) {
+		keep++
+	}
+	t.Columns = t.Columns[:keep]
+	for r := range t.Rows {
+		t.Rows[r] = t.Rows[r][:keep]
+	}
+}
+
+// fieldRank returns the index of the field selecting column, or len(fields)
+// if none does
+func fieldRank(fields []string, column string) int {
+	normalize := func(name string) string {
+		return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	}
+	column = normalize(column)
+	for i, field := range fields {
+		field = normalize(field)
+		if column == field || strings.HasPrefix(column, field+".") {
+			return i
+		}
+	}
+	return len(fields)
+}
@@ -0,0 +1,95 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// WriteCSV writes the table with a header row using the given field separator
+func WriteCSV(w io.Writer, table *Table, separator rune) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = separator
+	if err := writer.Write(table.Columns); err != nil {
+		return err
+	}
+	for _, row := range table.Rows {
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// StreamNDJSON writes the items of a list result one JSON document per line,
+// calling flush after each line. A top-level array or the items array of an
+// object is streamed; any other value is written as a single line.
+func StreamNDJSON(w io.Writer, body []byte, flush func()) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("result is not valid JSON: %w", err)
+	}
+	switch token {
+	case json.Delim('['):
+		return streamItems(w, decoder, flush)
+	case json.Delim('{'):
+		// Stream the items of an aggregate response, skipping its metadata
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if key == "items" {
+				if open, err := decoder.Token(); err != nil || open != json.Delim('[') {
+					break
+				}
+				return streamItems(w, decoder, flush)
+			}
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Not a list: the whole body is one record
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("result is not valid JSON: %w", err)
+	}
+	return writeLine(w, value, flush)
+}
+
+// streamItems writes the remaining elements of an opened JSON array
+func streamItems(w io.Writer, decoder *json.Decoder, flush func()) error {
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return err
+		}
+		if err := writeLine(w, item, flush); err != nil {
+			return err
+		}
+	}
+	_, err := decoder.Token()
+	return err
+}
+
+// writeLine encodes one value as a compact JSON line
+func writeLine(w io.Writer, value interface{}, flush func()) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	if flush != nil {
+		flush()
+	}
+	return nil
+}
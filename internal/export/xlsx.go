@@ -0,0 +1,158 @@
+package export
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xlsxStatic are the workbook parts that do not depend on the data
+var xlsxStatic = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// Style 1 is the bold header row
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+// maxSheetNameLength is the longest worksheet name Excel accepts
+const maxSheetNameLength = 31
+
+// WriteXLSX writes the table as a single-sheet Excel workbook. Numeric cells
+// are stored as numbers, everything else as inline strings.
+func WriteXLSX(w io.Writer, table *Table, sheetName string) error {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxStatic {
+		if err := writeZipPart(archive, part.name, part.body); err != nil {
+			return err
+		}
+	}
+
+	sheetName = strings.NewReplacer("[", "", "]", "", ":", "", "*", "", "?", "", "/", "", `\`, "").Replace(sheetName)
+	if len(sheetName) > maxSheetNameLength {
+		sheetName = sheetName[:maxSheetNameLength]
+	}
+	if sheetName == "" {
+		sheetName = "Sheet1"
+	}
+	workbook := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="` + escapeXML(sheetName) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	if err := writeZipPart(archive, "xl/workbook.xml", workbook); err != nil {
+		return err
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	// Keep the header visible while scrolling
+	b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	b.WriteString(`<sheetData>`)
+	writeSheetRow(&b, 1, table.Columns, true)
+	for i, row := range table.Rows {
+		writeSheetRow(&b, i+2, row, false)
+		// Flush periodically so large tables are not held twice in memory
+		if b.Len() > 64*1024 {
+			if _, err := io.WriteString(sheet, b.String()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	if _, err := io.WriteString(sheet, b.String()); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeZipPart adds a file with the given content to the archive
+func writeZipPart(archive *zip.Writer, name, body string) error {
+	part, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(part, body)
+	return err
+}
+
+// writeSheetRow appends one row of cells to the sheet XML
+func writeSheetRow(b *strings.Builder, number int, cells []string, header bool) {
+	fmt.Fprintf(b, `<row r="%d">`, number)
+	for i, value := range cells {
+		ref := columnName(i) + strconv.Itoa(number)
+		switch {
+		case header:
+			fmt.Fprintf(b, `<c r="%s" s="1" t="inlineStr"><is><t>%s</t></is></c>`, ref, escapeXML(value))
+		case value == "":
+			continue
+		case isNumeric(value):
+			fmt.Fprintf(b, `<c r="%s"><v>%s</v></c>`, ref, value)
+		default:
+			fmt.Fprintf(b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, escapeXML(value))
+		}
+	}
+	b.WriteString(`</row>`)
+}
+
+// columnName converts a zero-based index to a spreadsheet column (0 -> A, 26 -> AA)
+func columnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// isNumeric reports whether a cell can be stored as a number without losing
+// information. Identifiers with leading zeros and very long digit strings
+// (serial numbers) stay text.
+func isNumeric(value string) bool {
+	if len(value) > 15 || (len(value) > 1 && value[0] == '0' && value[1] != '.') {
+		return false
+	}
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil && !strings.ContainsAny(value, "xXpPnN_")
+}
+
+// escapeXML escapes text for use in element content and attributes, dropping
+// characters that XML 1.0 does not allow
+func escapeXML(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != 0xFFFE && r != 0xFFFF) {
+			return r
+		}
+		return -1
+	}, value)))
+	return b.String()
+}
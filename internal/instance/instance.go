@@ -0,0 +1,199 @@
+// Package instance describes the N-Sight servers and accounts the tools can
+// work with. Without an instances file there is a single instance built
+// from the configured server and key, as before instances existed.
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/nsight"
+)
+
+// DefaultName is the name of the instance built from the configured server
+const DefaultName = "default"
+
+// All selects every instance where a command supports merging their results
+const All = "all"
+
+// validName keeps instance names usable in paths and URLs
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Instance is one N-Sight server and account
+type Instance struct {
+	Name         string `json:"name"`
+	Server       string `json:"server"`
+	APIKey       string `json:"api_key,omitempty"`
+	APIKeyEnv    string `json:"api_key_env,omitempty"`    // Environment variable holding the key
+	APIKeyFile   string `json:"api_key_file,omitempty"`   // File holding the key, readable only by its owner
+	APIKeySource string `json:"api_key_source,omitempty"` // Any key source, see credentials.Parse
+	CacheDir     string `json:"cache_dir,omitempty"`      // fetchall cache, data/<name> by default
+	Default      bool   `json:"default,omitempty"`        // Used when no instance is selected
+
+	provider credentials.Provider
+}
+
+// Provider returns the source of the instance's API key, the first of
+// api_key, api_key_source, api_key_env and api_key_file that is set
+func (i *Instance) Provider() (credentials.Provider, error) {
+	if i.provider != nil {
+		return i.provider, nil
+	}
+	var err error
+	switch {
+	case i.APIKey != "":
+		i.provider = credentials.Static(i.APIKey)
+	case i.APIKeySource != "":
+		i.provider, err = credentials.Parse(i.APIKeySource)
+	case i.APIKeyEnv != "":
+		i.provider = credentials.Env(i.APIKeyEnv)
+	case i.APIKeyFile != "":
+		i.provider = credentials.NewFile(i.APIKeyFile)
+	default:
+		i.provider = credentials.Static("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %w", i.Name, err)
+	}
+	return i.provider, nil
+}
+
+// Client creates an API client for the instance. The client reads the key
+// from the instance's source on every call.
+func (i *Instance) Client() (*nsight.ApiClient, error) {
+	provider, err := i.Provider()
+	if err != nil {
+		return nil, err
+	}
+	if i.Server == "" {
+		return nil, fmt.Errorf("instance %s needs a server", i.Name)
+	}
+	client, err := nsight.NewApiClientWithProvider(provider, i.Server)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %w", i.Name, err)
+	}
+	return client, nil
+}
+
+// Set is the configured instances
+type Set struct {
+	list       []*Instance
+	byName     map[string]*Instance
+	def        *Instance
+	configured bool // Loaded from an instances file
+}
+
+// Load reads the instances from the JSON file named by instances_file, or
+// builds the single default instance from the configured server and key.
+// The fetchall cache of each instance is below data_dir.
+func Load(cfg *config.Config) (*Set, error) {
+	file := cfg.InstancesFile
+	if file == "" {
+		provider, err := credentials.Select(cfg.APIKeySource, cfg.APIKey.Value())
+		if err != nil {
+			return nil, err
+		}
+		return newSet([]*Instance{{
+			Name:     DefaultName,
+			Server:   cfg.Server,
+			CacheDir: cfg.DataDir,
+			provider: provider,
+		}}, cfg.DataDir, false)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instances file %s: %w", file, err)
+	}
+	var list []*Instance
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse instances file %s: %w", file, err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("instances file %s defines no instances", file)
+	}
+	return newSet(list, cfg.DataDir, true)
+}
+
+// newSet validates the instances and picks the default. Instances without a
+// cache directory get a subdirectory of baseCacheDir.
+func newSet(list []*Instance, baseCacheDir string, configured bool) (*Set, error) {
+	s := &Set{list: list, byName: make(map[string]*Instance), configured: configured}
+	for _, inst := range list {
+		if configured {
+			if !validName.MatchString(inst.Name) || inst.Name == All {
+				return nil, fmt.Errorf("invalid instance name %q, use lowercase letters, digits, - and _", inst.Name)
+			}
+			if inst.Server == "" {
+				return nil, fmt.Errorf("instance %s has no server", inst.Name)
+			}
+		}
+		if _, dup := s.byName[inst.Name]; dup {
+			return nil, fmt.Errorf("instance %s is defined twice", inst.Name)
+		}
+		if inst.CacheDir == "" {
+			inst.CacheDir = filepath.Join(baseCacheDir, inst.Name)
+		}
+		s.byName[inst.Name] = inst
+		if inst.Default {
+			if s.def != nil {
+				return nil, errors.New("only one instance may be the default")
+			}
+			s.def = inst
+		}
+	}
+	if s.def == nil {
+		s.def = list[0]
+	}
+	return s, nil
+}
+
+// Configured reports whether the instances come from a file
+func (s *Set) Configured() bool {
+	return s.configured
+}
+
+// List returns all instances in file order
+func (s *Set) List() []*Instance {
+	return s.list
+}
+
+// Default returns the instance used when none is selected
+func (s *Set) Default() *Instance {
+	return s.def
+}
+
+// Get returns the named instance, or the default one for an empty name
+func (s *Set) Get(name string) (*Instance, error) {
+	if name == "" {
+		return s.def, nil
+	}
+	if inst, ok := s.byName[name]; ok {
+		return inst, nil
+	}
+	names := make([]string, len(s.list))
+	for i, inst := range s.list {
+		names[i] = inst.Name
+	}
+	return nil, fmt.Errorf("unknown instance %q, configured: %s", name, strings.Join(names, ", "))
+}
+
+// Select returns the named instance, every instance for All, or the default
+// instance for an empty name
+func (s *Set) Select(name string) ([]*Instance, error) {
+	if name == All {
+		return s.list, nil
+	}
+	inst, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return []*Instance{inst}, nil
+}
@@ -0,0 +1,73 @@
+package inventory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Device types of a DeviceLocation
+const (
+	DeviceServer      = "server"
+	DeviceWorkstation = "workstation"
+)
+
+// DeviceLocation places a device in the client and site tree
+type DeviceLocation struct {
+	DeviceID   int    `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	DeviceType string `json:"device_type"` // DeviceServer or DeviceWorkstation
+	ClientID   int    `json:"client_id"`
+	ClientName string `json:"client_name"`
+	SiteID     int    `json:"site_id"`
+	SiteName   string `json:"site_name"`
+	Match      string `json:"match,omitempty"` // Field ResolveDevice matched on
+}
+
+// AmbiguousError is returned when an identifier matches several devices
+type AmbiguousError struct {
+	Identifier string
+	Candidates []DeviceLocation
+}
+
+func (e *AmbiguousError) Error() string {
+	names := make([]string, len(e.Candidates))
+	for i, c := range e.Candidates {
+		names[i] = fmt.Sprintf("%d %s (%s / %s)", c.DeviceID, c.DeviceName, c.ClientName, c.SiteName)
+	}
+	return fmt.Sprintf("%q matches %d devices, use an ID: %s", e.Identifier, len(e.Candidates), strings.Join(names, ", "))
+}
+
+// FindDevice looks up a server or workstation by ID or case-insensitive name.
+// It returns nil without an error if a numeric ID is not in the tree.
+func FindDevice(clients []ClientDetail, identifier string) (*DeviceLocation, error) {
+	var matches []DeviceLocation
+	for _, client := range clients {
+		for _, site := range client.Sites {
+			location := DeviceLocation{ClientID: client.ID, ClientName: client.Name, SiteID: site.ID, SiteName: site.Name}
+			for _, server := range site.Servers {
+				if matchesIdentifier(server.ID, server.Name, identifier) {
+					location.DeviceID, location.DeviceName, location.DeviceType = server.ID, server.Name, DeviceServer
+					matches = append(matches, location)
+				}
+			}
+			for _, workstation := range site.Workstations {
+				if matchesIdentifier(workstation.ID, workstation.Name, identifier) {
+					location.DeviceID, location.DeviceName, location.DeviceType = workstation.ID, workstation.Name, DeviceWorkstation
+					matches = append(matches, location)
+				}
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		if _, err := strconv.Atoi(identifier); err == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no device named %q in the fetchall cache", identifier)
+	case 1:
+		return &matches[0], nil
+	}
+	return nil, &AmbiguousError{Identifier: identifier, Candidates: matches}
+}
@@ -0,0 +1,136 @@
+package inventory
+
+import (
+	"strconv"
+	"strings"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// matchesName reports whether value contains the query, ignoring case.
+// An empty query matches everything.
+func matchesName(value, query string) bool {
+	return query == "" || strings.Contains(strings.ToLower(value), strings.ToLower(query))
+}
+
+// matchesIdentifier reports whether an entity matches an ID or a case-insensitive name
+func matchesIdentifier(id int, name, identifier string) bool {
+	if identifier == "" {
+		return true
+	}
+	if n, err := strconv.Atoi(identifier); err == nil {
+		return n == id
+	}
+	return strings.EqualFold(name, identifier)
+}
+
+// FilterClients keeps the clients accepted by keep
+func FilterClients(clients []ClientDetail, keep func(ClientDetail) bool) []ClientDetail {
+	result := []ClientDetail{}
+	for _, client := range clients {
+		if keep(client) {
+			result = append(result, client)
+		}
+	}
+	return result
+}
+
+// Select narrows the tree to a client and site given by ID or name. Empty
+// identifiers select everything.
+func Select(clients []ClientDetail, clientIdentifier, siteIdentifier string) []ClientDetail {
+	result := []ClientDetail{}
+	for _, client := range clients {
+		if !matchesIdentifier(client.ID, client.Name, clientIdentifier) {
+			continue
+		}
+		if siteIdentifier != "" {
+			sites := []SiteDetail{}
+			for _, site := range client.Sites {
+				if matchesIdentifier(site.ID, site.Name, siteIdentifier) {
+					sites = append(sites, site)
+				}
+			}
+			if len(sites) == 0 {
+				continue
+			}
+			client.Sites = sites
+		}
+		result = append(result, client)
+	}
+	return result
+}
+
+// pruneAssets rewrites the asset details of every device with trim and drops
+// devices, sites and clients left without assets
+func pruneAssets(clients []ClientDetail, trim func(nsight.AssetDetails) (nsight.AssetDetails, bool)) []ClientDetail {
+	result := []ClientDetail{}
+	for _, client := range clients {
+		sites := []SiteDetail{}
+		for _, site := range client.Sites {
+			servers := []ServerDetail{}
+			for _, server := range site.Servers {
+				if server.AssetInfo == nil {
+					continue
+				}
+				if assets, ok := trim(*server.AssetInfo); ok {
+					server.AssetInfo = &assets
+					servers = append(servers, server)
+				}
+			}
+			workstations := []WorkstationDetail{}
+			for _, ws := range site.Workstations {
+				if ws.AssetInfo == nil {
+					continue
+				}
+				if assets, ok := trim(*ws.AssetInfo); ok {
+					ws.AssetInfo = &assets
+					workstations = append(workstations, ws)
+				}
+			}
+			if len(servers) == 0 && len(workstations) == 0 {
+				continue
+			}
+			site.Servers = servers
+			site.Workstations = workstations
+			sites = append(sites, site)
+		}
+		if len(sites) == 0 {
+			continue
+		}
+		client.Sites = sites
+		result = append(result, client)
+	}
+	return result
+}
+
+// FilterSoftware keeps devices with software whose name contains name and
+// reduces their asset details to the matching software
+func FilterSoftware(clients []ClientDetail, name string) []ClientDetail {
+	return pruneAssets(clients, func(assets nsight.AssetDetails) (nsight.AssetDetails, bool) {
+		var matched []nsight.SoftwareItem
+		for _, item := range assets.Software {
+			if matchesName(item.Name, name) {
+				matched = append(matched, item)
+			}
+		}
+		assets.Software = matched
+		assets.Hardware = nil
+		return assets, len(matched) > 0
+	})
+}
+
+// FilterHardware keeps devices with hardware whose name contains name and
+// reduces their asset details to the matching hardware
+func FilterHardware(clients []ClientDetail, name string) []ClientDetail {
+	return pruneAssets(clients, func(assets nsight.AssetDetails) (nsight.AssetDetails, bool) {
+		var matched []nsight.HardwareItem
+		for _, item := range assets.Hardware {
+			if matchesName(item.Name, name) {
+				matched = append(matched, item)
+			}
+		}
+		assets.Hardware = matched
+		assets.Software = nil
+		return assets, len(matched) > 0
+	})
+}
@@ -0,0 +1,447 @@
+// Package inventory reads the CSV cache written by fetchall and rebuilds the
+// nested client, site and device structure from it.
+package inventory
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// FormatUnixTimestamp converts a Unix timestamp string to "DD.MM.YYYY HH:MM:SS" format.
+// Returns an empty string if the input is invalid or conversion fails.
+func FormatUnixTimestamp(timestampStr string) string {
+	if timestampStr == "" {
+		return ""
+	}
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		log.Printf("Warning: Failed to parse timestamp '%s': %v", timestampStr, err)
+		return "" // Or return timestampStr ? Or a placeholder like "Invalid Date"?
+	}
+	if timestamp == 0 { // Often used as a nil time value
+		return ""
+	}
+	t := time.Unix(timestamp, 0)
+	return t.Format("02.01.2006 15:04:05")
+}
+
+// --- Output Structures for Nested JSON ---
+
+// ServerDetail is a server with its optional asset details
+type ServerDetail struct {
+	ID           int                  `json:"server_id"`
+	Name         string               `json:"server_name"`
+	Online       bool                 `json:"online"`
+	OS           string               `json:"os,omitempty"`
+	IP           string               `json:"ip,omitempty"`
+	User         string               `json:"user,omitempty"`
+	Manufacturer string               `json:"manufacturer,omitempty"`
+	Model        string               `json:"model,omitempty"`
+	DeviceSerial string               `json:"serial_number,omitempty"`
+	LastBootTime string               `json:"last_boot_time,omitempty"`
+	AssetInfo    *nsight.AssetDetails `json:"asset_details,omitempty"`
+}
+
+// WorkstationDetail is a workstation with its optional asset details
+type WorkstationDetail struct {
+	ID           int                  `json:"workstation_id"`
+	Name         string               `json:"workstation_name"`
+	Online       bool                 `json:"online"`
+	OS           string               `json:"os,omitempty"`
+	IP           string               `json:"ip,omitempty"`
+	User         string               `json:"user,omitempty"`
+	Manufacturer string               `json:"manufacturer,omitempty"`
+	Model        string               `json:"model,omitempty"`
+	DeviceSerial string               `json:"serial_number,omitempty"`
+	LastBootTime string               `json:"last_boot_time,omitempty"`
+	AssetInfo    *nsight.AssetDetails `json:"asset_details,omitempty"`
+}
+
+// SiteDetail is a site with its servers and workstations
+type SiteDetail struct {
+	ID           int                 `json:"site_id"`
+	Name         string              `json:"site_name"`
+	Servers      []ServerDetail      `json:"servers,omitempty"`
+	Workstations []WorkstationDetail `json:"workstations,omitempty"`
+}
+
+// ClientDetail is a client with its sites
+type ClientDetail struct {
+	Instance string       `json:"instance,omitempty"` // N-Sight instance, set when several are configured
+	ID       int          `json:"client_id"`
+	Name     string       `json:"client_name"`
+	Sites    []SiteDetail `json:"sites,omitempty"`
+}
+
+// --- CSV Reading Functions ---
+
+// CompletionMarker is written to the cache directory when fetchall has replaced all CSV files
+const CompletionMarker = ".fetchall_complete"
+
+// cachedTimestamp returns a timestamp from the cache, formatting raw Unix
+// values that older fetchall versions wrote unformatted
+func cachedTimestamp(value string) string {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return FormatUnixTimestamp(value)
+	}
+	return value
+}
+
+// MarkComplete records in dir that a full fetch has finished
+func MarkComplete(dir string) error {
+	path := filepath.Join(dir, CompletionMarker)
+	return os.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Updated returns when the cache in dir was last completed. Caches written
+// before the completion marker existed fall back to the age of clients.csv.
+func Updated(dir string) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(dir, CompletionMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = os.Stat(filepath.Join(dir, "clients.csv"))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// ReadCSV reads a specified CSV file from the cache directory, skipping the header
+func ReadCSV(dir, filename string) ([][]string, error) {
+	path := filepath.Join(dir, filename)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("cache file %s not found. Run fetchall without -cache first: %w", path, err)
+		}
+		return nil, fmt.Errorf("failed to open cache file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	_, err = reader.Read() // Skip header row
+	if err != nil {
+		if err == io.EOF {
+			return [][]string{}, nil // Empty file is valid
+		}
+		return nil, fmt.Errorf("failed to read header from %s: %w", path, err)
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records from %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// BuildFromCache reconstructs the nested structure from the CSV files in dir
+func BuildFromCache(dir string) ([]ClientDetail, error) {
+	log.Println("Building result from CSV cache...")
+
+	// --- Read Base Data CSV files ---
+	clientRecords, err := ReadCSV(dir, "clients.csv")
+	if err != nil {
+		return nil, err
+	}
+	siteRecords, err := ReadCSV(dir, "sites.csv")
+	if err != nil {
+		return nil, err
+	}
+	serverRecords, err := ReadCSV(dir, "servers.csv")
+	if err != nil {
+		return nil, err
+	}
+	workstationRecords, err := ReadCSV(dir, "workstations.csv")
+	if err != nil {
+		return nil, err
+	}
+
+	// --- Read Asset Data CSV files (handle missing files gracefully) ---
+	assetSummaryRecords, errAssetSummary := ReadCSV(dir, "asset_summary.csv")
+	if errAssetSummary != nil && !errors.Is(errAssetSummary, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read asset_summary.csv: %w", errAssetSummary)
+	} else if errors.Is(errAssetSummary, os.ErrNotExist) {
+		log.Println("Warning: asset_summary.csv not found in cache. Asset details will be missing.")
+		assetSummaryRecords = [][]string{} // Empty slice
+	}
+
+	hardwareRecords, errHardware := ReadCSV(dir, "hardware_assets.csv")
+	if errHardware != nil && !errors.Is(errHardware, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read hardware_assets.csv: %w", errHardware)
+	} else if errors.Is(errHardware, os.ErrNotExist) {
+		log.Println("Warning: hardware_assets.csv not found in cache. Hardware details will be missing.")
+		hardwareRecords = [][]string{} // Empty slice
+	}
+
+	softwareRecords, errSoftware := ReadCSV(dir, "software_assets.csv")
+	if errSoftware != nil && !errors.Is(errSoftware, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read software_assets.csv: %w", errSoftware)
+	} else if errors.Is(errSoftware, os.ErrNotExist) {
+		log.Println("Warning: software_assets.csv not found in cache. Software details will be missing.")
+		softwareRecords = [][]string{} // Empty slice
+	}
+
+	// --- Process records into usable maps for efficient lookup ---
+
+	// Map clientID -> Client Name
+	clientMap := make(map[int]string)
+	for _, rec := range clientRecords {
+		if len(rec) < 2 {
+			log.Printf("Warning: Skipping malformed client record in cache: %v", rec)
+			continue
+		}
+		clientID, err := strconv.Atoi(rec[0])
+		if err != nil {
+			log.Printf("Warning: Skipping client record with invalid ID: %v", rec)
+			continue
+		}
+		clientMap[clientID] = rec[1]
+	}
+
+	// Map clientID -> list of Sites (ID, Name)
+	sitesByClient := make(map[int][]SiteDetail)
+	for _, rec := range siteRecords {
+		if len(rec) < 3 {
+			log.Printf("Warning: Skipping malformed site record in cache: %v", rec)
+			continue
+		}
+		siteID, errS := strconv.Atoi(rec[0])
+		clientID, errC := strconv.Atoi(rec[2])
+		if errS != nil || errC != nil {
+			log.Printf("Warning: Skipping site record with invalid numeric data: %v", rec)
+			continue
+		}
+		sitesByClient[clientID] = append(sitesByClient[clientID], SiteDetail{ID: siteID, Name: rec[1]})
+	}
+
+	// --- Process Asset Data into Maps ---
+
+	// Map deviceID -> Asset Summary Data (using AssetDetails struct for convenience)
+	assetSummaryMap := make(map[int]nsight.AssetDetails)
+	for _, rec := range assetSummaryRecords {
+		if len(rec) < 37 { // Expected number of columns in asset_summary.csv
+			log.Printf("Warning: Skipping malformed asset summary record in cache: %v", rec)
+			continue
+		}
+		deviceID, err := strconv.Atoi(rec[0])
+		if err != nil {
+			log.Printf("Warning: Skipping asset summary record with invalid device ID: %v", rec)
+			continue
+		}
+		ram, _ := strconv.ParseInt(rec[15], 10, 64) // Ignore error, default to 0
+		assetSummaryMap[deviceID] = nsight.AssetDetails{
+			Client:       rec[1],
+			ChassisType:  rec[2],
+			IP:           rec[3],
+			MAC1:         rec[4],
+			MAC2:         rec[5],
+			MAC3:         rec[6],
+			User:         rec[7],
+			Manufacturer: rec[8],
+			Model:        rec[9],
+			OS:           rec[10],
+			SerialNumber: rec[11],
+			ProductKey:   rec[12],
+			Role:         rec[13],
+			ServicePack:  rec[14],
+			RAM:          ram,
+			ScanTime:     rec[16],
+			Custom1:      nsight.CustomField{Name: rec[17], Value: rec[18]},
+			Custom2:      nsight.CustomField{Name: rec[19], Value: rec[20]},
+			Custom3:      nsight.CustomField{Name: rec[21], Value: rec[22]},
+			Custom4:      nsight.CustomField{Name: rec[23], Value: rec[24]},
+			Custom5:      nsight.CustomField{Name: rec[25], Value: rec[26]},
+			Custom6:      nsight.CustomField{Name: rec[27], Value: rec[28]},
+			Custom7:      nsight.CustomField{Name: rec[29], Value: rec[30]},
+			Custom8:      nsight.CustomField{Name: rec[31], Value: rec[32]},
+			Custom9:      nsight.CustomField{Name: rec[33], Value: rec[34]},
+			Custom10:     nsight.CustomField{Name: rec[35], Value: rec[36]},
+			// Hardware and Software lists will be populated later
+		}
+	}
+
+	// Map deviceID -> []HardwareItem
+	hardwareMap := make(map[int][]nsight.HardwareItem)
+	for _, rec := range hardwareRecords {
+		if len(rec) < 9 { // Expected columns in hardware_assets.csv
+			log.Printf("Warning: Skipping malformed hardware asset record in cache: %v", rec)
+			continue
+		}
+		deviceID, err := strconv.Atoi(rec[0])
+		if err != nil {
+			log.Printf("Warning: Skipping hardware asset record with invalid device ID: %v", rec)
+			continue
+		}
+		hwID, _ := strconv.Atoi(rec[1])
+		hwType, _ := strconv.Atoi(rec[3])
+		hwDeleted, _ := strconv.Atoi(rec[7])
+		hwModified, _ := strconv.Atoi(rec[8])
+		hardwareMap[deviceID] = append(hardwareMap[deviceID], nsight.HardwareItem{
+			HardwareID:   hwID,
+			Name:         rec[2],
+			Type:         hwType,
+			Manufacturer: rec[4],
+			Details:      rec[5],
+			Status:       rec[6],
+			Deleted:      hwDeleted,
+			Modified:     hwModified,
+		})
+	}
+
+	// Map deviceID -> []SoftwareItem
+	softwareMap := make(map[int][]nsight.SoftwareItem)
+	for _, rec := range softwareRecords {
+		if len(rec) < 8 { // Expected columns in software_assets.csv
+			log.Printf("Warning: Skipping malformed software asset record in cache: %v", rec)
+			continue
+		}
+		deviceID, err := strconv.Atoi(rec[0])
+		if err != nil {
+			log.Printf("Warning: Skipping software asset record with invalid device ID: %v", rec)
+			continue
+		}
+		swID, _ := strconv.Atoi(rec[1])
+		swDeleted, _ := strconv.Atoi(rec[6])
+		swModified, _ := strconv.Atoi(rec[7])
+		softwareMap[deviceID] = append(softwareMap[deviceID], nsight.SoftwareItem{
+			SoftwareID:  swID,
+			Name:        rec[2],
+			Version:     rec[3],
+			InstallDate: rec[4],
+			Type:        rec[5],
+			Deleted:     swDeleted,
+			Modified:    swModified,
+		})
+	}
+
+	// --- Process Base Data (Servers and Workstations) and combine with Asset Data ---
+
+	// Map siteID -> list of Servers
+	serversBySite := make(map[int][]ServerDetail)
+	for _, rec := range serverRecords {
+		// Check for the extended number of columns (now 12: ID, Name, OS, IP, Online, User, Manufacturer, Model, Serial, LastBootTime, SiteID, ClientID)
+		if len(rec) < 12 { // Updated count
+			log.Printf("Warning: Skipping malformed server record in cache: %v", rec)
+			continue
+		}
+		serverID, errSv := strconv.Atoi(rec[0])
+		onlineInt, errO := strconv.Atoi(rec[4])
+		siteID, errSi := strconv.Atoi(rec[10]) // Site ID is now at index 10
+		if errSv != nil || errO != nil || errSi != nil {
+			log.Printf("Warning: Skipping server record with invalid numeric data: %v", rec)
+			continue
+		}
+
+		// Look up and assign asset details from maps
+		var assetInfoPtr *nsight.AssetDetails
+		if summary, ok := assetSummaryMap[serverID]; ok {
+			summary.Hardware = hardwareMap[serverID] // Assign hardware list
+			summary.Software = softwareMap[serverID] // Assign software list
+			assetInfoPtr = &summary                  // Assign pointer to the combined struct
+		}
+
+		serversBySite[siteID] = append(serversBySite[siteID], ServerDetail{
+			ID:           serverID,
+			Name:         rec[1],
+			OS:           rec[2],
+			IP:           rec[3],
+			Online:       onlineInt == 1,
+			User:         rec[5],
+			Manufacturer: rec[6],
+			Model:        rec[7],
+			DeviceSerial: rec[8],
+			LastBootTime: cachedTimestamp(rec[9]), // Already formatted by fetchall
+			AssetInfo:    assetInfoPtr,            // Assign asset details from cache
+		})
+	}
+
+	// Map siteID -> list of Workstations
+	workstationsBySite := make(map[int][]WorkstationDetail)
+	for _, rec := range workstationRecords {
+		// Check for the extended number of columns (now 12)
+		if len(rec) < 12 { // Updated count
+			log.Printf("Warning: Skipping malformed workstation record in cache: %v", rec)
+			continue
+		}
+		wsID, errW := strconv.Atoi(rec[0])
+		onlineInt, errO := strconv.Atoi(rec[4])
+		siteID, errS := strconv.Atoi(rec[10]) // Site ID is now at index 10
+		if errW != nil || errO != nil || errS != nil {
+			log.Printf("Warning: Skipping workstation record with invalid numeric data: %v", rec)
+			continue
+		}
+
+		// Look up and assign asset details from maps
+		var assetInfoPtr *nsight.AssetDetails
+		if summary, ok := assetSummaryMap[wsID]; ok {
+			summary.Hardware = hardwareMap[wsID] // Assign hardware list
+			summary.Software = softwareMap[wsID] // Assign software list
+			assetInfoPtr = &summary              // Assign pointer to the combined struct
+		}
+
+		workstationsBySite[siteID] = append(workstationsBySite[siteID], WorkstationDetail{
+			ID:           wsID,
+			Name:         rec[1],
+			OS:           rec[2],
+			IP:           rec[3],
+			Online:       onlineInt == 1,
+			User:         rec[5],
+			Manufacturer: rec[6],
+			Model:        rec[7],
+			DeviceSerial: rec[8],
+			LastBootTime: cachedTimestamp(rec[9]), // Already formatted by fetchall
+			AssetInfo:    assetInfoPtr,            // Assign asset details from cache
+		})
+	}
+
+	// --- Build the final nested structure ---
+
+	var finalResult []ClientDetail
+	for clientID, clientName := range clientMap {
+		clientDetail := ClientDetail{
+			ID:    clientID,
+			Name:  clientName,
+			Sites: []SiteDetail{},
+		}
+
+		sites, ok := sitesByClient[clientID]
+		if ok {
+			for _, site := range sites {
+				// Ensure Servers and Workstations are initialized to empty slices if nil
+				servers := serversBySite[site.ID]
+				if servers == nil {
+					servers = []ServerDetail{}
+				}
+				workstations := workstationsBySite[site.ID]
+				if workstations == nil {
+					workstations = []WorkstationDetail{}
+				}
+				siteDetail := SiteDetail{
+					ID:           site.ID,
+					Name:         site.Name,
+					Servers:      servers,
+					Workstations: workstations,
+				}
+				clientDetail.Sites = append(clientDetail.Sites, siteDetail)
+			}
+		}
+		// Ensure Sites slice is not nil if it remained empty
+		if clientDetail.Sites == nil {
+			clientDetail.Sites = []SiteDetail{}
+		}
+
+		finalResult = append(finalResult, clientDetail)
+	}
+
+	log.Println("Successfully built result from CSV cache.")
+	return finalResult, nil
+}
@@ -0,0 +1,228 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nsight-proxy/internal/nsight"
+)
+
+// ErrNoDevice is returned by ResolveDevice if nothing matches
+var ErrNoDevice = errors.New("no matching device")
+
+// Fields a device can be matched on, reported in DeviceLocation.Match
+const (
+	MatchID     = "id"
+	MatchName   = "name"
+	MatchSerial = "serial"
+	MatchIP     = "ip"
+	MatchMAC    = "mac"
+)
+
+// Match quality, better matches hide worse ones
+const (
+	qualityExact = iota
+	qualityPrefix
+	qualityContains
+	qualityFuzzy
+	qualityNone
+)
+
+// DeviceQuery describes the device to resolve
+type DeviceQuery struct {
+	Identifier string // Device ID, hostname, serial number, IP or MAC address
+	Client     string // Only devices of this client ID or name, optional
+	Site       string // Only devices of this site ID or name, optional
+	Exact      bool   // Accept only exact matches, for calls that change data
+}
+
+// deviceKeys are the values a device can be found by
+type deviceKeys struct {
+	name    string
+	serials []string
+	ips     []string
+	macs    []string // Normalized by normalizeMAC
+}
+
+// ResolveDevice finds one server or workstation. The identifier is compared,
+// ignoring case, with the device ID, hostname, serial numbers, IP and MAC
+// addresses. Exact matches win over hostname or serial prefixes, which win
+// over hostnames containing the identifier, which win over hostnames within
+// a small edit distance, unless the query is exact. Several devices at the best level give an
+// *AmbiguousError, none an error wrapping ErrNoDevice.
+func ResolveDevice(clients []ClientDetail, q DeviceQuery) (*DeviceLocation, error) {
+	identifier := strings.TrimSpace(q.Identifier)
+	if identifier == "" {
+		return nil, errors.New("empty device identifier")
+	}
+	best := qualityNone
+	var matches []DeviceLocation
+	consider := func(location DeviceLocation, keys deviceKeys) {
+		quality, field := matchDevice(location.DeviceID, keys, identifier)
+		if quality == qualityNone || quality > best || (q.Exact && quality != qualityExact) {
+			return
+		}
+		if quality < best {
+			best, matches = quality, nil
+		}
+		location.Match = field
+		matches = append(matches, location)
+	}
+
+	for _, client := range Select(clients, q.Client, q.Site) {
+		for _, site := range client.Sites {
+			location := DeviceLocation{ClientID: client.ID, ClientName: client.Name, SiteID: site.ID, SiteName: site.Name}
+			for _, server := range site.Servers {
+				location.DeviceID, location.DeviceName, location.DeviceType = server.ID, server.Name, DeviceServer
+				consider(location, newDeviceKeys(server.Name, server.DeviceSerial, server.IP, server.AssetInfo))
+			}
+			for _, ws := range site.Workstations {
+				location.DeviceID, location.DeviceName, location.DeviceType = ws.ID, ws.Name, DeviceWorkstation
+				consider(location, newDeviceKeys(ws.Name, ws.DeviceSerial, ws.IP, ws.AssetInfo))
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w for %q%s", ErrNoDevice, identifier, q.scope())
+	case 1:
+		return &matches[0], nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].DeviceName != matches[j].DeviceName {
+			return strings.ToLower(matches[i].DeviceName) < strings.ToLower(matches[j].DeviceName)
+		}
+		return matches[i].DeviceID < matches[j].DeviceID
+	})
+	return nil, &AmbiguousError{Identifier: identifier, Candidates: matches}
+}
+
+// scope describes the client and site filters for error messages
+func (q DeviceQuery) scope() string {
+	var parts []string
+	if q.Client != "" {
+		parts = append(parts, "client "+q.Client)
+	}
+	if q.Site != "" {
+		parts = append(parts, "site "+q.Site)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " in " + strings.Join(parts, ", ")
+}
+
+// newDeviceKeys collects the values of a device, including its asset details
+func newDeviceKeys(name, serial, ip string, details *nsight.AssetDetails) deviceKeys {
+	keys := deviceKeys{name: strings.ToLower(name)}
+	keys.add(&keys.serials, serial)
+	keys.add(&keys.ips, ip)
+	if details != nil {
+		keys.add(&keys.serials, details.SerialNumber)
+		keys.add(&keys.ips, details.IP)
+		for _, mac := range []string{details.MAC1, details.MAC2, details.MAC3} {
+			if normalized := normalizeMAC(mac); normalized != "" {
+				keys.macs = append(keys.macs, normalized)
+			}
+		}
+	}
+	return keys
+}
+
+// add appends a lowercased value unless it is empty
+func (deviceKeys) add(list *[]string, value string) {
+	if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+		*list = append(*list, value)
+	}
+}
+
+// matchDevice returns how well and on which field a device matches
+func matchDevice(id int, keys deviceKeys, identifier string) (int, string) {
+	if n, err := strconv.Atoi(identifier); err == nil && n == id {
+		return qualityExact, MatchID
+	}
+	query := strings.ToLower(identifier)
+
+	if keys.name == query {
+		return qualityExact, MatchName
+	}
+	for _, serial := range keys.serials {
+		if serial == query {
+			return qualityExact, MatchSerial
+		}
+	}
+	for _, ip := range keys.ips {
+		if ip == query {
+			return qualityExact, MatchIP
+		}
+	}
+	if mac := normalizeMAC(identifier); mac != "" {
+		for _, known := range keys.macs {
+			if known == mac {
+				return qualityExact, MatchMAC
+			}
+		}
+	}
+
+	if keys.name != "" && strings.HasPrefix(keys.name, query) {
+		return qualityPrefix, MatchName
+	}
+	for _, serial := range keys.serials {
+		if strings.HasPrefix(serial, query) {
+			return qualityPrefix, MatchSerial
+		}
+	}
+	if strings.Contains(keys.name, query) {
+		return qualityContains, MatchName
+	}
+	// Typos are only forgiven in hostnames of a reasonable length
+	if len(query) >= 4 && keys.name != "" && editDistance(keys.name, query) <= len(query)/4 {
+		return qualityFuzzy, MatchName
+	}
+	return qualityNone, ""
+}
+
+// normalizeMAC returns a MAC address as 12 lowercase hex digits, or "" if
+// value is not one. Colons, dashes and dots are accepted as separators.
+func normalizeMAC(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		switch {
+		case r == ':' || r == '-' || r == '.':
+		case (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f'):
+			b.WriteRune(r)
+		default:
+			return ""
+		}
+	}
+	if b.Len() != 12 {
+		return ""
+	}
+	return b.String()
+}
+
+// editDistance is the Levenshtein distance of two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
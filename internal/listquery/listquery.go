@@ -0,0 +1,394 @@
+// Package listquery applies filtering, sorting, pagination and field selection
+// to JSON results. It works on decoded JSON values, so any slice result can be
+// queried by the JSON names of its fields.
+package listquery
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// operators supported in filter expressions. At the same position the longer
+// operator wins, so ">=" is not read as ">".
+var operators = []string{"!~", ">=", "<=", "!=", "~", "=", ">", "<"}
+
+// Filter is a single field comparison such as severity>=2
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// SortKey orders results by a field, descending if Desc is set
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Options are the query parameters of a list request
+type Options struct {
+	Filters []Filter
+	Sort    []SortKey
+	Limit   int // Zero means no limit
+	Offset  int
+	Fields  []string
+}
+
+// Page is the result of applying Options to a list
+type Page struct {
+	Items      []interface{}
+	Total      int    // Number of items after filtering, before pagination
+	NextCursor string // Cursor of the next page, empty on the last page
+}
+
+// Parse reads the filter, sort, limit, offset, cursor and fields parameters.
+// Filters may be repeated or separated by semicolons.
+func Parse(values url.Values) (*Options, error) {
+	opts := &Options{}
+
+	for _, raw := range values["filter"] {
+		for _, expr := range strings.Split(raw, ";") {
+			expr = strings.TrimSpace(expr)
+			if expr == "" {
+				continue
+			}
+			filter, err := parseFilter(expr)
+			if err != nil {
+				return nil, err
+			}
+			opts.Filters = append(opts.Filters, filter)
+		}
+	}
+
+	for _, field := range splitList(values.Get("sort")) {
+		key := SortKey{Field: field}
+		if strings.HasPrefix(field, "-") {
+			key = SortKey{Field: field[1:], Desc: true}
+		} else if strings.HasPrefix(field, "+") {
+			key.Field = field[1:]
+		}
+		opts.Sort = append(opts.Sort, key)
+	}
+
+	var err error
+	if v := values.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := values.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			return nil, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		if opts.Offset, err = decodeCursor(v); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.Fields = splitList(values.Get("fields"))
+	return opts, nil
+}
+
+// Empty reports whether the options leave results unchanged
+func (o *Options) Empty() bool {
+	return len(o.Filters) == 0 && len(o.Sort) == 0 && o.Limit == 0 && o.Offset == 0 && len(o.Fields) == 0
+}
+
+// parseFilter splits an expression like "name~chrome" into field, operator and value
+func parseFilter(expr string) (Filter, error) {
+	best := -1
+	var op string
+	for _, candidate := range operators {
+		if i := strings.Index(expr, candidate); i > 0 && (best == -1 || i < best || (i == best && len(candidate) > len(op))) {
+			best, op = i, candidate
+		}
+	}
+	if best == -1 {
+		return Filter{}, fmt.Errorf("invalid filter %q, expected <field><op><value> with op one of %s", expr, strings.Join(operators, " "))
+	}
+	return Filter{
+		Field: strings.TrimSpace(expr[:best]),
+		Op:    op,
+		Value: strings.TrimSpace(expr[best+len(op):]),
+	}, nil
+}
+
+// splitList splits a comma separated parameter, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// encodeCursor returns an opaque cursor pointing at offset
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+// decodeCursor returns the offset stored in a cursor
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), "o:") {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	offset, err := strconv.Atoi(string(data[2:]))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return offset, nil
+}
+
+// Apply filters, sorts, paginates and projects a list of decoded JSON values
+func Apply(items []interface{}, opts *Options) (*Page, error) {
+	matched := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		ok, err := matchesAll(item, opts.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+
+	if len(opts.Sort) > 0 {
+		sort.SliceStable(matched, func(i, j int) bool {
+			for _, key := range opts.Sort {
+				c := compareValues(lookup(matched[i], key.Field), lookup(matched[j], key.Field))
+				if c == 0 {
+					continue
+				}
+				if key.Desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+
+	page := &Page{Total: len(matched)}
+	start := opts.Offset
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := len(matched)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+		page.NextCursor = encodeCursor(end)
+	}
+	page.Items = matched[start:end]
+
+	if len(opts.Fields) > 0 {
+		for i, item := range page.Items {
+			page.Items[i] = Project(item, opts.Fields)
+		}
+	}
+	return page, nil
+}
+
+// matchesAll reports whether an item satisfies every filter
+func matchesAll(item interface{}, filters []Filter) (bool, error) {
+	for _, f := range filters {
+		ok, err := matches(lookup(item, f.Field), f)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matches evaluates one filter against a field value
+func matches(value interface{}, f Filter) (bool, error) {
+	text := stringify(value)
+	switch f.Op {
+	case "~":
+		return strings.Contains(strings.ToLower(text), strings.ToLower(f.Value)), nil
+	case "!~":
+		return !strings.Contains(strings.ToLower(text), strings.ToLower(f.Value)), nil
+	case "=":
+		return equalValues(value, f.Value), nil
+	case "!=":
+		return !equalValues(value, f.Value), nil
+	}
+
+	c := compareValues(value, f.Value)
+	switch f.Op {
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator %q", f.Op)
+}
+
+// equalValues compares a field with a filter value. Numbers compare
+// numerically, booleans also match 1/0, strings ignore case.
+func equalValues(value interface{}, want string) bool {
+	if b, ok := value.(bool); ok {
+		switch strings.ToLower(want) {
+		case "1", "true", "yes":
+			return b
+		case "0", "false", "no":
+			return !b
+		}
+	}
+	if a, okA := toNumber(value); okA {
+		if b, okB := toNumber(want); okB {
+			return a == b
+		}
+	}
+	return strings.EqualFold(stringify(value), want)
+}
+
+// compareValues orders two values numerically when both are numbers and as
+// case-insensitive strings otherwise. Missing values sort first.
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if x, okA := toNumber(a); okA {
+		if y, okB := toNumber(b); okB {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(strings.ToLower(stringify(a)), strings.ToLower(stringify(b)))
+}
+
+// toNumber converts JSON numbers and numeric strings to float64
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case fmt.Stringer: // json.Number
+		f, err := strconv.ParseFloat(v.String(), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// stringify renders a scalar JSON value as text
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// normalizeName makes field names comparable regardless of case and underscores,
+// so device_name matches DeviceName
+func normalizeName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// findKey returns the key of obj matching name
+func findKey(obj map[string]interface{}, name string) (string, bool) {
+	if _, ok := obj[name]; ok {
+		return name, true
+	}
+	normalized := normalizeName(name)
+	for key := range obj {
+		if normalizeName(key) == normalized {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lookup resolves a dotted field path in a decoded JSON value
+func lookup(value interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		key, ok := findKey(obj, part)
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	return value
+}
+
+// Project keeps only the given (possibly dotted) fields of an object. Lists
+// are projected element by element.
+func Project(value interface{}, fields []string) interface{} {
+	if list, ok := value.([]interface{}); ok {
+		projected := make([]interface{}, len(list))
+		for i, item := range list {
+			projected[i] = Project(item, fields)
+		}
+		return projected
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	// Nested fields are grouped by their head so each child is projected once;
+	// a plain field keeps the whole child
+	whole := make(map[string]bool)
+	rests := make(map[string][]string)
+	for _, field := range fields {
+		head, rest, nested := strings.Cut(field, ".")
+		key, ok := findKey(obj, head)
+		if !ok {
+			continue
+		}
+		if nested {
+			rests[key] = append(rests[key], rest)
+		} else {
+			whole[key] = true
+		}
+	}
+	result := make(map[string]interface{}, len(whole)+len(rests))
+	for key := range whole {
+		result[key] = obj[key]
+	}
+	for key, fields := range rests {
+		if !whole[key] {
+			result[key] = Project(obj[key], fields)
+		}
+	}
+	return result
+}
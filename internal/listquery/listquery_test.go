@@ -0,0 +1,182 @@
+package listquery
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// decode parses a JSON literal into the values Apply and Project work on
+func decode(t *testing.T, text string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", text, err)
+	}
+	return value
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    *Options
+		wantErr bool
+	}{
+		{name: "empty", query: "", want: &Options{}},
+		{
+			name:  "filters repeated and separated by semicolons",
+			query: "filter=" + url.QueryEscape("severity>=2;name~disk") + "&filter=status!=ok&filter=" + url.QueryEscape("a<=1; ;b!~x"),
+			want: &Options{Filters: []Filter{
+				{"severity", ">=", "2"}, {"name", "~", "disk"}, {"status", "!=", "ok"}, {"a", "<=", "1"}, {"b", "!~", "x"},
+			}},
+		},
+		{name: "operator in the value", query: "filter=" + url.QueryEscape("name=a>b"), want: &Options{Filters: []Filter{{"name", "=", "a>b"}}}},
+		{
+			name:  "sort, limit, offset and fields",
+			query: "sort=-severity,+name,id&limit=10&offset=20&fields=" + url.QueryEscape("id, name,,sites.site_id"),
+			want: &Options{
+				Sort:   []SortKey{{"severity", true}, {"name", false}, {"id", false}},
+				Limit:  10,
+				Offset: 20,
+				Fields: []string{"id", "name", "sites.site_id"},
+			},
+		},
+		{name: "cursor overrides offset", query: "offset=5&cursor=" + encodeCursor(40), want: &Options{Offset: 40}},
+		{name: "filter without operator", query: "filter=severity", wantErr: true},
+		{name: "filter without field", query: "filter=" + url.QueryEscape("=2"), wantErr: true},
+		{name: "negative limit", query: "limit=-1", wantErr: true},
+		{name: "invalid offset", query: "offset=x", wantErr: true},
+		{name: "invalid cursor", query: "cursor=bm9wZQ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse(values)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%s) = %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", tt.query, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%s) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+const checks = `[
+	{"check_id": 1, "name": "Disk C", "severity": 2, "online": true, "device": {"name": "srv01"}},
+	{"check_id": 2, "name": "Backup", "severity": 0, "online": false, "device": {"name": "ws02"}},
+	{"check_id": 3, "name": "disk D", "severity": 1, "online": true, "device": {"name": "srv01"}},
+	{"check_id": 4, "name": "Antivirus", "severity": 2, "online": true},
+	{"check_id": 5, "name": "Ping", "severity": "10", "online": false, "device": {"name": "ws01"}}
+]`
+
+// ids returns the check_id of each item
+func ids(items []interface{}) []int {
+	result := []int{}
+	for _, item := range items {
+		result = append(result, int(item.(map[string]interface{})["check_id"].(float64)))
+	}
+	return result
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   []int
+		total  int
+		cursor string
+	}{
+		{name: "no options", query: "", want: []int{1, 2, 3, 4, 5}, total: 5},
+		{name: "numeric comparison with a numeric string", query: "filter=severity>=2", want: []int{1, 4, 5}, total: 3},
+		{name: "equal ignores case and field name style", query: "filter=Name=DISK+C", want: []int{1}, total: 1},
+		{name: "contains and not contains", query: "filter=" + url.QueryEscape("name~disk;name!~c"), want: []int{3}, total: 1},
+		{name: "boolean as number", query: "filter=online=1", want: []int{1, 3, 4}, total: 3},
+		{name: "not equal", query: "filter=severity!=2", want: []int{2, 3, 5}, total: 3},
+		{name: "nested field", query: "filter=device.name=srv01", want: []int{1, 3}, total: 2},
+		{name: "sort by two keys", query: "sort=-severity,name", want: []int{5, 4, 1, 3, 2}, total: 5},
+		{name: "missing values sort first", query: "sort=device.name", want: []int{4, 1, 3, 5, 2}, total: 5},
+		{name: "first page", query: "sort=check_id&limit=2", want: []int{1, 2}, total: 5, cursor: encodeCursor(2)},
+		{name: "page from cursor", query: "sort=check_id&limit=2&cursor=" + encodeCursor(2), want: []int{3, 4}, total: 5, cursor: encodeCursor(4)},
+		{name: "last page has no cursor", query: "sort=check_id&limit=2&cursor=" + encodeCursor(4), want: []int{5}, total: 5},
+		{name: "offset past the end", query: "offset=10", want: []int{}, total: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := Parse(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := Apply(decode(t, checks).([]interface{}), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(page.Items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("items = %v, want %v", got, tt.want)
+			}
+			if page.Total != tt.total || page.NextCursor != tt.cursor {
+				t.Errorf("total, cursor = %d, %q, want %d, %q", page.Total, page.NextCursor, tt.total, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestApplyProjects(t *testing.T) {
+	opts := &Options{Sort: []SortKey{{Field: "check_id"}}, Limit: 1, Fields: []string{"check_id", "device.name"}}
+	page, err := Apply(decode(t, checks).([]interface{}), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decode(t, `[{"check_id": 1, "device": {"name": "srv01"}}]`)
+	if !reflect.DeepEqual(page.Items, want) {
+		t.Errorf("items = %v, want %v", page.Items, want)
+	}
+}
+
+func TestProject(t *testing.T) {
+	const client = `{
+		"client_id": 1,
+		"Name": "Alpha",
+		"contact": {"email": "a@example.com", "phone": "123", "address": {"city": "Brno", "zip": "60200"}},
+		"sites": [
+			{"site_id": 11, "site_name": "HQ", "devices": 3},
+			{"site_id": 12, "site_name": "Branch", "devices": 1}
+		]
+	}`
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{"top-level fields", []string{"client_id", "name"}, `{"client_id": 1, "Name": "Alpha"}`},
+		{"unknown field", []string{"missing"}, `{}`},
+		{"nested fields merge", []string{"contact.email", "contact.address.city"}, `{"contact": {"email": "a@example.com", "address": {"city": "Brno"}}}`},
+		{"list elements keep every nested field", []string{"sites.site_id", "sites.site_name"}, `{"sites": [{"site_id": 11, "site_name": "HQ"}, {"site_id": 12, "site_name": "Branch"}]}`},
+		{"whole field wins over a nested one", []string{"contact", "contact.email"}, `{"contact": {"email": "a@example.com", "phone": "123", "address": {"city": "Brno", "zip": "60200"}}}`},
+		{"whole field given after a nested one", []string{"sites.site_id", "sites"}, `{"sites": [{"site_id": 11, "site_name": "HQ", "devices": 3}, {"site_id": 12, "site_name": "Branch", "devices": 1}]}`},
+		{"nested field of a scalar", []string{"client_id.x"}, `{"client_id": 1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Project(decode(t, client), tt.fields)
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("Project(%v) = %v, want %v", tt.fields, got, want)
+			}
+		})
+	}
+}
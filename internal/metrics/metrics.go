@@ -0,0 +1,77 @@
+// Package metrics defines the Prometheus metrics of the proxy and the N-Sight
+// API client. Labels carry service names, statuses and error kinds only, never
+// API keys, tokens or request parameters.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// latencyBuckets cover fast cache hits up to the upstream timeout
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	// Requests counts proxy requests by handler, service and HTTP status
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsight_proxy_requests_total",
+		Help: "Proxy requests by handler, service and HTTP status.",
+	}, []string{"handler", "service", "status"})
+
+	// RequestDuration observes proxy request latency by handler, service and HTTP status
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nsight_proxy_request_duration_seconds",
+		Help:    "Proxy request latency by handler, service and HTTP status.",
+		Buckets: latencyBuckets,
+	}, []string{"handler", "service", "status"})
+
+	// InFlight counts proxy requests being served
+	InFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nsight_proxy_requests_in_flight",
+		Help: "Proxy requests currently being served.",
+	}, []string{"handler"})
+
+	// CacheRequests counts response cache lookups by service and result (HIT, MISS, STALE, BYPASS)
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsight_proxy_cache_requests_total",
+		Help: "Response cache lookups by service and result.",
+	}, []string{"service", "result"})
+
+	// UpstreamRequests counts N-Sight API calls by service and outcome ("ok" or an error kind)
+	UpstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsight_upstream_requests_total",
+		Help: "N-Sight API calls by service and outcome.",
+	}, []string{"service", "outcome"})
+
+	// UpstreamDuration observes N-Sight API call latency by service
+	UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nsight_upstream_request_duration_seconds",
+		Help:    "N-Sight API call latency by service.",
+		Buckets: latencyBuckets,
+	}, []string{"service"})
+
+	// UpstreamInFlight counts N-Sight API calls in progress
+	UpstreamInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nsight_upstream_requests_in_flight",
+		Help: "N-Sight API calls in progress.",
+	})
+
+	// RateLimitWait observes how long calls waited for the upstream rate limiter
+	RateLimitWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nsight_rate_limiter_wait_seconds",
+		Help:    "Time N-Sight API calls waited for the rate limiter.",
+		Buckets: []float64{0, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	// DecodeFailures counts N-Sight responses that could not be parsed, by result type
+	DecodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsight_xml_decode_failures_total",
+		Help: "N-Sight XML responses that failed to decode, by result type.",
+	}, []string{"type"})
+
+	// WebhookDeliveries counts webhook deliveries by subscription and result (delivered, retried, dead_letter)
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nsight_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by subscription and result.",
+	}, []string{"subscription", "result"})
+)
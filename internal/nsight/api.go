@@ -2,6 +2,7 @@ package nsight
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -9,35 +10,84 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"time"
 
-	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html/charset"
+
+	"nsight-proxy/internal/audit"
+	"nsight-proxy/internal/config"
+	"nsight-proxy/internal/credentials"
+	"nsight-proxy/internal/metrics"
+	"nsight-proxy/internal/tracing"
 )
 
+// requestTimeout bounds a single call to the N-Sight API unless Configure sets another
+const requestTimeout = 60 * time.Second
+
+// httpClient is shared by all API clients so connections are reused
+var httpClient = &http.Client{Timeout: requestTimeout}
+
 // ApiClient holds the configuration and provides methods for API calls
 type ApiClient struct {
-	apiKey string
+	key    credentials.Provider // Asked for the key on every call, so rotated keys are used
 	server string
+	ctx    context.Context // Parent of the client's trace spans, nil for none
+	actor  *audit.Actor    // Who changes made by the client are attributed to, nil for the local user
+	dryRun *[]Call         // Receives the calls that would change data, nil to make them
+}
+
+// WithActor returns a copy of the client whose changes are audited under actor
+func (c *ApiClient) WithActor(actor audit.Actor) *ApiClient {
+	clone := *c
+	clone.actor = &actor
+	return &clone
+}
+
+// WithContext returns a copy of the client whose calls are traced as children
+// of ctx and stop when ctx is cancelled
+func (c *ApiClient) WithContext(ctx context.Context) *ApiClient {
+	clone := *c
+	clone.ctx = ctx
+	return &clone
+}
+
+// WithDryRun returns a copy of the client that appends the calls that would
+// change data to calls instead of making them. Read calls are made as usual.
+func (c *ApiClient) WithDryRun(calls *[]Call) *ApiClient {
+	clone := *c
+	clone.dryRun = calls
+	return &clone
+}
+
+// context returns the client's context
+func (c *ApiClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
-// NewApiClient creates a new ApiClient, loading configuration from .env
+// NewApiClient creates a new ApiClient from the configuration (see package
+// config) and applies its client settings. The key comes from api_key_source,
+// or api_key if no source is set.
 func NewApiClient() (*ApiClient, error) {
-	err := godotenv.Load()
+	cfg, err := config.Load(nil)
 	if err != nil {
-		// It's often okay if .env is missing, rely on environment variables
-		log.Println("Warning: Could not load .env file:", err)
+		return nil, err
 	}
+	Configure(cfg.Client)
 
-	apiKey := os.Getenv("NSIGHT_API_KEY")
-	server := os.Getenv("NSIGHT_SERVER")
-
-	if apiKey == "" || server == "" {
-		return nil, errors.New("NSIGHT_API_KEY and NSIGHT_SERVER must be set in .env file or environment variables")
+	provider, err := credentials.Select(cfg.APIKeySource, cfg.APIKey.Value())
+	if err != nil {
+		return nil, err
 	}
-
-	return &ApiClient{apiKey: apiKey, server: server}, nil
+	return NewApiClientWithProvider(provider, cfg.Server)
 }
 
 // NewApiClientWithCredentials creates a new ApiClient with provided API key and server
@@ -46,51 +96,205 @@ func NewApiClientWithCredentials(apiKey, server string) (*ApiClient, error) {
 		return nil, errors.New("apiKey and server must not be empty")
 	}
 
-	return &ApiClient{apiKey: apiKey, server: server}, nil
+	return &ApiClient{key: credentials.Static(apiKey), server: server}, nil
+}
+
+// NewApiClientWithProvider creates a new ApiClient whose key is read from
+// provider. The key is read once here so a missing key is reported early.
+func NewApiClientWithProvider(provider credentials.Provider, server string) (*ApiClient, error) {
+	if server == "" {
+		return nil, errors.New("no N-Sight server, set server in the config file or NSIGHT_SERVER")
+	}
+	key, err := provider.Key(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, fmt.Errorf("no API key in %s, set NSIGHT_API_KEY or NSIGHT_API_KEY_SOURCE", provider)
+	}
+
+	return &ApiClient{key: provider, server: server}, nil
 }
 
-// callAPI performs the HTTP GET request and returns the response body bytes
+// apiKey returns the current key
+func (c *ApiClient) apiKey(ctx context.Context) (string, error) {
+	key, err := c.key.Key(ctx)
+	if err == nil && key == "" {
+		err = fmt.Errorf("no API key in %s", c.key)
+	}
+	return key, err
+}
+
+// callAPI performs a read call and returns the response body bytes. Calls
+// that fail with a transient error are repeated as configured by SetRetries.
 func (c *ApiClient) callAPI(service string, params map[string]string) ([]byte, error) {
-	base, err := url.Parse(fmt.Sprintf("https://%s/api/", c.server))
+	return withRetries(c.context(), service, func() ([]byte, error) {
+		return c.callOnce(service, params)
+	})
+}
+
+// callOnce performs the HTTP GET request and returns the response body bytes
+func (c *ApiClient) callOnce(service string, params map[string]string) (body []byte, err error) {
+	apiKey, err := c.apiKey(c.context())
+	if err != nil {
+		return nil, err
+	}
+	apiUrl, err := c.requestURL(service, params, apiKey)
 	if err != nil {
-		return nil, fmt.Errorf("invalid server URL: %w", err)
+		return nil, err
+	}
+	if Debug() {
+		// Only the logged copy is masked, the request needs the key
+		if logged, err := c.requestURL(service, params, redactedKey); err == nil {
+			log.Printf("Requesting URL: %s", logged)
+		}
 	}
 
-	q := base.Query()
-	q.Set("apikey", c.apiKey)
-	q.Set("service", service)
-	for key, value := range params {
-		q.Set(key, value)
+	// The span never records the URL, which contains the API key
+	ctx, span := tracing.Tracer().Start(c.context(), "nsight.callAPI", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("nsight.service", service),
+		attribute.String("server.address", c.server),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, Outcome(err))
+		}
+		span.End()
+	}()
+
+	if err := waitForRateLimit(ctx); err != nil {
+		return nil, transportError(service, err)
 	}
-	base.RawQuery = q.Encode()
 
-	apiUrl := base.String()
-	fmt.Println("Requesting URL:", apiUrl) // Print URL for debugging
+	start := time.Now()
+	metrics.UpstreamInFlight.Inc()
+	defer func() {
+		metrics.UpstreamInFlight.Dec()
+		metrics.UpstreamDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+		metrics.UpstreamRequests.WithLabelValues(service, Outcome(err)).Inc()
+	}()
 
-	resp, err := http.Get(apiUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request for %s: %w", service, err)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching data from API (%s): %w", service, err)
+		return nil, transportError(service, err)
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body (%s): %w", service, err)
+		return nil, transportError(service, err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API (%s) returned non-OK status: %s\nResponse: %s", service, resp.Status, string(bodyBytes))
+		return nil, statusError(service, resp, bodyBytes)
+	}
+	if apiErr := checkFailure(service, bodyBytes); apiErr != nil {
+		return nil, apiErr
 	}
 	return bodyBytes, nil
 }
 
+// requestURL returns the URL of a call
+func (c *ApiClient) requestURL(service string, params map[string]string, apiKey string) (string, error) {
+	base, err := url.Parse(fmt.Sprintf("https://%s/api/", c.server))
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	q := base.Query()
+	q.Set("apikey", apiKey)
+	q.Set("service", service)
+	for key, value := range params {
+		q.Set(key, value)
+	}
+	base.RawQuery = q.Encode()
+	return base.String(), nil
+}
+
+// mutate performs a call that changes state in N-Sight and records it in the
+// audit log. Calls are refused if the configured audit log cannot be written
+// or the process is read-only, and only recorded by a dry-run client.
+func (c *ApiClient) mutate(service string, params map[string]string) error {
+	if c.dryRun != nil {
+		apiUrl, err := c.requestURL(service, params, redactedKey)
+		if err != nil {
+			return err
+		}
+		*c.dryRun = append(*c.dryRun, Call{Service: service, Params: params, URL: apiUrl})
+		return nil
+	}
+	if ReadOnly() {
+		return fmt.Errorf("refusing %s: %w", service, ErrReadOnly)
+	}
+	store, err := audit.Default()
+	if err != nil {
+		return fmt.Errorf("refusing %s without an audit log: %w", service, err)
+	}
+
+	// Only a hash of the key is recorded
+	apiKey, _ := c.apiKey(c.context())
+	start := time.Now()
+	// Changes are never repeated, a failed call may still have been applied
+	body, err := c.callOnce(service, params)
+
+	actor := audit.ProcessActor()
+	if c.actor != nil {
+		actor = *c.actor
+	}
+	rec := audit.Record{
+		Time:       start.UTC(),
+		Actor:      actor,
+		KeyHash:    audit.Hash(apiKey),
+		Service:    service,
+		Targets:    audit.Targets(params),
+		Params:     params,
+		Outcome:    Outcome(err),
+		Response:   responseExcerpt(body),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		rec.UpstreamStatus = apiErr.StatusCode
+		rec.Response = apiErr.Message
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if store != nil {
+		if auditErr := store.Append(rec); auditErr != nil {
+			log.Printf("Warning: Failed to record %s in the audit log: %v", service, auditErr)
+		}
+	}
+	return err
+}
+
+// FetchRaw calls a service and returns the undecoded XML response
+func (c *ApiClient) FetchRaw(service string, params map[string]string) ([]byte, error) {
+	return c.callAPI(service, params)
+}
+
 // decodeXML parses the XML body using the correct charset reader
-func decodeXML(bodyBytes []byte, target interface{}) error {
+func (c *ApiClient) decodeXML(bodyBytes []byte, target interface{}) error {
+	typeName := resultTypeName(target)
+	_, span := tracing.Tracer().Start(c.context(), "nsight.decodeXML", trace.WithAttributes(
+		attribute.String("nsight.result_type", typeName),
+		attribute.Int("nsight.response_bytes", len(bodyBytes)),
+	))
+	defer span.End()
+
 	decoder := xml.NewDecoder(bytes.NewReader(bodyBytes))
 	decoder.CharsetReader = charset.NewReaderLabel
 	err := decoder.Decode(target)
 	if err != nil && err != io.EOF { // Ignore EOF if the structure allows empty results
-		return fmt.Errorf("error parsing XML response: %w\nRaw Response:\n%s", err, string(bodyBytes))
+		metrics.DecodeFailures.WithLabelValues(typeName).Inc()
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("%w: %v", ErrDecode, err)
 	}
 	return nil
 }
@@ -102,7 +306,7 @@ func (c *ApiClient) FetchClients() ([]Client, error) {
 		return nil, err
 	}
 	var result ClientResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -118,7 +322,7 @@ func (c *ApiClient) FetchSites(clientID int) ([]Site, error) {
 		return nil, fmt.Errorf("fetching sites for client %d: %w", clientID, err)
 	}
 	var result SiteResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		// Check if the error suggests an empty list vs. malformed XML
 		// This simple check might need refinement based on API behavior for empty lists
 		if len(result.Items) == 0 && err.Error() == "EOF" { // Common case for empty list with Decode
@@ -138,7 +342,7 @@ func (c *ApiClient) FetchServers(siteID int) ([]Server, error) {
 		return nil, fmt.Errorf("fetching servers for site %d: %w", siteID, err)
 	}
 	var result ServerResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		if len(result.Items) == 0 && err.Error() == "EOF" {
 			log.Printf("No servers found for site %d.", siteID)
 			return []Server{}, nil
@@ -156,7 +360,7 @@ func (c *ApiClient) FetchWorkstations(siteID int) ([]Workstation, error) {
 		return nil, fmt.Errorf("fetching workstations for site %d: %w", siteID, err)
 	}
 	var result WorkstationResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		if len(result.Items) == 0 && err.Error() == "EOF" {
 			log.Printf("No workstations found for site %d.", siteID)
 			return []Workstation{}, nil
@@ -180,7 +384,7 @@ func (c *ApiClient) FetchDeviceAssetDetails(deviceID int) (*AssetDetails, error)
 
 	var result AssetDetails
 	// Use decodeXML to handle potential charset issues like ISO-8859-1
-	if err := decodeXML(body, &result); err != nil {
+	if err := c.decodeXML(body, &result); err != nil {
 		// Log the body for debugging if unmarshal fails
 		log.Printf("Failed to decode device asset details XML for device %d. Body: %s", deviceID, string(body))
 		return nil, fmt.Errorf("failed to decode device asset details XML for device %d: %w", deviceID, err)
@@ -204,7 +408,7 @@ func (c *ApiClient) FetchFailingChecks() ([]Check, error) {
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -218,7 +422,7 @@ func (c *ApiClient) FetchChecks(deviceID int) ([]Check, error) {
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -232,7 +436,7 @@ func (c *ApiClient) FetchChecksBySite(siteID int) ([]Check, error) {
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -241,8 +445,7 @@ func (c *ApiClient) FetchChecksBySite(siteID int) ([]Check, error) {
 // ClearCheck clears a specific check
 func (c *ApiClient) ClearCheck(checkID int) error {
 	params := map[string]string{"checkid": fmt.Sprintf("%d", checkID)}
-	_, err := c.callAPI("clear_check", params)
-	return err
+	return c.mutate("clear_check", params)
 }
 
 // AddCheckNote adds a note to a check
@@ -251,8 +454,7 @@ func (c *ApiClient) AddCheckNote(checkID int, note string) error {
 		"checkid": fmt.Sprintf("%d", checkID),
 		"note":    note,
 	}
-	_, err := c.callAPI("add_check_note", params)
-	return err
+	return c.mutate("add_check_note", params)
 }
 
 // -- Device-related methods --
@@ -265,7 +467,7 @@ func (c *ApiClient) FetchDevices(clientID int) ([]Device, error) {
 		return nil, err
 	}
 	var result DeviceResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -279,7 +481,7 @@ func (c *ApiClient) FetchDevicesBySite(siteID int) ([]Device, error) {
 		return nil, err
 	}
 	var result DeviceResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -293,7 +495,7 @@ func (c *ApiClient) FetchDeviceMonitoringDetails(deviceID int) ([]Check, error)
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -309,7 +511,7 @@ func (c *ApiClient) FetchAgentlessAssets(siteID int) ([]AgentlessAsset, error) {
 		return nil, err
 	}
 	var result AgentlessAssetResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -328,7 +530,7 @@ func (c *ApiClient) FetchHardware(deviceID int) ([]HardwareItem, error) {
 		XMLName xml.Name       `xml:"result"`
 		Items   []HardwareItem `xml:"items>item"`
 	}
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -345,7 +547,7 @@ func (c *ApiClient) FetchSoftware(deviceID int) ([]SoftwareItem, error) {
 		XMLName xml.Name       `xml:"result"`
 		Items   []SoftwareItem `xml:"items>item"`
 	}
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -358,7 +560,7 @@ func (c *ApiClient) FetchLicenseGroups() ([]LicenseGroup, error) {
 		return nil, err
 	}
 	var result LicenseGroupResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -374,7 +576,7 @@ func (c *ApiClient) FetchPatches(deviceID int) ([]Patch, error) {
 		return nil, err
 	}
 	var result PatchResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -390,8 +592,7 @@ func (c *ApiClient) ApprovePatches(deviceID int, patchIDs []int) error {
 		"deviceid": fmt.Sprintf("%d", deviceID),
 		"patchids": fmt.Sprintf("[%s]", fmt.Sprintf("%s", patchIDsStr)),
 	}
-	_, err := c.callAPI("approve_patch", params)
-	return err
+	return c.mutate("approve_patch", params)
 }
 
 // IgnorePatches ignores patches for a device
@@ -404,8 +605,7 @@ func (c *ApiClient) IgnorePatches(deviceID int, patchIDs []int) error {
 		"deviceid": fmt.Sprintf("%d", deviceID),
 		"patchids": fmt.Sprintf("[%s]", fmt.Sprintf("%s", patchIDsStr)),
 	}
-	_, err := c.callAPI("ignore_patch", params)
-	return err
+	return c.mutate("ignore_patch", params)
 }
 
 // -- Antivirus methods --
@@ -417,7 +617,7 @@ func (c *ApiClient) FetchAntivirusProducts() ([]AntivirusProduct, error) {
 		return nil, err
 	}
 	var result AntivirusProductResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -431,7 +631,7 @@ func (c *ApiClient) FetchAntivirusDefinitions(deviceID int) ([]AntivirusDefiniti
 		return nil, err
 	}
 	var result AntivirusDefinitionResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -445,7 +645,7 @@ func (c *ApiClient) FetchQuarantineList(deviceID int) ([]QuarantineItem, error)
 		return nil, err
 	}
 	var result QuarantineResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -457,8 +657,7 @@ func (c *ApiClient) StartAntivirusScan(deviceID int, scanType string) error {
 		"deviceid": fmt.Sprintf("%d", deviceID),
 		"scantype": scanType,
 	}
-	_, err := c.callAPI("start_scan", params)
-	return err
+	return c.mutate("start_scan", params)
 }
 
 // -- Performance History methods --
@@ -476,7 +675,7 @@ func (c *ApiClient) FetchPerformanceHistory(deviceID, checkID int, startDate, en
 		return nil, err
 	}
 	var result PerformanceResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -494,7 +693,7 @@ func (c *ApiClient) FetchDriveSpaceHistory(deviceID int, startDate, endDate stri
 		return nil, err
 	}
 	var result PerformanceResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -509,7 +708,7 @@ func (c *ApiClient) FetchTemplates() ([]Template, error) {
 		return nil, err
 	}
 	var result TemplateResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -525,7 +724,7 @@ func (c *ApiClient) FetchBackupSessions(deviceID int) ([]BackupSession, error) {
 		return nil, err
 	}
 	var result BackupSessionResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -540,7 +739,7 @@ func (c *ApiClient) FetchWallChartSettings() ([]Setting, error) {
 		return nil, err
 	}
 	var result SettingResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -553,7 +752,7 @@ func (c *ApiClient) FetchGeneralSettings() ([]Setting, error) {
 		return nil, err
 	}
 	var result SettingResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -569,7 +768,7 @@ func (c *ApiClient) FetchActiveDirectoryUsers(deviceID int) ([]ADUser, error) {
 		return nil, err
 	}
 	var result ADUserResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -578,8 +777,7 @@ func (c *ApiClient) FetchActiveDirectoryUsers(deviceID int) ([]ADUser, error) {
 // RunTaskNow runs a task immediately
 func (c *ApiClient) RunTaskNow(taskID int) error {
 	params := map[string]string{"taskid": fmt.Sprintf("%d", taskID)}
-	_, err := c.callAPI("run_task_now", params)
-	return err
+	return c.mutate("run_task_now", params)
 }
 
 // -- Site Management methods --
@@ -591,8 +789,7 @@ func (c *ApiClient) AddClient(name, contactName, contactEmail string) error {
 		"contactname":  contactName,
 		"contactemail": contactEmail,
 	}
-	_, err := c.callAPI("add_client", params)
-	return err
+	return c.mutate("add_client", params)
 }
 
 // AddSite adds a new site to a client
@@ -603,8 +800,7 @@ func (c *ApiClient) AddSite(clientID int, name, contactName, contactEmail string
 		"contactname":  contactName,
 		"contactemail": contactEmail,
 	}
-	_, err := c.callAPI("add_site", params)
-	return err
+	return c.mutate("add_site", params)
 }
 
 // GetSiteInstallationPackage gets installation package for a site
@@ -630,7 +826,7 @@ func (c *ApiClient) FetchOutages(siteID int, startDate, endDate string) ([]Check
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -650,7 +846,7 @@ func (c *ApiClient) FetchCheckConfiguration(deviceID int, os string) ([]Check, e
 		return nil, err
 	}
 	var result CheckResult
-	if err := decodeXML(bodyBytes, &result); err != nil {
+	if err := c.decodeXML(bodyBytes, &result); err != nil {
 		return nil, err
 	}
 	return result.Items, nil
@@ -0,0 +1,19 @@
+package nsight
+
+import "sync/atomic"
+
+// redactedKey replaces the API key in logged and dry-run URLs
+const redactedKey = "REDACTED"
+
+// debug logs the URL of every call, for every client of the process
+var debug atomic.Bool
+
+// SetDebug turns logging of call URLs on or off
+func SetDebug(on bool) {
+	debug.Store(on)
+}
+
+// Debug reports whether call URLs are logged
+func Debug() bool {
+	return debug.Load()
+}
@@ -0,0 +1,249 @@
+package nsight
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Kinds of failed API calls. An *APIError matches its kind with errors.Is.
+var (
+	ErrUnauthorized = errors.New("API key rejected")
+	ErrForbidden    = errors.New("API key not permitted")
+	ErrNotFound     = errors.New("entity not found")
+	ErrThrottled    = errors.New("request throttled")
+	ErrTimeout      = errors.New("upstream timed out")
+	ErrUnavailable  = errors.New("upstream unreachable")
+	ErrUpstream     = errors.New("upstream error")
+	ErrDecode       = errors.New("invalid upstream response")
+)
+
+// maxMessageLength limits upstream messages kept in errors
+const maxMessageLength = 200
+
+// APIError describes a failed call to the N-Sight API. Message is a short,
+// sanitized excerpt of the upstream response that is safe to show to callers.
+type APIError struct {
+	Service    string
+	Kind       error         // One of the Err* kinds above
+	StatusCode int           // HTTP status of the upstream response, 0 if none was received
+	Code       string        // N-Sight error code, if the response had one
+	Message    string        // Sanitized upstream message
+	RetryAfter time.Duration // Wait requested by a throttled response
+	Err        error         // Underlying transport or parse error
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("API (%s): %v", e.Service, e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	} else if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap exposes both the kind and the underlying error to errors.Is and errors.As
+func (e *APIError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// transportError classifies a failure to get any response from N-Sight.
+// The request URL, which contains the API key, is stripped from the message.
+func transportError(service string, err error) *APIError {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	kind := ErrUnavailable
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		kind = ErrTimeout
+	}
+	return &APIError{Service: service, Kind: kind, Err: err}
+}
+
+// statusError builds the error for a non-OK HTTP response
+func statusError(service string, resp *http.Response, body []byte) *APIError {
+	code, message := failureMessage(body)
+	e := &APIError{
+		Service:    service,
+		StatusCode: resp.StatusCode,
+		Code:       code,
+		Message:    message,
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		e.Kind = ErrUnauthorized
+	case http.StatusForbidden:
+		e.Kind = ErrForbidden
+	case http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case http.StatusTooManyRequests:
+		e.Kind = ErrThrottled
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		e.Kind = ErrTimeout
+	default:
+		e.Kind = classifyMessage(message, ErrUpstream)
+	}
+	return e
+}
+
+// failureResult is the error response N-Sight returns with status="FAIL"
+type failureResult struct {
+	Status string `xml:"status,attr"`
+	Error  struct {
+		Code    string `xml:"errorcode"`
+		Message string `xml:"message"`
+		Text    string `xml:",chardata"`
+	} `xml:"error"`
+}
+
+// checkFailure returns an error if an OK response reports a failed call
+func checkFailure(service string, body []byte) *APIError {
+	if !bytes.Contains(body, []byte(`status="FAIL"`)) {
+		return nil
+	}
+	code, message := failureMessage(body)
+	return &APIError{
+		Service:    service,
+		Kind:       classifyMessage(message, ErrUpstream),
+		StatusCode: http.StatusOK,
+		Code:       code,
+		Message:    message,
+	}
+}
+
+// failureMessage extracts the error code and a sanitized message from an error response
+func failureMessage(body []byte) (string, string) {
+	var result failureResult
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&result); err == nil {
+		message := result.Error.Message
+		if message == "" {
+			message = result.Error.Text
+		}
+		if message = sanitizeMessage(message); message != "" {
+			return strings.TrimSpace(result.Error.Code), message
+		}
+	}
+	// Not an N-Sight error document, keep only its text
+	return "", sanitizeMessage(tagPattern.ReplaceAllString(string(body), " "))
+}
+
+// maxResponseExcerpt limits upstream responses kept in audit records
+const maxResponseExcerpt = 2000
+
+// responseExcerpt returns a response body with collapsed whitespace, truncated for audit records
+func responseExcerpt(body []byte) string {
+	excerpt := strings.Join(strings.Fields(string(body)), " ")
+	if runes := []rune(excerpt); len(runes) > maxResponseExcerpt {
+		excerpt = string(runes[:maxResponseExcerpt]) + "…"
+	}
+	return excerpt
+}
+
+// tagPattern matches XML and HTML tags
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// sanitizeMessage collapses whitespace, drops control characters and truncates
+func sanitizeMessage(message string) string {
+	message = strings.Join(strings.FieldsFunc(message, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if runes := []rune(message); len(runes) > maxMessageLength {
+		message = string(runes[:maxMessageLength]) + "…"
+	}
+	return message
+}
+
+// messageKinds map phrases in N-Sight error messages to kinds
+var messageKinds = []struct {
+	phrases []string
+	kind    error
+}{
+	{[]string{"api key", "apikey", "authenticat"}, ErrUnauthorized},
+	{[]string{"permission", "not allowed", "access denied"}, ErrForbidden},
+	{[]string{"not found", "does not exist", "no such", "unknown device", "unknown client", "unknown site", "invalid device", "invalid client", "invalid site", "invalid check"}, ErrNotFound},
+	{[]string{"too many", "rate limit", "throttl"}, ErrThrottled},
+}
+
+// classifyMessage guesses the kind of a failure from its message
+func classifyMessage(message string, fallback error) error {
+	lower := strings.ToLower(message)
+	for _, entry := range messageKinds {
+		for _, phrase := range entry.phrases {
+			if strings.Contains(lower, phrase) {
+				return entry.kind
+			}
+		}
+	}
+	return fallback
+}
+
+// Outcome names the result of a call: "ok" or the kind of error, as used in
+// metrics and audit records
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrThrottled):
+		return "throttled"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	}
+	return "error"
+}
+
+// resultTypeName returns the name of the type a response is decoded into.
+// Anonymous result structs are named after the items they hold.
+func resultTypeName(target interface{}) string {
+	t := reflect.TypeOf(target)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return "unknown"
+	}
+	if t.Name() != "" {
+		return t.Name()
+	}
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i).Type; field.Kind() == reflect.Slice && field.Elem().Name() != "" {
+				return "[]" + field.Elem().Name()
+			}
+		}
+	}
+	return "unknown"
+}
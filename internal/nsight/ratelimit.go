@@ -0,0 +1,75 @@
+package nsight
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"nsight-proxy/internal/metrics"
+)
+
+// The limiter is shared by all API clients of the process, since N-Sight
+// throttles per account rather than per connection. nil means unlimited.
+var (
+	limiterMu sync.RWMutex
+	limiter   *rate.Limiter
+)
+
+// SetRateLimit limits API calls to perSecond with bursts of up to burst calls.
+// A zero or negative rate removes the limit.
+func SetRateLimit(perSecond float64, burst int) {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	if perSecond <= 0 {
+		limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(perSecond)))
+	}
+	limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// currentLimiter returns the configured limiter
+func currentLimiter() *rate.Limiter {
+	limiterMu.RLock()
+	defer limiterMu.RUnlock()
+	return limiter
+}
+
+// waitForRateLimit blocks until the limiter allows another call and records the wait
+func waitForRateLimit(ctx context.Context) error {
+	l := currentLimiter()
+	if l == nil {
+		return nil
+	}
+	start := time.Now()
+	err := l.Wait(ctx)
+	metrics.RateLimitWait.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// RateLimitState describes the shared limiter at one point in time
+type RateLimitState struct {
+	Limited   bool    // False if calls are not limited
+	PerSecond float64 // Configured rate
+	Burst     int     // Configured burst
+	Tokens    float64 // Calls available right now, negative while callers are waiting
+}
+
+// CurrentRateLimit returns the state of the shared limiter
+func CurrentRateLimit() RateLimitState {
+	l := currentLimiter()
+	if l == nil {
+		return RateLimitState{}
+	}
+	return RateLimitState{
+		Limited:   true,
+		PerSecond: float64(l.Limit()),
+		Burst:     l.Burst(),
+		Tokens:    l.Tokens(),
+	}
+}
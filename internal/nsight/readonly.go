@@ -0,0 +1,30 @@
+package nsight
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrReadOnly is returned for calls that change data while the process is read-only
+var ErrReadOnly = errors.New("read-only mode, changes to N-Sight are disabled")
+
+// readOnly refuses all calls that change data, for every client of the process
+var readOnly atomic.Bool
+
+// SetReadOnly turns read-only mode on or off
+func SetReadOnly(on bool) {
+	readOnly.Store(on)
+}
+
+// ReadOnly reports whether calls that change data are refused
+func ReadOnly() bool {
+	return readOnly.Load()
+}
+
+// Call is a call that changes data, as recorded by a dry-run client instead
+// of being made
+type Call struct {
+	Service string            `json:"service"`
+	Params  map[string]string `json:"params"`
+	URL     string            `json:"url"` // With the API key redacted
+}
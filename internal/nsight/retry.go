@@ -0,0 +1,86 @@
+package nsight
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/config"
+)
+
+// Retry settings are shared by all API clients of the process, like the rate limit
+var (
+	retryMu      sync.RWMutex
+	retries      int
+	retryBackoff = time.Second
+)
+
+// maxRetryWait caps the wait between two attempts, including Retry-After
+const maxRetryWait = time.Minute
+
+// Configure applies the client settings of a loaded config: the call
+// timeout, retries, the rate limit, read-only mode and debug logging. It is meant to be
+// called once at startup.
+func Configure(c config.Client) {
+	httpClient.Timeout = c.Timeout.D()
+	SetReadOnly(c.ReadOnly)
+	SetDebug(c.Debug)
+	SetRetries(c.Retries, c.RetryBackoff.D())
+	SetRateLimit(c.RateLimit, c.RateBurst)
+	if c.RateLimit > 0 {
+		state := CurrentRateLimit()
+		log.Printf("Limiting N-Sight API calls to %g per second (burst %d)", state.PerSecond, state.Burst)
+	}
+}
+
+// SetRetries repeats read calls that failed with a transient error up to n
+// times, waiting backoff before the first repeat and twice as long each time
+func SetRetries(n int, backoff time.Duration) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retries = max(n, 0)
+	retryBackoff = backoff
+}
+
+// retrySettings returns the configured retries and backoff
+func retrySettings() (int, time.Duration) {
+	retryMu.RLock()
+	defer retryMu.RUnlock()
+	return retries, retryBackoff
+}
+
+// transient reports whether a failed call may succeed when repeated
+func transient(err error) bool {
+	if errors.Is(err, ErrThrottled) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable) {
+		return true
+	}
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode >= 500
+}
+
+// withRetries runs call, repeating it while it fails with a transient error.
+// Only calls without side effects may be repeated.
+func withRetries(ctx context.Context, service string, call func() ([]byte, error)) ([]byte, error) {
+	n, wait := retrySettings()
+	for attempt := 0; ; attempt++ {
+		body, err := call()
+		if err == nil || attempt >= n || !transient(err) {
+			return body, err
+		}
+		delay := wait
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		delay = min(delay, maxRetryWait)
+		log.Printf("Warning: %s failed (%s), retrying in %s (%d/%d)", service, Outcome(err), delay, attempt+1, n)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		wait *= 2
+	}
+}
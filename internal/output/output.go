@@ -0,0 +1,175 @@
+// Package output renders command line results as JSON, YAML, delimited text,
+// aligned tables or Go templates, for people and for shell pipelines alike.
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"nsight-proxy/internal/export"
+)
+
+// Formats accepted by Parse
+const (
+	FormatJSON     = "json"
+	FormatNDJSON   = "ndjson"
+	FormatYAML     = "yaml"
+	FormatCSV      = "csv"
+	FormatTSV      = "tsv"
+	FormatTable    = "table"
+	FormatWide     = "wide"
+	FormatTemplate = "template"
+)
+
+// Formats lists the format names for usage texts
+const Formats = "table|wide|csv|tsv|yaml|json|ndjson|template=TEXT|template-file=PATH"
+
+// Options selects how a result is written
+type Options struct {
+	Format   string
+	Template string   // Template text of FormatTemplate
+	Columns  []string // Columns of table, wide, csv and tsv output, empty for the defaults
+	NoHeader bool     // Omit the header row of table, wide, csv and tsv output
+}
+
+// Parse reads a format given as a name, template=TEXT or template-file=PATH
+func Parse(value string) (Options, error) {
+	name, arg, hasArg := strings.Cut(value, "=")
+	switch strings.ToLower(name) {
+	case "", FormatJSON:
+		return Options{Format: FormatJSON}, nil
+	case FormatNDJSON, FormatYAML, FormatCSV, FormatTSV, FormatTable, FormatWide:
+		if hasArg {
+			return Options{}, fmt.Errorf("format %s takes no argument", name)
+		}
+		return Options{Format: strings.ToLower(name)}, nil
+	case "yml":
+		return Options{Format: FormatYAML}, nil
+	case FormatTemplate, "go-template":
+		if arg == "" {
+			return Options{}, fmt.Errorf("format %s needs a template, e.g. %s='{{.Name}}'", name, name)
+		}
+		return Options{Format: FormatTemplate, Template: arg}, nil
+	case "template-file", "go-template-file":
+		text, err := os.ReadFile(arg)
+		if err != nil {
+			return Options{}, fmt.Errorf("failed to read template: %w", err)
+		}
+		return Options{Format: FormatTemplate, Template: string(text)}, nil
+	}
+	return Options{}, fmt.Errorf("unsupported output format %q, expected one of %s", value, Formats)
+}
+
+// Write renders data, any value that marshals to JSON, to w. Fields are
+// named as in the JSON output.
+func Write(w io.Writer, data interface{}, opts Options) error {
+	// A nil list is an empty result, not a null one
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice && v.IsNil() {
+		data = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+	if opts.Format == "" || opts.Format == FormatJSON {
+		body, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(body))
+		return err
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	switch opts.Format {
+	case FormatNDJSON:
+		return export.StreamNDJSON(w, body, nil)
+	case FormatYAML:
+		return writeYAML(w, body)
+	case FormatTemplate:
+		return writeTemplate(w, body, opts.Template)
+	case FormatCSV, FormatTSV, FormatTable, FormatWide:
+		return writeTable(w, data, body, opts)
+	}
+	return fmt.Errorf("unsupported output format %q", opts.Format)
+}
+
+// writeYAML converts the JSON document to block-style YAML, keeping the
+// order of the fields
+func writeYAML(w io.Writer, body []byte) error {
+	var node yaml.Node
+	if err := yaml.Unmarshal(body, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// blockStyle clears the flow style and quoting the JSON input left on nodes
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// templateFuncs are available in templates besides the text/template builtins
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		body, err := json.Marshal(value)
+		return string(body), err
+	},
+	"join": func(separator string, list []interface{}) string {
+		parts := make([]string, len(list))
+		for i, item := range list {
+			parts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(parts, separator)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// writeTemplate executes the template for each item of a list, or once for
+// any other result, ending each output with a newline
+func writeTemplate(w io.Writer, body []byte, text string) error {
+	tmpl, err := template.New("output").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	for _, item := range items {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, item); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+			b.WriteByte('\n')
+		}
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"nsight-proxy/internal/audit"
+	"nsight-proxy/internal/export"
+	"nsight-proxy/internal/nsight"
+	"nsight-proxy/internal/overview"
+)
+
+// maxCellWidth truncates the cells of table output, wide output is not truncated
+const maxCellWidth = 60
+
+// defaultColumns are the table columns of known result types, by the type of
+// the result or of its items. Other results show their top-level fields.
+var defaultColumns = map[reflect.Type][]string{
+	reflect.TypeOf(nsight.Client{}):              {"ClientID", "Name"},
+	reflect.TypeOf(nsight.Site{}):                {"SiteID", "Name"},
+	reflect.TypeOf(nsight.Server{}):              {"ServerID", "Name", "OS", "IP", "Online", "User"},
+	reflect.TypeOf(nsight.Workstation{}):         {"WorkstationID", "Name", "OS", "IP", "Online", "User"},
+	reflect.TypeOf(nsight.Device{}):              {"DeviceID", "DeviceName", "DeviceType", "ClientName", "SiteName", "Online", "IP"},
+	reflect.TypeOf(nsight.AgentlessAsset{}):      {"AssetID", "Name", "Type", "IP", "MAC", "SiteName"},
+	reflect.TypeOf(nsight.Check{}):               {"CheckID", "DeviceName", "Name", "Severity", "Message", "LastCheck"},
+	reflect.TypeOf(nsight.HardwareItem{}):        {"HardwareID", "Name", "Manufacturer", "Details", "Status"},
+	reflect.TypeOf(nsight.SoftwareItem{}):        {"Name", "Version", "InstallDate", "Type"},
+	reflect.TypeOf(nsight.AssetDetails{}):        {"Manufacturer", "Model", "SerialNumber", "OS", "IP", "MAC1", "RAM", "ScanTime"},
+	reflect.TypeOf(nsight.LicenseGroup{}):        {"GroupID", "Name", "Publisher", "Version", "Count"},
+	reflect.TypeOf(nsight.Patch{}):               {"PatchID", "Name", "Severity", "Status", "Released", "Installed"},
+	reflect.TypeOf(nsight.AntivirusProduct{}):    {"ProductID", "Name", "Vendor", "Supported"},
+	reflect.TypeOf(nsight.AntivirusDefinition{}): {"DeviceName", "ProductName", "Version", "ReleaseDate"},
+	reflect.TypeOf(nsight.QuarantineItem{}):      {"ItemID", "DeviceName", "ThreatName", "FilePath", "Quarantined"},
+	reflect.TypeOf(nsight.Template{}):            {"TemplateID", "Name", "OS", "DeviceType", "CheckCount"},
+	reflect.TypeOf(nsight.PerformanceData{}):     {"Timestamp", "Value", "Unit"},
+	reflect.TypeOf(nsight.BackupSession{}):       {"SessionID", "DeviceName", "Type", "Status", "StartTime", "EndTime"},
+	reflect.TypeOf(nsight.Setting{}):             {"Section", "Name", "Value"},
+	reflect.TypeOf(nsight.ADUser{}):              {"Name", "DisplayName", "Email", "Domain", "LastLogon", "Enabled"},
+	reflect.TypeOf(overview.Device{}):            {"device_id", "location.device_name", "location.device_type", "location.client_name", "location.site_name", "generated_at"},
+	reflect.TypeOf(audit.Record{}):               {"time", "tool", "user", "service", "targets", "outcome", "error"},
+}
+
+// columnsFor returns the default table columns of a result, nil if its type is not known
+func columnsFor(data interface{}) []string {
+	t := reflect.TypeOf(data)
+	for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice) {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil
+	}
+	return defaultColumns[t]
+}
+
+// writeTable renders a result flattened into rows. Table output shows the
+// default columns of the result type, the other formats all columns, unless
+// columns are selected. Rows that only differ in columns left out are
+// written once.
+func writeTable(w io.Writer, data interface{}, body []byte, opts Options) error {
+	table, err := export.Flatten(body)
+	if err != nil {
+		return err
+	}
+
+	columns := opts.Columns
+	if len(columns) == 0 && opts.Format == FormatTable {
+		columns = columnsFor(data)
+		if columns == nil {
+			columns = topLevel(table.Columns)
+		}
+	}
+	if len(columns) > 0 {
+		if len(table.Rows) == 0 {
+			table.Columns = columns
+		} else {
+			table.Select(columns)
+			if len(table.Columns) == 0 {
+				return fmt.Errorf("no columns match %s", strings.Join(columns, ","))
+			}
+		}
+		table.Rows = slices.CompactFunc(table.Rows, slices.Equal[[]string])
+	}
+
+	switch opts.Format {
+	case FormatTSV:
+		// Unquoted, one record per line, for cut, awk and read
+		if !opts.NoHeader {
+			if _, err := fmt.Fprintln(w, strings.Join(table.Columns, "\t")); err != nil {
+				return err
+			}
+		}
+		for _, row := range table.Rows {
+			cells := make([]string, len(row))
+			for i, value := range row {
+				cells[i] = cell(value, false)
+			}
+			if _, err := fmt.Fprintln(w, strings.Join(cells, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if !opts.NoHeader {
+			if err := writer.Write(table.Columns); err != nil {
+				return err
+			}
+		}
+		return writer.WriteAll(table.Rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if !opts.NoHeader {
+		headers := make([]string, len(table.Columns))
+		for i, column := range table.Columns {
+			headers[i] = headerName(column)
+		}
+		fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	}
+	for _, row := range table.Rows {
+		cells := make([]string, len(row))
+		for i, value := range row {
+			cells[i] = cell(value, opts.Format == FormatTable)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// topLevel keeps the columns that are not nested in objects or lists
+func topLevel(columns []string) []string {
+	var result []string
+	for _, column := range columns {
+		if !strings.Contains(column, ".") {
+			result = append(result, column)
+		}
+	}
+	return result
+}
+
+// cell prepares a value for an aligned column, on one line and optionally truncated
+func cell(value string, truncate bool) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if runes := []rune(value); truncate && len(runes) > maxCellWidth {
+		value = string(runes[:maxCellWidth-1]) + "…"
+	}
+	return value
+}
+
+// headerName turns a column such as DeviceName or location.site_name into
+// an upper-case header like DEVICE NAME or LOCATION SITE NAME
+func headerName(column string) string {
+	var b strings.Builder
+	runes := []rune(column)
+	for i, r := range runes {
+		switch {
+		case r == '.' || r == '_':
+			b.WriteByte(' ')
+			continue
+		case i > 0 && unicode.IsUpper(r):
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
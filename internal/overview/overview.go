@@ -0,0 +1,205 @@
+// Package overview assembles everything known about one device from several
+// N-Sight services into a single document.
+package overview
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// Defaults for the history parts of an overview
+const (
+	DefaultDays           = 7
+	DefaultBackupSessions = 10
+)
+
+// Options bound the history parts of an overview
+type Options struct {
+	Days           int // Days of drive space history
+	BackupSessions int // Most recent backup sessions kept
+}
+
+// PartError annotates a part of the overview that could not be fetched
+type PartError struct {
+	Part  string `json:"part"`
+	Kind  string `json:"kind"` // Kind of the error, as in nsight.Outcome
+	Error string `json:"error"`
+}
+
+// Device is the merged view of one device. Parts that failed are left empty
+// and listed in Errors.
+type Device struct {
+	DeviceID             int                          `json:"device_id"`
+	Location             *inventory.DeviceLocation    `json:"location,omitempty"`
+	Server               *nsight.Server               `json:"server,omitempty"`
+	Workstation          *nsight.Workstation          `json:"workstation,omitempty"`
+	AssetDetails         *nsight.AssetDetails         `json:"asset_details,omitempty"`
+	Checks               []nsight.Check               `json:"checks"`
+	PendingPatches       []nsight.Patch               `json:"pending_patches"`
+	AntivirusDefinitions []nsight.AntivirusDefinition `json:"antivirus_definitions"`
+	Quarantine           []nsight.QuarantineItem      `json:"quarantine"`
+	BackupSessions       []nsight.BackupSession       `json:"backup_sessions"`
+	DriveSpaceHistory    []nsight.PerformanceData     `json:"drive_space_history"`
+	Errors               []PartError                  `json:"errors,omitempty"`
+	GeneratedAt          time.Time                    `json:"generated_at"`
+
+	parts int              // Number of parts fetched
+	errs  map[string]error // Errors by part
+}
+
+// Err returns an error if every part failed, typically because of a rejected
+// API key or an unreachable N-Sight. Partial failures only annotate Errors.
+func (d *Device) Err() error {
+	if len(d.Errors) < d.parts {
+		return nil
+	}
+	return d.errs[d.Errors[0].Part]
+}
+
+// part fetches one section of the overview
+type part struct {
+	name  string
+	fetch func() error
+}
+
+// Build fetches all parts of the overview of a device in parallel. location,
+// usually found in the name index, is needed for the server or
+// workstation listing; without it that part is reported as an error.
+func Build(client *nsight.ApiClient, deviceID int, location *inventory.DeviceLocation, opts Options) *Device {
+	if opts.Days <= 0 {
+		opts.Days = DefaultDays
+	}
+	if opts.BackupSessions <= 0 {
+		opts.BackupSessions = DefaultBackupSessions
+	}
+	d := &Device{DeviceID: deviceID, Location: location, GeneratedAt: time.Now().UTC(), errs: make(map[string]error)}
+	end := time.Now()
+	start := end.AddDate(0, 0, -opts.Days)
+
+	parts := []part{
+		{"listing", func() error { return d.fetchListing(client) }},
+		{"asset_details", func() (err error) {
+			d.AssetDetails, err = client.FetchDeviceAssetDetails(deviceID)
+			return err
+		}},
+		{"checks", func() (err error) {
+			d.Checks, err = client.FetchDeviceMonitoringDetails(deviceID)
+			return err
+		}},
+		{"pending_patches", func() error {
+			patches, err := client.FetchPatches(deviceID)
+			d.PendingPatches = pendingPatches(patches)
+			return err
+		}},
+		{"antivirus_definitions", func() (err error) {
+			d.AntivirusDefinitions, err = client.FetchAntivirusDefinitions(deviceID)
+			return err
+		}},
+		{"quarantine", func() (err error) {
+			d.Quarantine, err = client.FetchQuarantineList(deviceID)
+			return err
+		}},
+		{"backup_sessions", func() error {
+			sessions, err := client.FetchBackupSessions(deviceID)
+			d.BackupSessions = recentSessions(sessions, opts.BackupSessions)
+			return err
+		}},
+		{"drive_space_history", func() (err error) {
+			d.DriveSpaceHistory, err = client.FetchDriveSpaceHistory(deviceID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+			return err
+		}},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.fetch(); err != nil {
+				mu.Lock()
+				d.Errors = append(d.Errors, PartError{Part: p.name, Kind: nsight.Outcome(err), Error: err.Error()})
+				d.errs[p.name] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	d.parts = len(parts)
+	sort.Slice(d.Errors, func(i, j int) bool { return d.Errors[i].Part < d.Errors[j].Part })
+
+	// Keep lists as [] rather than null in JSON
+	d.Checks = nonNil(d.Checks)
+	d.PendingPatches = nonNil(d.PendingPatches)
+	d.AntivirusDefinitions = nonNil(d.AntivirusDefinitions)
+	d.Quarantine = nonNil(d.Quarantine)
+	d.BackupSessions = nonNil(d.BackupSessions)
+	d.DriveSpaceHistory = nonNil(d.DriveSpaceHistory)
+	return d
+}
+
+// fetchListing finds the device in the server or workstation list of its site
+func (d *Device) fetchListing(client *nsight.ApiClient) error {
+	if d.Location == nil {
+		return fmt.Errorf("device %d is not in the name index, run fetchall to include its listing", d.DeviceID)
+	}
+	if d.Location.DeviceType != inventory.DeviceWorkstation {
+		servers, err := client.FetchServers(d.Location.SiteID)
+		if err != nil {
+			return err
+		}
+		for i := range servers {
+			if servers[i].ServerID == d.DeviceID {
+				d.Server = &servers[i]
+				return nil
+			}
+		}
+	}
+	workstations, err := client.FetchWorkstations(d.Location.SiteID)
+	if err != nil {
+		return err
+	}
+	for i := range workstations {
+		if workstations[i].WorkstationID == d.DeviceID {
+			d.Workstation = &workstations[i]
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: device %d is no longer listed at site %d", nsight.ErrNotFound, d.DeviceID, d.Location.SiteID)
+}
+
+// pendingPatches drops installed and ignored patches
+func pendingPatches(patches []nsight.Patch) []nsight.Patch {
+	var pending []nsight.Patch
+	for _, p := range patches {
+		switch strings.ToLower(p.Status) {
+		case "installed", "ignored":
+			continue
+		}
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// recentSessions keeps the newest sessions by start time
+func recentSessions(sessions []nsight.BackupSession, limit int) []nsight.BackupSession {
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].StartTime > sessions[j].StartTime })
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions
+}
+
+// nonNil returns an empty slice for nil
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
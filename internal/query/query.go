@@ -0,0 +1,98 @@
+// Package query evaluates jq expressions over results, so they can be
+// reshaped without an external jq. Expressions use the gojq dialect of jq.
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/itchyny/gojq"
+)
+
+// Query is a compiled jq expression
+type Query struct {
+	expr string
+	code *gojq.Code
+}
+
+// Parse compiles a jq expression. Functions that read the environment or
+// files are not available.
+func Parse(expr string) (*Query, error) {
+	parsed, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %w", expr, err)
+	}
+	code, err := gojq.Compile(parsed, gojq.WithEnvironLoader(func() []string { return nil }))
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %w", expr, err)
+	}
+	return &Query{expr: expr, code: code}, nil
+}
+
+// String returns the expression
+func (q *Query) String() string {
+	return q.expr
+}
+
+// Run evaluates the query over data, any value that marshals to JSON, and
+// returns every value the expression emits. Fields are named as in the JSON
+// form of data.
+func (q *Query) Run(ctx context.Context, data interface{}) ([]interface{}, error) {
+	// A nil list is an empty result, so .[] yields nothing instead of failing
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice && v.IsNil() {
+		data = []interface{}{}
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return q.RunJSON(ctx, body)
+}
+
+// RunJSON evaluates the query over a JSON document
+func (q *Query) RunJSON(ctx context.Context, body []byte) ([]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // Keeps large IDs exact
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("result is not valid JSON: %w", err)
+	}
+
+	results := []interface{}{}
+	iter := q.code.RunWithContext(ctx, value)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return results, nil
+		}
+		if err, isErr := v.(error); isErr {
+			if halt, isHalt := err.(*gojq.HaltError); isHalt && halt.Value() == nil {
+				return results, nil
+			}
+			return nil, fmt.Errorf("query %q: %w", q.expr, err)
+		}
+		results = append(results, v)
+	}
+}
+
+// Apply evaluates the query over a JSON document and returns the result as
+// JSON: a single emitted value as it is, several as an array
+func (q *Query) Apply(ctx context.Context, body []byte) ([]byte, error) {
+	results, err := q.RunJSON(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Collapse(results))
+}
+
+// Collapse returns a single result as it is and any other number of results
+// as a list
+func Collapse(results []interface{}) interface{} {
+	if len(results) == 1 {
+		return results[0]
+	}
+	return results
+}
@@ -0,0 +1,329 @@
+// Package resolver turns client, site and device names into IDs using a
+// local index of the account's tree. The index is persisted next to the
+// fetchall cache and rebuilt when it is older than its TTL, so resolving a
+// name costs no API calls while the index is fresh.
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// IndexFile is the name of the index in the cache directory
+const IndexFile = "resolver.json"
+
+// Sources an index can be built from
+const (
+	SourceFetchall = "fetchall"
+	SourceAPI      = "api"
+)
+
+// refreshInterval is the minimum age of an index built from the API before
+// a name missing from it triggers another rebuild
+const refreshInterval = 5 * time.Minute
+
+// ErrNotFound is wrapped by the errors for unknown client and site names
+var ErrNotFound = errors.New("not found")
+
+// ErrAmbiguous matches the errors for names of several clients or sites
+var ErrAmbiguous = errors.New("ambiguous name")
+
+// ambiguousError lists the clients or sites a name matches
+type ambiguousError string
+
+func (e ambiguousError) Error() string { return string(e) }
+
+// Is makes an ambiguousError match ErrAmbiguous
+func (e ambiguousError) Is(target error) bool { return target == ErrAmbiguous }
+
+// Index is the tree of clients, sites and optionally devices. Devices carry
+// only the values they can be resolved by.
+type Index struct {
+	Built   time.Time
+	Source  string // SourceFetchall or SourceAPI
+	Devices bool   // Servers and workstations are included
+	Clients []inventory.ClientDetail
+}
+
+// Resolver resolves names of one N-Sight account
+type Resolver struct {
+	dir    string
+	ttl    time.Duration
+	client func() (*nsight.ApiClient, error) // Client for rebuilds, nil to use only local data
+
+	mu    sync.Mutex
+	index *Index
+}
+
+// New creates a resolver for the cache directory dir. Indexes older than ttl
+// are rebuilt from a fresh fetchall cache in dir or, with a client, from the API.
+func New(dir string, ttl time.Duration, client func() (*nsight.ApiClient, error)) *Resolver {
+	return &Resolver{dir: dir, ttl: ttl, client: client}
+}
+
+// Save writes an index of clients, as fetched by fetchall, to dir
+func Save(dir string, clients []inventory.ClientDetail) error {
+	return writeIndex(dir, &Index{Built: time.Now(), Source: SourceFetchall, Devices: true, Clients: compact(clients)})
+}
+
+// ClientID resolves a client ID or a case-insensitive client name
+func (r *Resolver) ClientID(identifier string) (int, error) {
+	if id, err := strconv.Atoi(identifier); err == nil {
+		return id, nil
+	}
+	var id int
+	err := r.lookup(false, identifier, func(clients []inventory.ClientDetail) error {
+		var matches []string
+		for _, client := range clients {
+			if strings.EqualFold(client.Name, identifier) {
+				id = client.ID
+				matches = append(matches, fmt.Sprintf("%d %s", client.ID, client.Name))
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("client %q %w", identifier, ErrNotFound)
+		case 1:
+			return nil
+		}
+		return ambiguousError(fmt.Sprintf("%q matches %d clients, use an ID: %s", identifier, len(matches), strings.Join(matches, ", ")))
+	})
+	return id, err
+}
+
+// SiteID resolves a site ID or a case-insensitive site name, optionally only
+// among the sites of the client given by ID or name
+func (r *Resolver) SiteID(identifier, client string) (int, error) {
+	if id, err := strconv.Atoi(identifier); err == nil {
+		return id, nil
+	}
+	var id int
+	err := r.lookup(false, identifier, func(clients []inventory.ClientDetail) error {
+		var matches []string
+		for _, c := range inventory.Select(clients, client, identifier) {
+			for _, site := range c.Sites {
+				id = site.ID
+				matches = append(matches, fmt.Sprintf("%d %s (%s)", site.ID, site.Name, c.Name))
+			}
+		}
+		switch len(matches) {
+		case 0:
+			if client != "" {
+				return fmt.Errorf("site %q of client %s %w", identifier, client, ErrNotFound)
+			}
+			return fmt.Errorf("site %q %w", identifier, ErrNotFound)
+		case 1:
+			return nil
+		}
+		return ambiguousError(fmt.Sprintf("%q matches %d sites, use an ID or -client: %s", identifier, len(matches), strings.Join(matches, ", ")))
+	})
+	return id, err
+}
+
+// Device resolves a device like inventory.ResolveDevice. If keep is not
+// nil, only devices of the clients it accepts are considered.
+func (r *Resolver) Device(q inventory.DeviceQuery, keep func(inventory.ClientDetail) bool) (*inventory.DeviceLocation, error) {
+	var location *inventory.DeviceLocation
+	err := r.lookup(true, q.Identifier, func(clients []inventory.ClientDetail) error {
+		if keep != nil {
+			clients = inventory.FilterClients(clients, keep)
+		}
+		var err error
+		location, err = inventory.ResolveDevice(clients, q)
+		return err
+	})
+	return location, err
+}
+
+// Locate places a device ID in the tree of whatever index is at hand, stale
+// or not, without rebuilding it. It returns nil if the device is not known
+// or not accepted by keep.
+func (r *Resolver) Locate(deviceID int, keep func(inventory.ClientDetail) bool) *inventory.DeviceLocation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		r.index, _ = readIndex(r.dir)
+	}
+	if r.index == nil {
+		return nil
+	}
+	clients := r.index.Clients
+	if keep != nil {
+		clients = inventory.FilterClients(clients, keep)
+	}
+	location, err := inventory.ResolveDevice(clients, inventory.DeviceQuery{Identifier: strconv.Itoa(deviceID), Exact: true})
+	if err != nil || location.Match != inventory.MatchID {
+		return nil
+	}
+	return location
+}
+
+// Clients returns the tree of the index, with devices if the index has them.
+// A stale index is used as it is and nothing is fetched from the API, so the
+// result may be incomplete.
+func (r *Resolver) Clients() ([]inventory.ClientDetail, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := r.client
+	r.client = nil
+	defer func() { r.client = client }()
+	index, err := r.current(false)
+	if err != nil {
+		return nil, err
+	}
+	return index.Clients, nil
+}
+
+// lookup runs find on the index. A name that is not found in an index that
+// was not just built from the API triggers one rebuild from the API, since
+// the name may have been added after the index was built.
+func (r *Resolver) lookup(devices bool, identifier string, find func([]inventory.ClientDetail) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index, err := r.current(devices)
+	if err != nil {
+		return err
+	}
+	err = find(index.Clients)
+	if !errors.Is(err, ErrNotFound) && !errors.Is(err, inventory.ErrNoDevice) {
+		return err
+	}
+	if _, numeric := strconv.Atoi(identifier); numeric == nil || r.client == nil {
+		return err
+	}
+	if index.Source == SourceAPI && time.Since(index.Built) < refreshInterval {
+		return err
+	}
+	log.Printf("%q is not in the name index, rebuilding it from the API", identifier)
+	if index, err = r.rebuild(devices); err != nil {
+		return err
+	}
+	return find(index.Clients)
+}
+
+// current returns a fresh index that covers devices if needed, rebuilding it
+// when necessary. It must be called with r.mu held.
+func (r *Resolver) current(devices bool) (*Index, error) {
+	if r.index == nil {
+		index, err := readIndex(r.dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Ignoring name index: %v", err)
+		}
+		r.index = index
+	}
+	cacheUpdated, cacheErr := inventory.Updated(r.dir)
+	if r.usable(r.index, devices) && (cacheErr != nil || !cacheUpdated.After(r.index.Built)) {
+		return r.index, nil
+	}
+
+	// A fresh fetchall cache holds the whole tree without any API calls
+	if cacheErr == nil && r.fresh(cacheUpdated) {
+		clients, err := inventory.BuildFromCache(r.dir)
+		if err == nil {
+			index := &Index{Built: cacheUpdated, Source: SourceFetchall, Devices: true, Clients: compact(clients)}
+			r.store(index)
+			return index, nil
+		}
+		log.Printf("Warning: Failed to read fetchall cache for the name index: %v", err)
+	}
+
+	if r.client == nil {
+		if r.index != nil && (r.index.Devices || !devices) {
+			log.Printf("Warning: Using name index from %s, it is older than %s", r.index.Built.Format(time.RFC3339), r.ttl)
+			return r.index, nil
+		}
+		return nil, fmt.Errorf("no name index in %s, run fetchall first", r.dir)
+	}
+	return r.rebuild(devices)
+}
+
+// usable reports whether index is fresh and covers devices if needed
+func (r *Resolver) usable(index *Index, devices bool) bool {
+	return index != nil && (index.Devices || !devices) && r.fresh(index.Built)
+}
+
+// fresh reports whether data built at t is younger than the TTL
+func (r *Resolver) fresh(t time.Time) bool {
+	return r.ttl > 0 && time.Since(t) < r.ttl
+}
+
+// rebuild builds the index from the API. Devices cost two calls per site and
+// are only fetched when a device is being resolved.
+func (r *Resolver) rebuild(devices bool) (*Index, error) {
+	client, err := r.client()
+	if err != nil {
+		return nil, fmt.Errorf("could not build name index: %w", err)
+	}
+	what := "clients and sites"
+	if devices {
+		what = "clients, sites and devices"
+	}
+	log.Printf("Building name index of %s from the API...", what)
+	clients, err := fetchTree(client, devices)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{Built: time.Now(), Source: SourceAPI, Devices: devices, Clients: clients}
+	r.store(index)
+	return index, nil
+}
+
+// store keeps index in memory and persists it. A failed write only costs
+// the next process a rebuild.
+func (r *Resolver) store(index *Index) {
+	r.index = index
+	if err := writeIndex(r.dir, index); err != nil {
+		log.Printf("Warning: Failed to save name index: %v", err)
+	}
+}
+
+// fetchTree lists the clients and sites and, if devices is set, the servers
+// and workstations of every site
+func fetchTree(client *nsight.ApiClient, devices bool) ([]inventory.ClientDetail, error) {
+	clients, err := client.FetchClients()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch client list for the name index: %w", err)
+	}
+	tree := make([]inventory.ClientDetail, 0, len(clients))
+	for _, c := range clients {
+		detail := inventory.ClientDetail{ID: c.ClientID, Name: c.Name}
+		sites, err := client.FetchSites(c.ClientID)
+		if err != nil {
+			log.Printf("Warning: Skipping sites of client %d: %v", c.ClientID, err)
+		}
+		for _, s := range sites {
+			site := inventory.SiteDetail{ID: s.SiteID, Name: s.Name}
+			if devices {
+				servers, err := client.FetchServers(s.SiteID)
+				if err != nil {
+					log.Printf("Warning: Skipping servers of site %d: %v", s.SiteID, err)
+				}
+				for _, server := range servers {
+					site.Servers = append(site.Servers, inventory.ServerDetail{ID: server.ServerID, Name: server.Name, IP: server.IP, DeviceSerial: server.DeviceSerial})
+				}
+				workstations, err := client.FetchWorkstations(s.SiteID)
+				if err != nil {
+					log.Printf("Warning: Skipping workstations of site %d: %v", s.SiteID, err)
+				}
+				for _, ws := range workstations {
+					site.Workstations = append(site.Workstations, inventory.WorkstationDetail{ID: ws.WorkstationID, Name: ws.Name, IP: ws.IP, DeviceSerial: ws.DeviceSerial})
+				}
+			}
+			detail.Sites = append(detail.Sites, site)
+		}
+		tree = append(tree, detail)
+	}
+	sort.Slice(tree, func(i, j int) bool { return tree[i].ID < tree[j].ID })
+	return tree, nil
+}
@@ -0,0 +1,151 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// indexFile is the persisted form of an Index
+type indexFile struct {
+	Built   time.Time     `json:"built"`
+	Source  string        `json:"source"`
+	Devices bool          `json:"devices"`
+	Clients []indexClient `json:"clients"`
+}
+
+type indexClient struct {
+	ID    int         `json:"id"`
+	Name  string      `json:"name"`
+	Sites []indexSite `json:"sites,omitempty"`
+}
+
+type indexSite struct {
+	ID      int           `json:"id"`
+	Name    string        `json:"name"`
+	Devices []indexDevice `json:"devices,omitempty"`
+}
+
+// indexDevice holds the values of the listing and of the asset details a
+// device is resolved by
+type indexDevice struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Type        string   `json:"type"` // inventory.DeviceServer or inventory.DeviceWorkstation
+	Serial      string   `json:"serial,omitempty"`
+	IP          string   `json:"ip,omitempty"`
+	AssetSerial string   `json:"asset_serial,omitempty"`
+	AssetIP     string   `json:"asset_ip,omitempty"`
+	MACs        []string `json:"macs,omitempty"`
+}
+
+// compact copies the tree, keeping only the values devices are resolved by
+func compact(clients []inventory.ClientDetail) []inventory.ClientDetail {
+	return expand(flatten(clients))
+}
+
+// flatten converts a tree to its persisted form
+func flatten(clients []inventory.ClientDetail) []indexClient {
+	result := make([]indexClient, 0, len(clients))
+	for _, c := range clients {
+		client := indexClient{ID: c.ID, Name: c.Name}
+		for _, s := range c.Sites {
+			site := indexSite{ID: s.ID, Name: s.Name}
+			for _, d := range s.Servers {
+				site.Devices = append(site.Devices, newIndexDevice(d.ID, d.Name, inventory.DeviceServer, d.DeviceSerial, d.IP, d.AssetInfo))
+			}
+			for _, d := range s.Workstations {
+				site.Devices = append(site.Devices, newIndexDevice(d.ID, d.Name, inventory.DeviceWorkstation, d.DeviceSerial, d.IP, d.AssetInfo))
+			}
+			client.Sites = append(client.Sites, site)
+		}
+		result = append(result, client)
+	}
+	return result
+}
+
+// newIndexDevice builds the persisted form of a server or workstation
+func newIndexDevice(id int, name, deviceType, serial, ip string, details *nsight.AssetDetails) indexDevice {
+	d := indexDevice{ID: id, Name: name, Type: deviceType, Serial: serial, IP: ip}
+	if details != nil {
+		d.AssetSerial, d.AssetIP = details.SerialNumber, details.IP
+		for _, mac := range []string{details.MAC1, details.MAC2, details.MAC3} {
+			if mac != "" {
+				d.MACs = append(d.MACs, mac)
+			}
+		}
+	}
+	return d
+}
+
+// expand converts the persisted form back to a tree
+func expand(clients []indexClient) []inventory.ClientDetail {
+	result := make([]inventory.ClientDetail, 0, len(clients))
+	for _, c := range clients {
+		client := inventory.ClientDetail{ID: c.ID, Name: c.Name}
+		for _, s := range c.Sites {
+			site := inventory.SiteDetail{ID: s.ID, Name: s.Name}
+			for _, d := range s.Devices {
+				details := d.assetDetails()
+				if d.Type == inventory.DeviceWorkstation {
+					site.Workstations = append(site.Workstations, inventory.WorkstationDetail{ID: d.ID, Name: d.Name, IP: d.IP, DeviceSerial: d.Serial, AssetInfo: details})
+				} else {
+					site.Servers = append(site.Servers, inventory.ServerDetail{ID: d.ID, Name: d.Name, IP: d.IP, DeviceSerial: d.Serial, AssetInfo: details})
+				}
+			}
+			client.Sites = append(client.Sites, site)
+		}
+		result = append(result, client)
+	}
+	return result
+}
+
+// assetDetails returns the asset values of a device, nil if it has none
+func (d indexDevice) assetDetails() *nsight.AssetDetails {
+	if d.AssetSerial == "" && d.AssetIP == "" && len(d.MACs) == 0 {
+		return nil
+	}
+	details := &nsight.AssetDetails{SerialNumber: d.AssetSerial, IP: d.AssetIP}
+	for i, target := range []*string{&details.MAC1, &details.MAC2, &details.MAC3} {
+		if i < len(d.MACs) {
+			*target = d.MACs[i]
+		}
+	}
+	return details
+}
+
+// readIndex loads the index persisted in dir
+func readIndex(dir string) (*Index, error) {
+	path := filepath.Join(dir, IndexFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Index{Built: file.Built, Source: file.Source, Devices: file.Devices, Clients: expand(file.Clients)}, nil
+}
+
+// writeIndex persists index in dir, replacing the previous one atomically
+func writeIndex(dir string, index *Index) error {
+	data, err := json.Marshal(indexFile{Built: index.Built, Source: index.Source, Devices: index.Devices, Clients: flatten(index.Clients)})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, IndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
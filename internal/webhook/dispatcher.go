@@ -0,0 +1,341 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/metrics"
+)
+
+// Defaults of the delivery options
+const (
+	DefaultAttempts       = 5
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+	DefaultTimeout        = 10 * time.Second
+	DefaultDeadLetter     = "webhooks-dead.jsonl"
+
+	queueSize = 1000 // Pending deliveries per subscription
+)
+
+// Options control retries and the dead-letter file
+type Options struct {
+	Attempts       int           // Delivery attempts before a payload is dead-lettered
+	InitialBackoff time.Duration // Wait before the second attempt, doubled for each further one
+	MaxBackoff     time.Duration
+	Timeout        time.Duration // Per attempt
+	DeadLetter     string        // JSON lines file of undeliverable payloads
+}
+
+// DeadLetter is a payload that could not be delivered
+type DeadLetter struct {
+	Time         time.Time `json:"time"`
+	Subscription string    `json:"subscription"`
+	URL          string    `json:"url"`
+	Event        string    `json:"event"`
+	EventID      uint64    `json:"event_id"`
+	Attempts     int       `json:"attempts"`
+	Status       int       `json:"status,omitempty"` // HTTP status of the last attempt
+	Error        string    `json:"error"`
+	Body         string    `json:"body"`
+}
+
+// Result is the outcome of one delivery attempt
+type Result struct {
+	Status     int
+	RetryAfter time.Duration // Requested by a 429 or 503 response
+	Err        error
+}
+
+// retryable reports whether another attempt may succeed
+func (r Result) retryable() bool {
+	if r.Status == 0 {
+		return true // Network error or timeout
+	}
+	return r.Status == http.StatusRequestTimeout || r.Status == http.StatusTooManyRequests || r.Status >= 500
+}
+
+// delivery is a rendered payload waiting in a subscription's queue
+type delivery struct {
+	payload *Payload
+	body    []byte
+}
+
+// Dispatcher sends the events of a watcher to the matching subscriptions.
+// Each subscription has its own queue, so a slow receiver does not delay others.
+type Dispatcher struct {
+	watcher *checkwatch.Watcher
+	subs    []*Subscription
+	locate  func(deviceID int) *inventory.DeviceLocation
+	opts    Options
+	client  *http.Client
+
+	queues  map[*Subscription]chan delivery
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	deadMu  sync.Mutex
+}
+
+// New creates a dispatcher. locate finds a device in the client and site tree
+// and may return nil.
+func New(watcher *checkwatch.Watcher, subs []*Subscription, locate func(deviceID int) *inventory.DeviceLocation, opts Options) *Dispatcher {
+	if opts.Attempts <= 0 {
+		opts.Attempts = DefaultAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.DeadLetter == "" {
+		opts.DeadLetter = DefaultDeadLetter
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		watcher: watcher,
+		subs:    subs,
+		locate:  locate,
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		queues:  make(map[*Subscription]chan delivery),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Subscriptions returns the configured subscriptions
+func (d *Dispatcher) Subscriptions() []*Subscription {
+	return d.subs
+}
+
+// Start subscribes to the watcher and starts a delivery worker per subscription
+func (d *Dispatcher) Start() {
+	for _, sub := range d.subs {
+		queue := make(chan delivery, queueSize)
+		d.queues[sub] = queue
+		d.workers.Add(1)
+		go d.work(sub, queue)
+	}
+	go d.listen()
+	log.Printf("Delivering failing check changes to %d webhooks", len(d.subs))
+}
+
+// Close stops listening and waits for attempts in progress until ctx ends.
+// Payloads still queued or waiting for a retry are written to the dead-letter file.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.cancel()
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listen queues the watcher's events, resubscribing from the last event when
+// the watcher drops the subscription
+func (d *Dispatcher) listen() {
+	var lastID uint64
+	resume := false
+	for {
+		sub := d.watcher.Subscribe(lastID, resume)
+		for _, event := range sub.Backlog {
+			if event.Type == checkwatch.EventSnapshot {
+				if resume {
+					log.Printf("Warning: Webhooks missed failing check changes before event %d", event.ID)
+				}
+			} else {
+				d.enqueue(event)
+			}
+			lastID, resume = event.ID, true
+		}
+
+	events:
+		for {
+			select {
+			case <-d.ctx.Done():
+				sub.Close()
+				for _, queue := range d.queues {
+					close(queue)
+				}
+				return
+			case event, ok := <-sub.C():
+				if !ok {
+					break events
+				}
+				if event.Type != checkwatch.EventSnapshot {
+					d.enqueue(event)
+				}
+				lastID, resume = event.ID, true
+			}
+		}
+	}
+}
+
+// enqueue renders the event for every matching subscription
+func (d *Dispatcher) enqueue(event checkwatch.Event) {
+	var device *inventory.DeviceLocation
+	if d.locate != nil {
+		device = d.locate(event.Check.DeviceID)
+	}
+	for _, sub := range d.subs {
+		payload := NewPayload(event, device)
+		payload.Subscription = sub.Name
+		if !sub.Matches(payload) {
+			continue
+		}
+		body, err := sub.Render(payload)
+		if err != nil {
+			d.deadLetter(sub, payload, nil, 0, Result{Err: err})
+			continue
+		}
+		select {
+		case d.queues[sub] <- delivery{payload: payload, body: body}:
+		default:
+			d.deadLetter(sub, payload, body, 0, Result{Err: fmt.Errorf("queue of %d deliveries is full", queueSize)})
+		}
+	}
+}
+
+// work delivers the queue of one subscription in order
+func (d *Dispatcher) work(sub *Subscription, queue chan delivery) {
+	defer d.workers.Done()
+	for item := range queue {
+		d.deliver(sub, item)
+	}
+}
+
+// deliver sends a payload, retrying with exponential backoff. Payloads that
+// still fail, or are rejected with a non-retryable status, are dead-lettered.
+func (d *Dispatcher) deliver(sub *Subscription, item delivery) {
+	backoff := d.opts.InitialBackoff
+	var result Result
+	for attempt := 1; ; attempt++ {
+		if d.ctx.Err() != nil {
+			err := errors.New("not delivered before shutdown")
+			if result.Err != nil {
+				err = fmt.Errorf("%w, last error: %v", err, result.Err)
+			}
+			d.deadLetter(sub, item.payload, item.body, attempt-1, Result{Status: result.Status, Err: err})
+			return
+		}
+		result = d.Send(context.Background(), sub, item.payload, item.body)
+		if result.Err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(sub.Name, "delivered").Inc()
+			return
+		}
+		if !result.retryable() || attempt >= d.opts.Attempts {
+			d.deadLetter(sub, item.payload, item.body, attempt, result)
+			return
+		}
+		metrics.WebhookDeliveries.WithLabelValues(sub.Name, "retried").Inc()
+
+		wait := min(backoff, d.opts.MaxBackoff)
+		if result.RetryAfter > wait {
+			wait = min(result.RetryAfter, d.opts.MaxBackoff)
+		}
+		log.Printf("Warning: Webhook %s failed (attempt %d of %d), retrying in %s: %v", sub.Name, attempt, d.opts.Attempts, wait, result.Err)
+		select {
+		case <-time.After(wait):
+		case <-d.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+// Send makes one signed delivery attempt. A body of nil is rendered from the payload.
+func (d *Dispatcher) Send(ctx context.Context, sub *Subscription, payload *Payload, body []byte) Result {
+	if body == nil {
+		var err error
+		if body, err = sub.Render(payload); err != nil {
+			return Result{Err: err}
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nsight-proxy-webhooks")
+	req.Header.Set(HeaderEvent, payload.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(payload.ID, 10))
+	if sub.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HeaderSignature, Sign(sub.Secret, timestamp, body))
+	}
+	for name, value := range sub.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return Result{Err: err}
+	}
+	defer resp.Body.Close()
+	excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return Result{Status: resp.StatusCode}
+	}
+	result := Result{Status: resp.StatusCode, Err: fmt.Errorf("receiver returned HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(excerpt))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		result.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return result
+}
+
+// deadLetter appends an undeliverable payload to the dead-letter file
+func (d *Dispatcher) deadLetter(sub *Subscription, payload *Payload, body []byte, attempts int, result Result) {
+	metrics.WebhookDeliveries.WithLabelValues(sub.Name, "dead_letter").Inc()
+	log.Printf("Error delivering webhook %s, event %d written to dead letters after %d attempts: %v", sub.Name, payload.ID, attempts, result.Err)
+
+	record := DeadLetter{
+		Time:         time.Now().UTC(),
+		Subscription: sub.Name,
+		URL:          sub.URL,
+		Event:        payload.Event,
+		EventID:      payload.ID,
+		Attempts:     attempts,
+		Status:       result.Status,
+		Error:        fmt.Sprint(result.Err),
+		Body:         string(body),
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+	file, err := os.OpenFile(d.opts.DeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error writing webhook dead letter: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing webhook dead letter: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDispatcher creates a dispatcher without a watcher that dead-letters
+// into a temporary file
+func newTestDispatcher(t *testing.T, opts Options) *Dispatcher {
+	t.Helper()
+	opts.DeadLetter = filepath.Join(t.TempDir(), "dead.jsonl")
+	d := New(nil, nil, nil, opts)
+	t.Cleanup(d.cancel)
+	return d
+}
+
+// readDeadLetters returns the records of the dispatcher's dead-letter file
+func readDeadLetters(t *testing.T, d *Dispatcher) []DeadLetter {
+	t.Helper()
+	file, err := os.Open(d.opts.DeadLetter)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []DeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid dead letter %s: %v", scanner.Bytes(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// testDelivery renders the test payload for a generic subscription
+func testDelivery(t *testing.T, url string) (*Subscription, delivery) {
+	t.Helper()
+	sub := &Subscription{Name: "test", URL: url, Secret: "secret"}
+	payload := testPayload()
+	body, err := sub.Render(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub, delivery{payload: payload, body: body}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var verified atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		verified.Store(Verify("secret", timestamp, body, r.Header.Get(HeaderSignature)) &&
+			r.Header.Get(HeaderEvent) == "new" && r.Header.Get(HeaderDelivery) == "7")
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Options{})
+	sub, item := testDelivery(t, server.URL)
+	d.deliver(sub, item)
+
+	if !verified.Load() {
+		t.Error("receiver could not verify the delivery")
+	}
+	if records := readDeadLetters(t, d); len(records) != 0 {
+		t.Errorf("delivered payload was dead-lettered: %+v", records)
+	}
+}
+
+func TestDeliverRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Options{Attempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Second})
+	sub, item := testDelivery(t, server.URL)
+	start := time.Now()
+	d.deliver(sub, item)
+
+	if n := requests.Load(); n != 3 {
+		t.Errorf("receiver got %d requests, want 3", n)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, Retry-After asked for 1s", elapsed)
+	}
+	if records := readDeadLetters(t, d); len(records) != 0 {
+		t.Errorf("delivered payload was dead-lettered: %+v", records)
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Options{})
+	sub, item := testDelivery(t, server.URL)
+	result := d.Send(context.Background(), sub, item.payload, item.body)
+
+	if result.Status != http.StatusServiceUnavailable || result.RetryAfter != 30*time.Second || !result.retryable() {
+		t.Errorf("Send = %+v, want retryable 503 with Retry-After 30s", result)
+	}
+}
+
+func TestDeliverDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int // Requests expected before the payload is dead-lettered
+	}{
+		{"retried until attempts run out", http.StatusServiceUnavailable, 3},
+		{"not retried", http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				http.Error(w, "nope", tt.status)
+			}))
+			defer server.Close()
+
+			d := newTestDispatcher(t, Options{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+			sub, item := testDelivery(t, server.URL)
+			d.deliver(sub, item)
+
+			if n := int(requests.Load()); n != tt.attempts {
+				t.Errorf("receiver got %d requests, want %d", n, tt.attempts)
+			}
+			records := readDeadLetters(t, d)
+			if len(records) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(records))
+			}
+			record := records[0]
+			if record.Attempts != tt.attempts || record.Status != tt.status || record.EventID != 7 || record.Body != string(item.body) {
+				t.Errorf("dead letter = %+v", record)
+			}
+		})
+	}
+}
+
+func TestDeliverDeadLetterOnShutdown(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher(t, Options{Attempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	sub, item := testDelivery(t, server.URL)
+	done := make(chan struct{})
+	go func() {
+		d.deliver(sub, item)
+		close(done)
+	}()
+
+	<-requested
+	d.cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery kept waiting for a retry after shutdown")
+	}
+
+	records := readDeadLetters(t, d)
+	if len(records) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(records))
+	}
+	if record := records[0]; record.Attempts != 1 || !strings.Contains(record.Error, "shutdown") {
+		t.Errorf("dead letter = %+v", record)
+	}
+}
@@ -0,0 +1,246 @@
+// Package webhook delivers changes of the failing checks to HTTP receivers
+// such as chat and ticketing systems. Each subscription selects the changes
+// it wants and the body format; payloads are signed with HMAC-SHA256.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// Body formats of a subscription
+const (
+	FormatGeneric = "generic" // The Payload as JSON
+	FormatSlack   = "slack"   // Slack incoming webhook message
+	FormatTeams   = "teams"   // Microsoft Teams MessageCard
+)
+
+// Signature headers. The signature is the hex HMAC-SHA256 of the timestamp,
+// a dot and the body, so receivers can reject replayed deliveries.
+const (
+	HeaderSignature = "X-NSight-Signature"
+	HeaderTimestamp = "X-NSight-Timestamp"
+	HeaderEvent     = "X-NSight-Event"
+	HeaderDelivery  = "X-NSight-Delivery"
+)
+
+// builtinTemplates render the chat formats from a Payload
+var builtinTemplates = map[string]string{
+	FormatSlack: `{"text": {{json .Summary}}}`,
+	FormatTeams: `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": {{json .Color}}, ` +
+		`"summary": {{json .Summary}}, "title": {{json .Title}}, "text": {{json .Check.Message}}}`,
+}
+
+// Subscription selects changes for one receiver. Empty filters match everything.
+type Subscription struct {
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Format      string            `json:"format"`   // FormatGeneric (default), FormatSlack or FormatTeams
+	Template    string            `json:"template"` // File with a text/template for the body, overrides Format
+	Secret      string            `json:"secret"`   // HMAC key; deliveries are unsigned without it
+	Headers     map[string]string `json:"headers"`  // Extra request headers, e.g. for receiver authentication
+	Events      []string          `json:"events"`   // new, changed, resolved
+	ClientIDs   []int             `json:"client_ids"`
+	SiteIDs     []int             `json:"site_ids"`
+	MinSeverity int               `json:"min_severity"`
+	CheckNames  []string          `json:"check_names"` // Case-insensitive patterns such as "Disk*"
+
+	tmpl *template.Template
+}
+
+// LoadSubscriptions reads the subscriptions from a JSON file and compiles their templates
+func LoadSubscriptions(file string) ([]*Subscription, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks file %s: %w", file, err)
+	}
+	var subs []*Subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks file %s: %w", file, err)
+	}
+
+	names := make(map[string]bool)
+	for _, sub := range subs {
+		if sub.Name == "" || sub.URL == "" {
+			return nil, fmt.Errorf("webhook %q needs a name and a url", sub.Name)
+		}
+		if names[sub.Name] {
+			return nil, fmt.Errorf("webhook name %q is used twice", sub.Name)
+		}
+		names[sub.Name] = true
+		if err := sub.compile(); err != nil {
+			return nil, fmt.Errorf("webhook %q: %w", sub.Name, err)
+		}
+	}
+	return subs, nil
+}
+
+// compile validates the filters and parses the body template
+func (s *Subscription) compile() error {
+	for _, event := range s.Events {
+		switch event {
+		case checkwatch.EventNew, checkwatch.EventChanged, checkwatch.EventResolved:
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	for _, pattern := range s.CheckNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid check name pattern %q", pattern)
+		}
+	}
+
+	text := ""
+	switch {
+	case s.Template != "":
+		data, err := os.ReadFile(s.Template)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	case s.Format == "" || s.Format == FormatGeneric:
+		return nil
+	default:
+		var ok bool
+		if text, ok = builtinTemplates[s.Format]; !ok {
+			return fmt.Errorf("unknown format %q", s.Format)
+		}
+	}
+	tmpl, err := template.New(s.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+	if err != nil {
+		return err
+	}
+	s.tmpl = tmpl
+	return nil
+}
+
+// toJSON renders a value as JSON inside templates
+func toJSON(value any) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// Matches reports whether the subscription wants the payload. Client and site
+// filters only match devices found in the fetchall cache.
+func (s *Subscription) Matches(p *Payload) bool {
+	if len(s.Events) > 0 && !slices.Contains(s.Events, p.Event) {
+		return false
+	}
+	if p.Check.Severity < s.MinSeverity {
+		return false
+	}
+	if len(s.ClientIDs) > 0 && (p.Device == nil || !slices.Contains(s.ClientIDs, p.Device.ClientID)) {
+		return false
+	}
+	if len(s.SiteIDs) > 0 && (p.Device == nil || !slices.Contains(s.SiteIDs, p.Device.SiteID)) {
+		return false
+	}
+	if len(s.CheckNames) > 0 {
+		name := strings.ToLower(p.Check.Name)
+		for _, pattern := range s.CheckNames {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Render returns the request body for the payload
+func (s *Subscription) Render(p *Payload) ([]byte, error) {
+	if s.tmpl == nil {
+		return json.Marshal(p)
+	}
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, p); err != nil {
+		return nil, fmt.Errorf("rendering template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature of a body sent at the given time
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Payload describes one change of a failing check, with the device's place
+// in the client and site tree if it is in the fetchall cache
+type Payload struct {
+	Event        string                    `json:"event"`
+	ID           uint64                    `json:"id"`
+	Time         time.Time                 `json:"time"`
+	Subscription string                    `json:"subscription"`
+	Check        nsight.Check              `json:"check"`
+	Previous     *nsight.Check             `json:"previous,omitempty"`
+	Changes      []string                  `json:"changes,omitempty"`
+	Device       *inventory.DeviceLocation `json:"device,omitempty"`
+}
+
+// NewPayload creates the payload of a watcher event
+func NewPayload(event checkwatch.Event, device *inventory.DeviceLocation) *Payload {
+	return &Payload{
+		Event:    event.Type,
+		ID:       event.ID,
+		Time:     event.Time,
+		Check:    *event.Check,
+		Previous: event.Previous,
+		Changes:  event.Changes,
+		Device:   device,
+	}
+}
+
+// Title is a one-line headline such as "New failing check: Disk C on SRV01"
+func (p *Payload) Title() string {
+	prefix := map[string]string{
+		checkwatch.EventNew:      "New failing check",
+		checkwatch.EventChanged:  "Failing check changed",
+		checkwatch.EventResolved: "Resolved check",
+	}[p.Event]
+	return fmt.Sprintf("%s: %s on %s", prefix, p.Check.Name, p.Check.DeviceName)
+}
+
+// Summary adds the device's client and site and the check message to the title
+func (p *Payload) Summary() string {
+	summary := p.Title()
+	if p.Device != nil {
+		summary += fmt.Sprintf(" (%s / %s)", p.Device.ClientName, p.Device.SiteName)
+	}
+	if p.Check.Message != "" {
+		summary += " - " + p.Check.Message
+	}
+	return summary
+}
+
+// Color is a hex color for chat cards: red for new, amber for changed, green for resolved
+func (p *Payload) Color() string {
+	switch p.Event {
+	case checkwatch.EventNew:
+		return "D93F0B"
+	case checkwatch.EventChanged:
+		return "FBCA04"
+	}
+	return "0E8A16"
+}
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"nsight-proxy/internal/checkwatch"
+	"nsight-proxy/internal/inventory"
+	"nsight-proxy/internal/nsight"
+)
+
+// testPayload is a failing check with characters that must be escaped in JSON
+func testPayload() *Payload {
+	return &Payload{
+		Event: checkwatch.EventNew,
+		ID:    7,
+		Check: nsight.Check{
+			CheckID:    5001,
+			Name:       `Disk "C:"`,
+			DeviceID:   101,
+			DeviceName: "SRV01",
+			Severity:   2,
+			Message:    "Free space 2%\nbelow <5%> \\ limit",
+		},
+		Device: &inventory.DeviceLocation{DeviceID: 101, ClientID: 1, ClientName: "Alpha", SiteID: 11, SiteName: "HQ"},
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"event":"new"}`)
+	signature := Sign("secret", 1700000000, body)
+
+	if !Verify("secret", 1700000000, body, signature) {
+		t.Fatalf("Verify rejected its own signature %s", signature)
+	}
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+	}{
+		{"other secret", "other", 1700000000, body},
+		{"replayed timestamp", "secret", 1700000001, body},
+		{"changed body", "secret", 1700000000, []byte(`{"event":"resolved"}`)},
+	}
+	for _, tt := range tests {
+		if Verify(tt.secret, tt.timestamp, tt.body, signature) {
+			t.Errorf("%s: Verify accepted the signature", tt.name)
+		}
+	}
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	payload := testPayload()
+	for _, format := range []string{FormatSlack, FormatTeams} {
+		sub := &Subscription{Name: format, URL: "http://localhost", Format: format}
+		if err := sub.compile(); err != nil {
+			t.Fatalf("%s: compile: %v", format, err)
+		}
+		body, err := sub.Render(payload)
+		if err != nil {
+			t.Fatalf("%s: Render: %v", format, err)
+		}
+		var message map[string]any
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Fatalf("%s: rendered invalid JSON %s: %v", format, body, err)
+		}
+
+		switch format {
+		case FormatSlack:
+			if message["text"] != payload.Summary() {
+				t.Errorf("slack text = %q, want %q", message["text"], payload.Summary())
+			}
+		case FormatTeams:
+			if message["@type"] != "MessageCard" || message["themeColor"] != payload.Color() {
+				t.Errorf("teams card = %v", message)
+			}
+			if message["title"] != payload.Title() || message["text"] != payload.Check.Message {
+				t.Errorf("teams title or text = %q, %q", message["title"], message["text"])
+			}
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	sub := &Subscription{Name: "x", URL: "http://localhost", Format: "pager"}
+	if err := sub.compile(); err == nil {
+		t.Fatal("compile accepted an unknown format")
+	}
+}